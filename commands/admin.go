@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/step-sds/sds"
+	"github.com/urfave/cli"
+	"go.step.sm/cli-utils/errs"
+)
+
+// adminFlags are the flags used to connect to the admin API of a running
+// server.
+var adminFlags = []cli.Flag{
+	cli.StringFlag{
+		Name: "admin",
+		Usage: `The <address> of the admin API. UNIX domain sockets are defined with a path,
+like "/var/run/step-sds/admin.sock", or with the "unix://" prefix; any other
+address, like "127.0.0.1:9443", is used with mTLS. If it is not set, the address
+is read from the <config> file.`,
+	},
+	cli.StringFlag{
+		Name:  "crt",
+		Usage: `The path to the client certificate <file> used with an admin API on TCP.`,
+	},
+	cli.StringFlag{
+		Name:  "key",
+		Usage: `The path to the client private key <file> used with an admin API on TCP.`,
+	},
+	cli.StringFlag{
+		Name: "root",
+		Usage: `The path to the PEM <file> used to verify the certificate of an admin API on TCP.
+Defaults to the root certificate of the CA in the <config> file.`,
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: `Print the response of the admin API in JSON.`,
+	},
+}
+
+// adminClient is an HTTP client of the admin API of a running server.
+type adminClient struct {
+	client  *http.Client
+	baseURL string
+}
+
+// newAdminClient creates a client using the admin flags, or the admin
+// settings in the configuration file in the first argument.
+func newAdminClient(ctx *cli.Context) (*adminClient, error) {
+	network, address, rootFile := "", ctx.String("admin"), ctx.String("root")
+	switch {
+	case address != "":
+		var err error
+		if network, address, err = sds.ParseAdminAddress(address); err != nil {
+			return nil, err
+		}
+	case ctx.NArg() > 0:
+		c, err := sds.LoadConfiguration(ctx.Args().First())
+		if err != nil {
+			return nil, err
+		}
+		admin, ok := c.GetAdmin()
+		if !ok {
+			return nil, errors.Errorf("%s does not configure the admin API", ctx.Args().First())
+		}
+		network, address = admin.Network, admin.Address
+		if rootFile == "" {
+			rootFile = c.Provisioner.CaRoot
+		}
+	default:
+		return nil, errs.RequiredOrFlag(ctx, "admin", "config")
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tr := &http.Transport{
+		Proxy:               nil,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", address)
+		}
+		return &adminClient{
+			client:  &http.Client{Transport: tr, Timeout: time.Minute},
+			baseURL: "http://step-sds",
+		}, nil
+	}
+
+	// The admin API on TCP always requires a client certificate
+	crtFile, keyFile := ctx.String("crt"), ctx.String("key")
+	switch {
+	case crtFile == "":
+		return nil, errs.RequiredWithFlag(ctx, "admin", "crt")
+	case keyFile == "":
+		return nil, errs.RequiredWithFlag(ctx, "admin", "key")
+	}
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading client certificate")
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing address %s", address)
+	}
+	if host == "" {
+		host = "localhost"
+		address = "localhost" + address
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   host,
+		Certificates: []tls.Certificate{cert},
+	}
+	if rootFile != "" {
+		b, err := os.ReadFile(rootFile)
+		if err != nil {
+			return nil, errs.FileError(err, rootFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("error parsing %s: no certificates found", rootFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tr.DialContext = dialer.DialContext
+	tr.TLSClientConfig = tlsConfig
+	return &adminClient{
+		client:  &http.Client{Transport: tr, Timeout: time.Minute},
+		baseURL: "https://" + address,
+	}, nil
+}
+
+// Do sends a request to the admin API and decodes the response in v. It
+// returns the error in the response if the request fails.
+func (c *adminClient) Do(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to the admin API")
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "error reading response")
+	}
+	if resp.StatusCode >= 400 {
+		var e sds.AdminError
+		if err := json.Unmarshal(b, &e); err == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return errors.Errorf("admin API returned %s", resp.Status)
+	}
+	if v == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, "error parsing response")
+	}
+	return nil
+}
+
+// printJSON prints the given value in indented JSON.
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -182,14 +182,14 @@ func initAction(ctx *cli.Context) error {
 
 	// Generate SDS configuration
 	sdsConfig := sds.Config{
-		Network:               "tcp",
-		Address:               address,
-		Root:                  filepath.Join(base, "root_ca.crt"),
-		Certificate:           filepath.Join(base, "sds_server.crt"),
-		CertificateKey:        filepath.Join(base, "sds_server_key"),
-		Password:              "",
-		AuthorizedIdentity:    clientName,
-		AuthorizedFingerprint: x509util.Fingerprint(clientCert),
+		Network:                "tcp",
+		Address:                address,
+		Root:                   filepath.Join(base, "root_ca.crt"),
+		Certificate:            filepath.Join(base, "sds_server.crt"),
+		CertificateKey:         filepath.Join(base, "sds_server_key"),
+		Password:               "",
+		AuthorizedIdentities:   []string{clientName},
+		AuthorizedFingerprints: []string{x509util.Fingerprint(clientCert)},
 		Provisioner: sds.ProvisionerConfig{
 			Issuer:   prov.Name,
 			KeyID:    prov.Key.KeyID,
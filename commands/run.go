@@ -2,11 +2,12 @@ package commands
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"net"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 	"unicode"
 
@@ -18,7 +19,6 @@ import (
 	"go.step.sm/cli-utils/command"
 	"go.step.sm/cli-utils/errs"
 	"go.step.sm/cli-utils/ui"
-	"go.step.sm/crypto/pemutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
@@ -28,8 +28,10 @@ func init() {
 		Name:      "run",
 		Action:    cli.ActionFunc(runAction),
 		Usage:     "run the SDS server",
-		UsageText: "**step-sds run** <config> [--password-file=<file>] [--provisioner-password-file=<file>]",
+		UsageText: "**step-sds run** <config> [--password-file=<file>] [--provisioner-password-file=<file>] [--watch]",
 		Description: `**step-sds run** starts a secret discovery service (SDS) using the given configuration.
+The service listens on the configured network and address, and on each of the
+additional **listeners**, all of them serving the same secrets.
 
 ## POSITIONAL ARGUMENTS
 
@@ -37,6 +39,56 @@ func init() {
 : File that configures the operation of the Step SDS; this file is generated
 when you initialize the Step SDS using **step-sds init**
 
+## HEALTH
+
+The standard gRPC health service (**grpc.health.v1.Health**) is registered on
+all the listeners. It reports NOT_SERVING until the CA is reachable and the
+certificates of the resources configured with a literal name are signed, and
+it goes back to NOT_SERVING if the CA is unreachable for more than five minutes
+or when the server is stopping. The **step-sds.CA** service reports if the CA
+of every provisioner is reachable.
+
+## DEGRADED MODE
+
+If the CA is not reachable on start, the server starts anyway and retries the
+initialization of the provisioners every ten seconds. Until then, the secrets
+in memory or in the **state** directory are served and renewed when the CA is
+back, and requests for new secrets fail with UNAVAILABLE.
+
+## ADMIN API
+
+If **admin** is configured, an HTTP API is served on its network and address
+to list the active streams and the secrets served, to renew a secret
+immediately, and to close a stream. On TCP, clients require a certificate
+matching **authorizedIdentities** or **authorizedFingerprints**; on UNIX domain
+sockets, the socket file is only accessible by its owner unless **socketMode**
+is set.
+
+## TRACING
+
+If **tracing** is configured, a span is exported for each SDS stream or fetch
+request, with child spans for the token generation and the requests to the CA.
+The W3C trace context sent by the clients is used as the parent of the spans,
+and it is propagated to the CA. The tracing settings are only applied on start.
+
+## STATE
+
+If **state** is configured, the certificates, their private keys encrypted with
+the state **password** or the provisioner password, and the roots are stored in
+its **directory**. After a restart, the secrets that are still valid are served
+without contacting the CA, and they are renewed on their normal schedule.
+Expired secrets are removed on start, and secrets not requested for five
+minutes are removed with their renewal.
+
+## RELOAD
+
+Sending a SIGHUP signal to the process, or changing the <config> file if
+**--watch** is used, reloads the configuration without interrupting the
+existing streams. The authorization settings, logger, TLS material, resource
+profiles, and provisioners are updated at once. If the new configuration is not
+valid, the error is logged and the current configuration is kept. The
+listeners, their networks and their addresses cannot change without a restart.
+
 ## EXIT CODES
 
 This command will run indefinitely on success and return \>0 if any error occurs.
@@ -58,6 +110,11 @@ automating deployment:
 $ step-sds $STEPPATH/config/sds.json \
 	--password-file ./certificate-key-password.txt \
 	--provisioner-password-file ./provisioner-password.txt
+'''
+
+Run the Step SDS and reload the configuration when it changes:
+'''
+$ step-sds $STEPPATH/config/sds.json --watch
 '''`,
 		Flags: []cli.Flag{
 			cli.StringFlag{
@@ -68,24 +125,107 @@ $ step-sds $STEPPATH/config/sds.json \
 				Name:  "provisioner-password-file",
 				Usage: `Path to the <file> containing the provisioning password.`,
 			},
+			cli.BoolFlag{
+				Name:  "watch",
+				Usage: `Reload the configuration when the <config> file changes.`,
+			},
 		},
 	})
 }
 
-// stopper is a wrapper to be able to use the ca.StopHandler.
+// stopper is a wrapper to be able to use the ca.StopReloaderHandler.
 type stopper struct {
-	srv *grpc.Server
-	sds *sds.Service
+	m                sync.Mutex
+	servers          []*grpc.Server
+	rest             *http.Server
+	metrics          *http.Server
+	admin            *http.Server
+	tracing          func(context.Context) error
+	sds              *sds.Service
+	reloaders        []*sds.TLSReloader
+	filename         string
+	passwordFile     string
+	provPasswordFile string
+	config           sds.Config
 }
 
+// Stop sets the health service as NOT_SERVING and stops the service and the
+// servers.
 func (s *stopper) Stop() error {
 	if err := s.sds.Stop(); err != nil {
 		return err
 	}
-	s.srv.GracefulStop()
+	for _, r := range s.reloaders {
+		r.Stop()
+	}
+	for _, srv := range []*http.Server{s.rest, s.metrics, s.admin} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(context.Background()); err != nil {
+			return err
+		}
+	}
+	// Streams are closed when the service stops, so their spans are already
+	// ended and can be flushed before stopping the listeners.
+	if err := s.tracing(context.Background()); err != nil {
+		return err
+	}
+	// The default listener is stopped last because runAction returns when it
+	// stops, and the rest of the listeners need to remove their sockets.
+	for i := len(s.servers) - 1; i >= 0; i-- {
+		s.servers[i].GracefulStop()
+	}
+	return nil
+}
+
+// Reload reads the configuration file again and applies it to the running
+// service without interrupting the existing streams. Passwords that are not in
+// the configuration or in a password file are kept. If the new configuration is
+// not valid, the current one is kept.
+func (s *stopper) Reload() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	logger := s.sds.Logger()
+	c, err := sds.LoadConfiguration(s.filename)
+	if err == nil {
+		err = setPasswords(&c, s.passwordFile, s.provPasswordFile, func() (string, error) {
+			return s.config.Provisioner.Password, nil
+		})
+	}
+	if err == nil {
+		if c.Password == "" && s.passwordFile == "" {
+			c.Password = s.config.Password
+		}
+		err = s.sds.Reload(c)
+	}
+	if err != nil {
+		logger.WithError(err).Error("Error reloading configuration, the current configuration is kept")
+		return err
+	}
+
+	s.config = c
+	logger.Info("Configuration reloaded")
 	return nil
 }
 
+// watch reloads the configuration when the modification time of the
+// configuration file changes.
+func (s *stopper) watch() {
+	last := sds.ModTime(s.filename)
+	for range time.Tick(configWatchInterval) {
+		if mt := sds.ModTime(s.filename); !mt.Equal(last) {
+			last = mt
+			_ = s.Reload()
+		}
+	}
+}
+
+// configWatchInterval is the interval used to check if the configuration file
+// has changed when --watch is used.
+const configWatchInterval = 5 * time.Second
+
 func runAction(ctx *cli.Context) error {
 	if ctx.NArg() == 0 {
 		return cli.ShowAppHelp(ctx)
@@ -95,112 +235,276 @@ func runAction(ctx *cli.Context) error {
 		return err
 	}
 
-	c, err := sds.LoadConfiguration(ctx.Args().First())
+	filename := ctx.Args().First()
+	c, err := sds.LoadConfiguration(filename)
 	if err != nil {
 		return err
 	}
 
 	passwordFile := ctx.String("password-file")
 	provPasswordFile := ctx.String("provisioner-password-file")
-	if provPasswordFile == "" && c.Provisioner.Password == "" {
+	if err := setPasswords(&c, passwordFile, provPasswordFile, func() (string, error) {
 		password, err := ui.PromptPassword("Please enter the password to decrypt the provisioner key")
-		if err != nil {
-			return err
-		}
-		c.Provisioner.Password = string(password)
+		return string(password), err
+	}); err != nil {
+		return err
 	}
-	if provPasswordFile != "" {
-		b, err := readPasswordFromFile(provPasswordFile)
-		if err != nil {
-			return err
-		}
-		c.Provisioner.Password = string(b)
+
+	// Tracing is configured before the service so all the spans are exported
+	shutdownTracing, err := sds.StartTracing(context.Background(), c.Tracing)
+	if err != nil {
+		return err
 	}
 
-	logger, err := logging.New("step-sds", c.Logger)
+	s, err := sds.New(c)
 	if err != nil {
-		return errors.Wrap(err, "error initializing logger")
+		_ = shutdownTracing(context.Background())
+		return err
+	}
+	logger := s.Logger()
+	if c.Tracing != nil {
+		logger.Infof("Exporting traces to %s ...", c.Tracing.Endpoint)
 	}
 
-	// Start gRPC server
-	opts := []grpc.ServerOption{
-		grpc.ChainUnaryInterceptor(logging.UnaryServerInterceptor(logger)),
-		grpc.ChainStreamInterceptor(logging.StreamServerInterceptor(logger)),
+	st := &stopper{
+		tracing:          shutdownTracing,
+		sds:              s,
+		filename:         filename,
+		passwordFile:     passwordFile,
+		provPasswordFile: provPasswordFile,
+		config:           c,
 	}
 
-	if c.IsTCP() {
-		// Parse certificate
-		crtPEM, err := os.ReadFile(c.Certificate)
+	// On errors, stop the service, the renewers, the tracer provider and the
+	// servers already started.
+	var listeners []net.Listener
+	var done bool
+	defer func() {
+		if !done {
+			closeListeners(listeners)
+			_ = st.Stop()
+		}
+	}()
+
+	// Start one gRPC server for each listener, all of them share the same
+	// service and secrets
+	var tlsConfig *tls.Config
+	for _, l := range c.GetListeners() {
+		srv, reloader, err := newServer(s, l)
 		if err != nil {
 			return err
 		}
-		// Parse key, it can be encrypted
-		pemOpts := []pemutil.Options{
-			pemutil.WithFilename(c.CertificateKey),
-		}
-		if passwordFile != "" {
-			pemOpts = append(pemOpts, pemutil.WithPasswordFile(passwordFile))
-		} else if c.Password != "" {
-			pemOpts = append(pemOpts, pemutil.WithPassword([]byte(c.Password)))
-		}
-		keyBytes, err := os.ReadFile(c.CertificateKey)
-		if err != nil {
-			return errs.FileError(err, c.CertificateKey)
+		if reloader != nil {
+			st.reloaders = append(st.reloaders, reloader)
+			if l.Name == sds.DefaultListenerName {
+				tlsConfig = reloader.TLSConfig()
+			}
 		}
-		key, err := pemutil.Parse(keyBytes, pemOpts...)
+		lis, err := sds.Listen(l)
 		if err != nil {
 			return err
 		}
-		keyPEM, err := pemutil.Serialize(key)
+		st.servers = append(st.servers, srv)
+		listeners = append(listeners, lis)
+	}
+
+	// Start the optional REST-JSON server using the TLS configuration of the
+	// default listener on TCP.
+	if rl, ok := c.GetREST(); ok {
+		restLis, err := sds.Listen(rl)
 		if err != nil {
 			return err
 		}
-		// Load TLS certificate and create TLS config
-		cert, err := tls.X509KeyPair(crtPEM, pem.EncodeToMemory(keyPEM))
-		if err != nil {
-			return errors.Wrap(err, "error loading certificate")
+		var restTLSConfig *tls.Config
+		if rl.IsTCP() {
+			restTLSConfig = tlsConfig
 		}
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			MinVersion:   tls.VersionTLS12,
+		restSrv := &http.Server{
+			Handler:           s.RESTHandler(),
+			TLSConfig:         restTLSConfig,
+			ReadHeaderTimeout: 15 * time.Second,
 		}
-		if c.Root != "" {
-			b, err := os.ReadFile(c.Root)
-			if err != nil {
-				return errs.FileError(err, c.Root)
+		if restTLSConfig == nil {
+			restSrv.ConnContext = sds.PeerCredentialsConnContext
+		}
+		go func() {
+			var err error
+			if restTLSConfig != nil {
+				err = restSrv.ServeTLS(restLis, "", "")
+			} else {
+				err = restSrv.Serve(restLis)
 			}
-			pool := x509.NewCertPool()
-			if !pool.AppendCertsFromPEM(b) {
-				return errors.Errorf("failed to successfully load root certificates from %s", c.Root)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.WithError(err).Error("error serving REST")
 			}
-			tlsConfig.ClientCAs = pool
+		}()
+		st.rest = restSrv
+		logger.WithFields(logging.Fields{
+			"http.start_time": time.Now().Format(logger.GetTimeFormat()),
+		}).Infof("Serving REST at %s://%s ...", rl.Network, restLis.Addr())
+	}
+
+	// Start the optional Prometheus metrics server
+	if c.MetricsAddress != "" {
+		metricsLis, err := net.Listen("tcp", c.MetricsAddress)
+		if err != nil {
+			return errors.Wrapf(err, "error listening using network 'tcp' and address '%s'", c.MetricsAddress)
 		}
-		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		metricsSrv := &http.Server{
+			Handler:           s.MetricsHandler(),
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		go func() {
+			if err := metricsSrv.Serve(metricsLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.WithError(err).Error("error serving metrics")
+			}
+		}()
+		st.metrics = metricsSrv
+		logger.Infof("Serving metrics at http://%s%s ...", metricsLis.Addr(), sds.MetricsPath)
 	}
 
-	lis, err := net.Listen(c.Network, c.Address)
-	if err != nil {
-		return errors.Wrapf(err, "error listening using network '%s' and address '%s'", c.Network, c.Address)
+	// Start the optional admin API, it requires mTLS on TCP, and it uses the
+	// permissions of the socket file on UNIX domain sockets.
+	if admin, ok := c.GetAdmin(); ok {
+		var adminTLSConfig *tls.Config
+		if admin.IsTCP() {
+			reloader, err := s.NewTLSReloader(admin)
+			if err != nil {
+				return err
+			}
+			st.reloaders = append(st.reloaders, reloader)
+			adminTLSConfig = reloader.TLSConfig()
+		}
+		adminLis, err := sds.Listen(admin)
+		if err != nil {
+			return err
+		}
+		adminSrv := &http.Server{
+			Handler:           s.AdminHandler(),
+			TLSConfig:         adminTLSConfig,
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		if adminTLSConfig == nil {
+			adminSrv.ConnContext = sds.PeerCredentialsConnContext
+		}
+		go func() {
+			var err error
+			if adminTLSConfig != nil {
+				err = adminSrv.ServeTLS(adminLis, "", "")
+			} else {
+				err = adminSrv.Serve(adminLis)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.WithError(err).Error("error serving admin API")
+			}
+		}()
+		st.admin = adminSrv
+		logger.Infof("Serving admin API at %s://%s ...", admin.Network, adminLis.Addr())
 	}
 
-	s, err := sds.New(c)
-	if err != nil {
-		return err
+	go ca.StopReloaderHandler(st)
+
+	// The health service reports SERVING once the CA is reachable and the
+	// pre-configured secrets are signed, and NOT_SERVING when the CA is down
+	// for too long or after the stopper is called.
+	s.StartHealthCheck()
+	if ctx.Bool("watch") {
+		go st.watch()
 	}
 
-	srv := grpc.NewServer(opts...)
-	s.Register(srv)
-	go ca.StopHandler(&stopper{srv: srv, sds: s})
+	// Additional listeners are served in the background
+	for i := 1; i < len(st.servers); i++ {
+		srv, lis, name := st.servers[i], listeners[i], c.Listeners[i-1].Name
+		go func() {
+			if err := srv.Serve(lis); err != nil {
+				logger.WithError(err).Errorf("error serving gRPC on listener %s", name)
+			}
+		}()
+		logger.WithFields(logging.Fields{
+			"grpc.start_time": time.Now().Format(logger.GetTimeFormat()),
+			"grpc.listener":   name,
+		}).Infof("Serving at %s://%s ...", lis.Addr().Network(), lis.Addr())
+	}
 
 	fields := logging.Fields{
 		"grpc.start_time": time.Now().Format(logger.GetTimeFormat()),
 	}
-	logger.WithFields(fields).Infof("Serving at %s://%s ...", c.Network, lis.Addr())
-	if err := srv.Serve(lis); err != nil {
+	logger.WithFields(fields).Infof("Serving at %s://%s ...", c.Network, listeners[0].Addr())
+	if err := st.servers[0].Serve(listeners[0]); err != nil {
 		return errors.Wrap(err, "error serving gRPC")
 	}
 
+	done = true
+	return nil
+}
+
+// closeListeners closes the given listeners, removing their socket files.
+func closeListeners(listeners []net.Listener) {
+	for _, lis := range listeners {
+		lis.Close()
+	}
+}
+
+// newServer creates the gRPC server for the given listener. Requests are
+// validated with the authorization settings of the listener.
+func newServer(s *sds.Service, l sds.ListenerConfig) (*grpc.Server, *sds.TLSReloader, error) {
+	logger := s.Logger()
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			sds.UnaryListenerInterceptor(l.Name),
+			logging.UnaryServerInterceptor(logger),
+		),
+		grpc.ChainStreamInterceptor(
+			sds.StreamListenerInterceptor(l.Name),
+			logging.StreamServerInterceptor(logger),
+		),
+	}
+
+	var reloader *sds.TLSReloader
+	if l.IsTCP() {
+		// The certificate is renewed by the CA or reloaded from disk, and the
+		// client roots are refreshed the same way.
+		var err error
+		if reloader, err = s.NewTLSReloader(l); err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.TLSConfig())))
+	} else {
+		// Attach the credentials of the peer process to UNIX domain socket
+		// connections
+		opts = append(opts, grpc.Creds(sds.NewPeerCredentials()))
+	}
+
+	srv := grpc.NewServer(opts...)
+	s.Register(srv)
+	return srv, reloader, nil
+}
+
+// setPasswords sets the key and provisioner passwords from the password files.
+// If the provisioner password is not in the configuration or in a file, the
+// given function is used to get it.
+func setPasswords(c *sds.Config, passwordFile, provPasswordFile string, provPassword func() (string, error)) error {
+	if passwordFile != "" {
+		b, err := readPasswordFromFile(passwordFile)
+		if err != nil {
+			return err
+		}
+		c.Password = string(b)
+	}
+	switch {
+	case provPasswordFile != "":
+		b, err := readPasswordFromFile(provPasswordFile)
+		if err != nil {
+			return err
+		}
+		c.Provisioner.Password = string(b)
+	case c.Provisioner.Password == "":
+		password, err := provPassword()
+		if err != nil {
+			return err
+		}
+		c.Provisioner.Password = password
+	}
 	return nil
 }
 
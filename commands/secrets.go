@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/smallstep/step-sds/sds"
+	"github.com/urfave/cli"
+	"go.step.sm/cli-utils/command"
+	"go.step.sm/cli-utils/errs"
+)
+
+func init() {
+	command.Register(cli.Command{
+		Name:      "secrets",
+		Usage:     "list and renew the secrets of a running SDS server",
+		UsageText: "**step-sds secrets** <subcommand> [arguments] [global-flags] [subcommand-flags]",
+		Description: `**step-sds secrets** command group provides commands to list and renew the
+secrets served by a running SDS server using its admin API.
+
+## EXAMPLES
+
+List the secrets served:
+'''
+$ step-sds secrets list $STEPPATH/config/sds.json
+'''
+
+Renew the certificate of a resource and push it to the subscribed clients:
+'''
+$ step-sds secrets renew $STEPPATH/config/sds.json foo.smallstep.com
+'''`,
+		Subcommands: cli.Commands{
+			{
+				Name:      "list",
+				Action:    cli.ActionFunc(secretsListAction),
+				Usage:     "list the secrets of a running SDS server",
+				UsageText: "**step-sds secrets list** [<config>] [--admin=<address>] [--crt=<file>] [--key=<file>] [--root=<file>] [--json]",
+				Description: `**step-sds secrets list** prints the secrets in the cache of a running SDS
+server, with the serial number and expiration of their certificates, the number
+of subscribed clients, the next renewal, and the last renewal error.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step SDS; the address of the admin
+API is read from its **admin** property if **--admin** is not used
+
+## EXAMPLES
+
+List the secrets of the server with an admin API on a UNIX domain socket:
+'''
+$ step-sds secrets list --admin /var/run/step-sds/admin.sock
+'''
+
+List the secrets in JSON:
+'''
+$ step-sds secrets list $STEPPATH/config/sds.json --json
+'''`,
+				Flags: adminFlags,
+			},
+			{
+				Name:      "renew",
+				Action:    cli.ActionFunc(secretsRenewAction),
+				Usage:     "renew a secret of a running SDS server",
+				UsageText: "**step-sds secrets renew** [<config>] <name> [--admin=<address>] [--crt=<file>] [--key=<file>] [--root=<file>] [--json]",
+				Description: `**step-sds secrets renew** renews immediately the certificates with the given
+resource name and pushes them to the subscribed clients. The renewed secrets
+are printed after the renewal.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step SDS; the address of the admin
+API is read from its **admin** property if **--admin** is not used
+
+<name>
+: The resource name of the secret to renew
+
+## EXAMPLES
+
+Renew the certificate of a resource:
+'''
+$ step-sds secrets renew $STEPPATH/config/sds.json foo.smallstep.com
+'''
+
+Renew the certificate of a resource using an admin API on a UNIX domain socket:
+'''
+$ step-sds secrets renew --admin /var/run/step-sds/admin.sock foo.smallstep.com
+'''`,
+				Flags: adminFlags,
+			},
+		},
+	})
+}
+
+func secretsListAction(ctx *cli.Context) error {
+	if err := errs.MinMaxNumberOfArguments(ctx, 0, 1); err != nil {
+		return err
+	}
+	client, err := newAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var secrets []sds.SecretStatus
+	if err := client.Do("GET", sds.AdminSecretsPath, &secrets); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(secrets)
+	}
+	printSecrets(secrets)
+	return nil
+}
+
+func secretsRenewAction(ctx *cli.Context) error {
+	// The name is the last argument, the config the first one if given
+	var name string
+	switch {
+	case ctx.String("admin") != "":
+		if err := errs.NumberOfArguments(ctx, 1); err != nil {
+			return err
+		}
+		name = ctx.Args().First()
+	default:
+		if err := errs.NumberOfArguments(ctx, 2); err != nil {
+			return err
+		}
+		name = ctx.Args().Get(1)
+	}
+	client, err := newAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var secrets []sds.SecretStatus
+	path := sds.AdminSecretsPath + "/" + url.PathEscape(name) + "/renew"
+	if err := client.Do("POST", path, &secrets); err != nil {
+		return err
+	}
+	if ctx.Bool("json") {
+		return printJSON(secrets)
+	}
+	fmt.Printf("Renewed %s.\n", name)
+	printSecrets(secrets)
+	return nil
+}
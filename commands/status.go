@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/smallstep/step-sds/sds"
+	"github.com/urfave/cli"
+	"go.step.sm/cli-utils/command"
+	"go.step.sm/cli-utils/errs"
+)
+
+func init() {
+	command.Register(cli.Command{
+		Name:      "status",
+		Action:    cli.ActionFunc(statusAction),
+		Usage:     "print the status of a running SDS server",
+		UsageText: "**step-sds status** [<config>] [--admin=<address>] [--crt=<file>] [--key=<file>] [--root=<file>] [--json]",
+		Description: `**step-sds status** prints the active streams and the secrets served by a
+running SDS server using its admin API. Each stream is printed with the node
+and cluster of the client, its peer, and the resources it is subscribed to;
+each secret with the expiration of its certificate and its next renewal.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step SDS; the address of the admin
+API is read from its **admin** property if **--admin** is not used
+
+## EXIT CODES
+
+This command returns 0 on success and \>0 if any error occurs.
+
+## EXAMPLES
+
+Print the status of the server using its configuration:
+'''
+$ step-sds status $STEPPATH/config/sds.json
+'''
+
+Print the status of the server with an admin API on a UNIX domain socket:
+'''
+$ step-sds status --admin /var/run/step-sds/admin.sock
+'''
+
+Print the status of the server with an admin API on TCP in JSON:
+'''
+$ step-sds status --admin 127.0.0.1:9443 \
+	--crt admin.crt --key admin.key --root root_ca.crt --json
+'''`,
+		Flags: adminFlags,
+	})
+}
+
+func statusAction(ctx *cli.Context) error {
+	if err := errs.MinMaxNumberOfArguments(ctx, 0, 1); err != nil {
+		return err
+	}
+	client, err := newAdminClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var streams []sds.StreamStatus
+	if err := client.Do("GET", sds.AdminStreamsPath, &streams); err != nil {
+		return err
+	}
+	var secrets []sds.SecretStatus
+	if err := client.Do("GET", sds.AdminSecretsPath, &secrets); err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(struct {
+			Streams []sds.StreamStatus `json:"streams"`
+			Secrets []sds.SecretStatus `json:"secrets"`
+		}{streams, secrets})
+	}
+
+	fmt.Printf("Streams (%d):\n", len(streams))
+	printStreams(streams)
+	fmt.Printf("\nSecrets (%d):\n", len(secrets))
+	printSecrets(secrets)
+	return nil
+}
+
+// printStreams prints the given streams in a table.
+func printStreams(streams []sds.StreamStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROTOCOL\tLISTENER\tNODE\tCLUSTER\tPEER\tRESOURCES\tAGE")
+	for _, s := range streams {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.ID, s.Protocol, s.Listener, orDash(s.Node), orDash(s.Cluster),
+			streamPeer(s), orDash(strings.Join(s.ResourceNames, ",")),
+			formatDuration(time.Since(s.StartedAt)))
+	}
+	w.Flush()
+}
+
+// printSecrets prints the given secrets in a table, one row per certificate.
+func printSecrets(secrets []sds.SecretStatus) {
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tID\tSUBSCRIBERS\tSERIAL\tEXPIRES\tNEXT RENEWAL\tLAST ERROR")
+	for _, s := range secrets {
+		serial, expires, next := "-", "-", "-"
+		if !s.NextRenewal.IsZero() {
+			next = formatTime(s.NextRenewal, now)
+		}
+		if len(s.Certificates) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+				s.Name, s.ID, s.Subscribers, serial, expires, next, orDash(s.LastError))
+		}
+		for _, c := range s.Certificates {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+				s.Name, s.ID, s.Subscribers, c.SerialNumber, formatTime(c.NotAfter, now), next, orDash(s.LastError))
+		}
+	}
+	w.Flush()
+}
+
+// streamPeer returns the identity of the client of a stream: the identities
+// in its certificate, the credentials of its process, or its address.
+func streamPeer(s sds.StreamStatus) string {
+	switch {
+	case len(s.Identities) > 0:
+		return strings.Join(s.Identities, ",")
+	case s.Process != nil:
+		return fmt.Sprintf("pid=%d,uid=%d", s.Process.PID, s.Process.UID)
+	default:
+		return orDash(s.Address)
+	}
+}
+
+// formatTime returns the given time in RFC 3339 with the duration from now.
+func formatTime(t, now time.Time) string {
+	d := t.Sub(now)
+	if d < 0 {
+		return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), formatDuration(-d))
+	}
+	return fmt.Sprintf("%s (in %s)", t.Local().Format(time.RFC3339), formatDuration(d))
+}
+
+// formatDuration returns the given duration rounded to seconds.
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPServerMiddleware returns a new http middleware that adds a logrus.Entry
+// to the request context and logs the request when it finishes.
+func HTTPServerMiddleware(logger *Logger) func(next http.Handler) http.Handler {
+	loggerImpl := logger.GetImpl()
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			t1 := time.Now()
+			timeFormat := logger.GetTimeFormat()
+			requestID, _ := GetRequestID(r.Context())
+			entry := logrus.NewEntry(loggerImpl).WithFields(logrus.Fields{
+				"system":          "http",
+				"span.kind":       "server",
+				"http.method":     r.Method,
+				"http.path":       r.URL.Path,
+				"http.start_time": t1.Format(timeFormat),
+				"peer.address":    r.RemoteAddr,
+				"request.id":      requestID,
+			})
+			if r.TLS != nil {
+				if s, ok := getCommonName(*r.TLS); ok {
+					entry = entry.WithField("peer.identity", s)
+				}
+			}
+
+			rw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			ctx := WithRequestEntry(r.Context(), entry)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+			duration := time.Since(t1)
+
+			// Write log
+			entry = GetRequestEntry(ctx).WithFields(logrus.Fields{
+				"http.status":      rw.status,
+				"http.duration":    duration.String(),
+				"http.duration-ns": duration.Nanoseconds(),
+			})
+			msg := "finished http call with status " + strconv.Itoa(rw.status)
+			switch {
+			case rw.status >= http.StatusInternalServerError:
+				entry.Error(msg)
+			case rw.status >= http.StatusBadRequest:
+				entry.Warn(msg)
+			default:
+				entry.Info(msg)
+			}
+		}
+		// The trace header can change with a reload
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			RequestID(logger.GetTraceHeader())(http.HandlerFunc(fn)).ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusResponseWriter is an http.ResponseWriter that records the status code.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
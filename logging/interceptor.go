@@ -40,12 +40,13 @@ func (t interceptorType) String() string {
 // UnaryServerInterceptor returns a new unary server interceptors that adds logrus.Entry to the context.
 func UnaryServerInterceptor(logger *Logger) grpc.UnaryServerInterceptor {
 	loggerImpl := logger.GetImpl()
-	traceHeader := strings.ToLower(logger.GetTraceHeader())
-	timeFormat := logger.GetTimeFormat()
 
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 		var requestID string
 		t1 := time.Now()
+		// The trace header and time format can change with a reload
+		traceHeader := strings.ToLower(logger.GetTraceHeader())
+		timeFormat := logger.GetTimeFormat()
 
 		// Get or set request id
 		ctx, requestID = getRequestID(ctx, traceHeader)
@@ -67,11 +68,12 @@ func UnaryServerInterceptor(logger *Logger) grpc.UnaryServerInterceptor {
 // StreamServerInterceptor returns a new streaming server interceptor that adds logrus.Entry to the context.
 func StreamServerInterceptor(logger *Logger) grpc.StreamServerInterceptor {
 	loggerImpl := logger.GetImpl()
-	traceHeader := strings.ToLower(logger.GetTraceHeader())
-	timeFormat := logger.GetTimeFormat()
 
 	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 		t1 := time.Now()
+		// The trace header and time format can change with a reload
+		traceHeader := strings.ToLower(logger.GetTraceHeader())
+		timeFormat := logger.GetTimeFormat()
 
 		// Get or set request id
 		ctx, requestID := getRequestID(stream.Context(), traceHeader)
@@ -3,6 +3,7 @@ package logging
 import (
 	"encoding/json"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -22,6 +23,7 @@ type Fields = logrus.Fields
 type Logger struct {
 	*logrus.Logger
 	name        string
+	m           sync.RWMutex
 	traceHeader string
 	timeFormat  string
 }
@@ -35,18 +37,9 @@ type loggerConfig struct {
 
 // New initializes the logger with the given options.
 func New(name string, raw json.RawMessage) (*Logger, error) {
-	var config loggerConfig
-	if err := json.Unmarshal(raw, &config); err != nil {
-		return nil, errors.Wrap(err, "error unmarshaling logging attribute")
-	}
-
-	var formatter logrus.Formatter
-	switch strings.ToLower(config.Format) {
-	case "", "text":
-	case "json":
-		formatter = new(logrus.JSONFormatter)
-	default:
-		return nil, errors.Errorf("unsupported logger.format '%s'", config.Format)
+	config, formatter, err := parseConfig(raw)
+	if err != nil {
+		return nil, err
 	}
 
 	logger := &Logger{
@@ -61,6 +54,44 @@ func New(name string, raw json.RawMessage) (*Logger, error) {
 	return logger, nil
 }
 
+// Reload updates the format, trace header and time format of the logger. The
+// logger is not modified if the options are not valid.
+func (l *Logger) Reload(raw json.RawMessage) error {
+	config, formatter, err := parseConfig(raw)
+	if err != nil {
+		return err
+	}
+	if formatter == nil {
+		formatter = new(logrus.TextFormatter)
+	}
+	l.SetFormatter(formatter)
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.traceHeader = config.TraceHeader
+	l.timeFormat = config.TimeFormat
+	return nil
+}
+
+// parseConfig parses the logger options and returns the formatter to use, a
+// nil formatter is the default text formatter.
+func parseConfig(raw json.RawMessage) (loggerConfig, logrus.Formatter, error) {
+	var config loggerConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, nil, errors.Wrap(err, "error unmarshaling logging attribute")
+	}
+
+	var formatter logrus.Formatter
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+	case "json":
+		formatter = new(logrus.JSONFormatter)
+	default:
+		return config, nil, errors.Errorf("unsupported logger.format '%s'", config.Format)
+	}
+	return config, formatter, nil
+}
+
 // GetImpl returns the real implementation of the logger.
 func (l *Logger) GetImpl() *logrus.Logger {
 	return l.Logger
@@ -68,6 +99,8 @@ func (l *Logger) GetImpl() *logrus.Logger {
 
 // GetTraceHeader returns the trace header configured
 func (l *Logger) GetTraceHeader() string {
+	l.m.RLock()
+	defer l.m.RUnlock()
 	if l.traceHeader == "" {
 		return defaultTraceIDHeader
 	}
@@ -76,6 +109,8 @@ func (l *Logger) GetTraceHeader() string {
 
 // GetTimeFormat return the string to format the time.
 func (l *Logger) GetTimeFormat() string {
+	l.m.RLock()
+	defer l.m.RUnlock()
 	if l.timeFormat == "" {
 		return time.RFC3339
 	}
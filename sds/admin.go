@@ -0,0 +1,301 @@
+package sds
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/step-sds/logging"
+	"go.step.sm/crypto/x509util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdminListenerName is the name of the listener of the admin API.
+const AdminListenerName = "admin"
+
+// Paths of the admin API.
+const (
+	// AdminStreamsPath lists the active streams, and DELETE
+	// AdminStreamsPath/{id} closes a stream.
+	AdminStreamsPath = "/streams"
+	// AdminSecretsPath lists the secrets in the cache, and POST
+	// AdminSecretsPath/{name}/renew renews a secret immediately.
+	AdminSecretsPath = "/secrets"
+)
+
+// StreamStatus is the state of an active stream returned by the admin API.
+type StreamStatus struct {
+	ID            string         `json:"id"`
+	Protocol      string         `json:"protocol"`
+	Listener      string         `json:"listener"`
+	Address       string         `json:"address,omitempty"`
+	Identities    []string       `json:"identities,omitempty"`
+	Process       *ProcessStatus `json:"process,omitempty"`
+	Node          string         `json:"node,omitempty"`
+	Cluster       string         `json:"cluster,omitempty"`
+	ResourceNames []string       `json:"resourceNames"`
+	StartedAt     time.Time      `json:"startedAt"`
+}
+
+// ProcessStatus contains the credentials of the peer process of a stream on
+// a UNIX domain socket.
+type ProcessStatus struct {
+	UID        uint32 `json:"uid"`
+	GID        uint32 `json:"gid"`
+	PID        int32  `json:"pid"`
+	Executable string `json:"executable,omitempty"`
+}
+
+// SecretStatus is the state of a secret in the cache returned by the admin
+// API. Secrets with the same name signed with different parameters, for
+// example for different nodes, have different ids.
+type SecretStatus struct {
+	ID           string              `json:"id"`
+	Name         string              `json:"name"`
+	Provisioner  string              `json:"provisioner,omitempty"`
+	References   int                 `json:"references"`
+	Subscribers  int                 `json:"subscribers"`
+	Certificates []CertificateStatus `json:"certificates"`
+	Roots        []string            `json:"roots"`
+	LastRenewal  *time.Time          `json:"lastRenewal,omitempty"`
+	NextRenewal  time.Time           `json:"nextRenewal"`
+	LastError    string              `json:"lastError,omitempty"`
+	Failures     int                 `json:"failures,omitempty"`
+}
+
+// CertificateStatus contains the details of a certificate served.
+type CertificateStatus struct {
+	SerialNumber string    `json:"serialNumber"`
+	Subject      string    `json:"subject"`
+	DNSNames     []string  `json:"dnsNames,omitempty"`
+	IPAddresses  []string  `json:"ipAddresses,omitempty"`
+	URIs         []string  `json:"uris,omitempty"`
+	Fingerprint  string    `json:"fingerprint"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	RenewAt      time.Time `json:"renewAt"`
+}
+
+// AdminError is the body of the errors returned by the admin API.
+type AdminError struct {
+	Error string `json:"error"`
+}
+
+// ParseAdminAddress returns the network and address of the admin API in the
+// given address. UNIX domain sockets are paths or addresses with the "unix://"
+// prefix, any other address uses TCP. Abstract sockets are not allowed, as in
+// the admin configuration.
+func ParseAdminAddress(s string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		network, address = "unix", strings.TrimPrefix(s, "unix://")
+	case strings.HasPrefix(s, "https://"):
+		network, address = "tcp", strings.TrimPrefix(s, "https://")
+	case strings.HasPrefix(s, "/"), strings.HasPrefix(s, "@"), strings.HasPrefix(s, "."):
+		network, address = "unix", s
+	default:
+		network, address = "tcp", s
+	}
+	if network == "unix" && isAbstractSocket(address) {
+		return "", "", errAbstractAdminAddress(address)
+	}
+	return network, address, nil
+}
+
+// errAbstractAdminAddress returns the error used for an admin API on an
+// abstract socket.
+func errAbstractAdminAddress(address string) error {
+	return errors.Errorf("admin.address %s cannot be an abstract socket", address)
+}
+
+// AdminHandler returns the http.Handler that serves the admin API. The
+// clients are validated using the settings of the admin listener: on TCP they
+// require an authorized client certificate, on UNIX domain sockets the access
+// is controlled with the permissions of the socket file.
+//
+// The API has the following endpoints:
+//
+//	GET    /streams             lists the active streams
+//	DELETE /streams/{id}        closes a stream, the client will reconnect
+//	GET    /secrets             lists the secrets in the cache
+//	POST   /secrets/{name}/renew renews the secrets with the given name
+func (srv *Service) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+AdminStreamsPath, srv.adminListStreams)
+	mux.HandleFunc("DELETE "+AdminStreamsPath+"/{id}", srv.adminCloseStream)
+	mux.HandleFunc("GET "+AdminSecretsPath, srv.adminListSecrets)
+	mux.HandleFunc("POST "+AdminSecretsPath+"/{name}/renew", srv.adminRenewSecret)
+	return srv.adminAuthenticate(mux)
+}
+
+// adminAuthenticate validates the peer of the requests using the settings of
+// the admin listener.
+func (srv *Service) adminAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		l, ok := srv.getConfig().listeners[AdminListenerName]
+		if !ok {
+			writeAdminError(w, status.Error(codes.Unavailable, "admin API is not configured"))
+			return
+		}
+		if l.isTCP && req.TLS == nil {
+			writeAdminError(w, status.Error(codes.Unauthenticated, "missing client certificate"))
+			return
+		}
+		ctx := newHTTPPeerContext(req.Context(), req)
+		if _, err := l.validatePeer(ctx); err != nil {
+			srv.logger.WithError(err).WithFields(logging.Fields{
+				"method":      req.Method,
+				"path":        req.URL.Path,
+				"remote-addr": req.RemoteAddr,
+			}).Warn("Admin request denied")
+			writeAdminError(w, err)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func (srv *Service) adminListStreams(w http.ResponseWriter, req *http.Request) {
+	streams := srv.streams.List()
+	resp := make([]StreamStatus, len(streams))
+	for i, s := range streams {
+		resp[i] = s.Status()
+	}
+	writeAdminJSON(w, http.StatusOK, resp)
+}
+
+func (srv *Service) adminCloseStream(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	s, ok := srv.streams.Get(id)
+	if !ok {
+		writeAdminError(w, status.Errorf(codes.NotFound, "stream %s not found", id))
+		return
+	}
+	s.Close()
+	st := s.Status()
+	srv.logger.WithFields(logging.Fields{
+		"stream.id":   st.ID,
+		"node":        st.Node,
+		"cluster":     st.Cluster,
+		"remote-addr": req.RemoteAddr,
+	}).Info("Stream closed by the administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Service) adminListSecrets(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, http.StatusOK, srv.secretsStatus(""))
+}
+
+func (srv *Service) adminRenewSecret(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	var found bool
+	for _, e := range srv.cache.Entries() {
+		if e.name != name {
+			continue
+		}
+		found = true
+		if err := e.renewer.Renew(req.Context()); err != nil {
+			writeAdminError(w, status.Errorf(codes.Unavailable, "error renewing %s: %v", name, err))
+			return
+		}
+	}
+	if !found {
+		writeAdminError(w, status.Errorf(codes.NotFound, "secret %s not found", name))
+		return
+	}
+	srv.logger.WithFields(logging.Fields{
+		"resourceName": name,
+		"remote-addr":  req.RemoteAddr,
+	}).Info("Certificate renewed by the administrator")
+	writeAdminJSON(w, http.StatusOK, srv.secretsStatus(name))
+}
+
+// secretsStatus returns the state of the secrets in the cache with the given
+// name, or all of them if the name is empty. Secrets are sorted by name.
+func (srv *Service) secretsStatus(name string) []SecretStatus {
+	resp := []SecretStatus{}
+	for _, e := range srv.cache.Entries() {
+		if name != "" && e.name != name {
+			continue
+		}
+		sum := sha256.Sum256([]byte(e.key))
+		refs, subscribers := srv.cache.References(e)
+		rs := e.renewer.Status()
+		secs := e.Secrets()
+		st := SecretStatus{
+			ID:           hex.EncodeToString(sum[:8]),
+			Name:         e.name,
+			Provisioner:  e.request.Provisioner,
+			References:   refs,
+			Subscribers:  subscribers,
+			Certificates: make([]CertificateStatus, 0, len(secs.Certificates)),
+			Roots:        make([]string, len(secs.Roots)),
+			NextRenewal:  rs.NextRenewal,
+			Failures:     rs.Failures,
+		}
+		for i, cert := range secs.Certificates {
+			if cert.Leaf != nil {
+				cs := newCertificateStatus(cert.Leaf)
+				if i < len(rs.RenewAt) {
+					cs.RenewAt = rs.RenewAt[i]
+				}
+				st.Certificates = append(st.Certificates, cs)
+			}
+		}
+		for i, root := range secs.Roots {
+			st.Roots[i] = x509util.Fingerprint(root)
+		}
+		if !rs.LastRenewal.IsZero() {
+			st.LastRenewal = &rs.LastRenewal
+		}
+		if rs.LastError != nil {
+			st.LastError = rs.LastError.Error()
+		}
+		resp = append(resp, st)
+	}
+	sort.Slice(resp, func(i, j int) bool {
+		if resp[i].Name == resp[j].Name {
+			return resp[i].ID < resp[j].ID
+		}
+		return resp[i].Name < resp[j].Name
+	})
+	return resp
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError writes the given error using the http status code
+// equivalent to the gRPC code of the error.
+func writeAdminError(w http.ResponseWriter, err error) {
+	st, _ := status.FromError(err)
+	writeAdminJSON(w, httpStatusCode(st.Code()), AdminError{Error: st.Message()})
+}
+
+func newCertificateStatus(cert *x509.Certificate) CertificateStatus {
+	st := CertificateStatus{
+		SerialNumber: cert.SerialNumber.String(),
+		Subject:      cert.Subject.String(),
+		DNSNames:     cert.DNSNames,
+		Fingerprint:  x509util.Fingerprint(cert),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		st.IPAddresses = append(st.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		st.URIs = append(st.URIs, u.String())
+	}
+	return st
+}
@@ -0,0 +1,349 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/step-sds/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// adminRequest sends a request to the given admin handler and decodes the
+// response in v if it's not nil.
+func adminRequest(t *testing.T, h http.Handler, method, path string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, http.NoBody))
+	if v != nil {
+		assert.FatalError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func TestService_AdminHandler(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Admin: &ListenerConfig{
+			Network: "unix",
+			Address: filepath.Join(t.TempDir(), "admin.sock"),
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	h := srv.AdminHandler()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+	defer s.Stop()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.FatalError(t, err)
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	stream, err := client.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	}))
+	dr, err := stream.Recv()
+	assert.FatalError(t, err)
+
+	// List streams
+	var streams []StreamStatus
+	assert.Equals(t, http.StatusOK, adminRequest(t, h, "GET", "/streams", &streams))
+	assert.Len(t, 1, streams)
+	assert.Equals(t, "sotw", streams[0].Protocol)
+	assert.Equals(t, DefaultListenerName, streams[0].Listener)
+	assert.Equals(t, "node-id", streams[0].Node)
+	assert.Equals(t, "node-cluster", streams[0].Cluster)
+	assert.Equals(t, []string{"foo.smallstep.com", "trusted_ca"}, streams[0].ResourceNames)
+
+	// List secrets
+	var secrets []SecretStatus
+	assert.Equals(t, http.StatusOK, adminRequest(t, h, "GET", "/secrets", &secrets))
+	assert.Len(t, 2, secrets)
+	assert.Equals(t, "foo.smallstep.com", secrets[0].Name)
+	assert.Equals(t, 1, secrets[0].Subscribers)
+	assert.Len(t, 1, secrets[0].Certificates)
+	assert.Len(t, 1, secrets[0].Roots)
+	assert.Equals(t, []string{"foo.smallstep.com"}, secrets[0].Certificates[0].DNSNames)
+	assert.Nil(t, secrets[0].LastRenewal)
+	assert.Equals(t, "trusted_ca", secrets[1].Name)
+	assert.Len(t, 0, secrets[1].Certificates)
+	serial := secrets[0].Certificates[0].SerialNumber
+
+	// Renew a secret and push it to the stream
+	var renewed []SecretStatus
+	assert.Equals(t, http.StatusOK, adminRequest(t, h, "POST", "/secrets/foo.smallstep.com/renew", &renewed))
+	assert.Len(t, 1, renewed)
+	assert.NotEquals(t, serial, renewed[0].Certificates[0].SerialNumber)
+	assert.NotNil(t, renewed[0].LastRenewal)
+	assert.Equals(t, "", renewed[0].LastError)
+	dr2, err := stream.Recv()
+	assert.FatalError(t, err)
+	assert.NotEquals(t, dr.VersionInfo, dr2.VersionInfo)
+
+	var e AdminError
+	assert.Equals(t, http.StatusNotFound, adminRequest(t, h, "POST", "/secrets/bar.smallstep.com/renew", &e))
+	assert.Equals(t, "secret bar.smallstep.com not found", e.Error)
+
+	// Renewal errors are reported
+	ca.Close()
+	assert.Equals(t, http.StatusServiceUnavailable, adminRequest(t, h, "POST", "/secrets/foo.smallstep.com/renew", &e))
+	assert.Equals(t, http.StatusOK, adminRequest(t, h, "GET", "/secrets", &secrets))
+	assert.NotEquals(t, "", secrets[0].LastError)
+
+	// Close the stream
+	assert.Equals(t, http.StatusNotFound, adminRequest(t, h, "DELETE", "/streams/1234", nil))
+	assert.Equals(t, http.StatusNoContent, adminRequest(t, h, "DELETE", "/streams/"+streams[0].ID, nil))
+	_, err = stream.Recv()
+	assert.Equals(t, codes.Unavailable, status.Code(err))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.streams.List()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the stream to close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// streamGoroutines returns the number of goroutines started by the stream
+// handlers.
+func streamGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var count int
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "created by github.com/smallstep/step-sds/sds.(*Service).StreamSecrets") ||
+			strings.Contains(g, "created by github.com/smallstep/step-sds/sds.(*Service).DeltaSecrets") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestService_AdminHandler_disconnect(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Admin: &ListenerConfig{
+			Network: "unix",
+			Address: filepath.Join(t.TempDir(), "admin.sock"),
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	h := srv.AdminHandler()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+	defer s.Stop()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.FatalError(t, err)
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	stream, err := client.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+		Node:          node,
+		ResourceNames: []string{"trusted_ca"},
+		TypeUrl:       secretTypeURL,
+	}))
+	_, err = stream.Recv()
+	assert.FatalError(t, err)
+
+	delta, err := client.DeltaSecrets(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, delta.Send(&discovery.DeltaDiscoveryRequest{
+		Node:                   node,
+		ResourceNamesSubscribe: []string{"trusted_ca"},
+		TypeUrl:                secretTypeURL,
+	}))
+	_, err = delta.Recv()
+	assert.FatalError(t, err)
+	assert.Equals(t, 2, streamGoroutines())
+
+	// The clients keep the streams open, the goroutines reading their
+	// requests must exit after the streams are disconnected.
+	var streams []StreamStatus
+	assert.Equals(t, http.StatusOK, adminRequest(t, h, "GET", "/streams", &streams))
+	assert.Len(t, 2, streams)
+	for _, st := range streams {
+		assert.Equals(t, http.StatusNoContent, adminRequest(t, h, "DELETE", "/streams/"+st.ID, nil))
+	}
+	_, err = stream.Recv()
+	assert.Equals(t, codes.Unavailable, status.Code(err))
+	_, err = delta.Recv()
+	assert.Equals(t, codes.Unavailable, status.Code(err))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for streamGoroutines() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the stream goroutines to exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestService_AdminHandler_authentication(t *testing.T) {
+	identities, err := newIdentityMatcher([]string{"admin.smallstep.com"})
+	assert.FatalError(t, err)
+	cert := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		listeners map[string]*listenerPolicy
+		state     *tls.ConnectionState
+		want      int
+	}{
+		{"ok", map[string]*listenerPolicy{
+			AdminListenerName: {isTCP: true, authorizedIdentities: identities},
+		}, cert("admin.smallstep.com"), http.StatusOK},
+		{"ok unix", map[string]*listenerPolicy{
+			AdminListenerName: {isTCP: false},
+		}, nil, http.StatusOK},
+		{"fail not configured", map[string]*listenerPolicy{
+			DefaultListenerName: {isTCP: false},
+		}, nil, http.StatusServiceUnavailable},
+		{"fail no certificate", map[string]*listenerPolicy{
+			AdminListenerName: {isTCP: true, authorizedIdentities: identities},
+		}, nil, http.StatusUnauthorized},
+		{"fail identity", map[string]*listenerPolicy{
+			AdminListenerName: {isTCP: true, authorizedIdentities: identities},
+		}, cert("foo.smallstep.com"), http.StatusForbidden},
+	}
+	logger, err := logging.New("step-sds", []byte("{}"))
+	assert.FatalError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Service{
+				cache:   newSecretCache(nil),
+				streams: newStreamRegistry(),
+				logger:  logger,
+			}
+			srv.config.Store(&serviceConfig{listeners: tt.listeners})
+			req := httptest.NewRequest("GET", "/streams", http.NoBody)
+			req.TLS = tt.state
+			w := httptest.NewRecorder()
+			srv.AdminHandler().ServeHTTP(w, req)
+			assert.Equals(t, tt.want, w.Code)
+		})
+	}
+}
+
+func TestParseAdminAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{"ok path", "/var/run/step-sds/admin.sock", "unix", "/var/run/step-sds/admin.sock", false},
+		{"ok relative path", "./admin.sock", "unix", "./admin.sock", false},
+		{"ok unix", "unix://admin.sock", "unix", "admin.sock", false},
+		{"ok tcp", "127.0.0.1:9443", "tcp", "127.0.0.1:9443", false},
+		{"ok https", "https://localhost:9443", "tcp", "localhost:9443", false},
+		{"fail abstract", "@step-sds-admin", "", "", true},
+		{"fail unix abstract", "unix://@step-sds-admin", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, address, err := ParseAdminAddress(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAdminAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, tt.wantNetwork, network)
+			assert.Equals(t, tt.wantAddress, address)
+		})
+	}
+
+	// The configuration of the admin API fails with the same error
+	_, _, err := ParseAdminAddress("@step-sds-admin")
+	assert.Equals(t, "admin.address @step-sds-admin cannot be an abstract socket", err.Error())
+	c := Config{
+		Network: "unix",
+		Address: "/tmp/sds.unix",
+		Admin:   &ListenerConfig{Network: "unix", Address: "@step-sds-admin"},
+	}
+	assert.Equals(t, err.Error(), c.Validate().Error())
+}
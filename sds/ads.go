@@ -0,0 +1,19 @@
+package sds
+
+import (
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+)
+
+// StreamAggregatedResources implements the gRPC AggregatedDiscoveryService
+// service and returns a stream of TLS certificates. Requests for types other
+// than secrets are ignored.
+func (srv *Service) StreamAggregatedResources(ads discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	return srv.StreamSecrets(ads)
+}
+
+// DeltaAggregatedResources implements the gRPC AggregatedDiscoveryService
+// service and returns an incremental stream of TLS certificates. Requests for
+// types other than secrets are ignored.
+func (srv *Service) DeltaAggregatedResources(ads discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return srv.DeltaSecrets(ads)
+}
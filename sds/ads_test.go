@@ -0,0 +1,106 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestService_AggregatedResources(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := discovery.NewAggregatedDiscoveryServiceClient(conn)
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+
+	t.Run("stream", func(t *testing.T) {
+		stream, err := client.StreamAggregatedResources(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+
+		// Other types are ignored
+		assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+			Node:    node,
+			TypeUrl: "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+		}))
+		assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+			TypeUrl:       secretTypeURL,
+		}))
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, secretTypeURL, got.TypeUrl)
+		assert.Len(t, 2, got.Resources)
+		for i, r := range got.Resources {
+			var sec auth.Secret
+			assert.FatalError(t, proto.Unmarshal(r.Value, &sec))
+			assert.Equals(t, []string{"foo.smallstep.com", "trusted_ca"}[i], sec.Name)
+		}
+	})
+
+	t.Run("delta", func(t *testing.T) {
+		stream, err := client.DeltaAggregatedResources(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+
+		// Other types are ignored
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:    node,
+			TypeUrl: "type.googleapis.com/envoy.config.listener.v3.Listener",
+		}))
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResourceNamesSubscribe: []string{"foo.smallstep.com"},
+		}))
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, secretTypeURL, got.TypeUrl)
+		assert.Len(t, 1, got.Resources)
+		assert.Equals(t, "foo.smallstep.com", got.Resources[0].Name)
+	})
+}
@@ -0,0 +1,161 @@
+package sds
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/step-sds/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// matchAny returns if the value matches one of the given names or glob
+// patterns. Patterns use path.Match, so "*" does not match "/": the pattern
+// "spiffe://prod/ns/*/sa/envoy" matches one namespace, but "spiffe://prod/*"
+// does not match any ID with more than one segment. An empty value never
+// matches.
+func matchAny(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if p == value {
+			return true
+		}
+		if ok, err := path.Match(p, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// authzClient contains the attributes of an SDS client used in the
+// authorization policy.
+type authzClient struct {
+	Identities  []string
+	Node        string
+	Cluster     string
+	Credentials *PeerCredentials
+}
+
+// matchClient returns if the rule applies to the given client. Identities are
+// case insensitive.
+func (c AuthorizationRule) matchClient(client *authzClient) bool {
+	if len(c.Identities) > 0 {
+		patterns := make([]string, len(c.Identities))
+		for i, s := range c.Identities {
+			patterns[i] = strings.ToLower(s)
+		}
+		var ok bool
+		for _, id := range client.Identities {
+			if ok = matchAny(patterns, strings.ToLower(id)); ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(c.Nodes) > 0 && !matchAny(c.Nodes, client.Node) {
+		return false
+	}
+	if len(c.Clusters) > 0 && !matchAny(c.Clusters, client.Cluster) {
+		return false
+	}
+	if len(c.UIDs)+len(c.GIDs)+len(c.Executables) > 0 {
+		creds := client.Credentials
+		if creds == nil {
+			return false
+		}
+		if len(c.UIDs) > 0 && !containsID(c.UIDs, creds.UID) {
+			return false
+		}
+		if len(c.GIDs) > 0 && !containsID(c.GIDs, creds.GID) {
+			return false
+		}
+		if len(c.Executables) > 0 && !matchAny(c.Executables, creds.Executable) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSANs returns if the common name and all the SANs rendered for the given
+// resource name match the sans of the rule. Resources without certificate, and
+// rules without sans, always match.
+func (c AuthorizationRule) matchSANs(name string, render func(string) (*secretRequest, error)) bool {
+	if len(c.SANs) == 0 || isValidationContext(name) {
+		return true
+	}
+	req, err := render(name)
+	if err != nil || !matchAny(c.SANs, req.CommonName) {
+		return false
+	}
+	for _, san := range req.SANs {
+		if !matchAny(c.SANs, san) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the given client can request all the resource names
+// in the request. All names are allowed if the listener has no
+// authorization policy. The common name and SANs of a resource are rendered
+// with the given function if a rule restricts them, because templates can
+// render them from the node sent by the client. Denied requests are logged and
+// return a PermissionDenied error.
+func (l *listenerPolicy) authorize(ctx context.Context, client *authzClient, r *discovery.DiscoveryRequest, render func(string) (*secretRequest, error)) error {
+	authorization := l.authorization
+	if len(authorization) == 0 {
+		return nil
+	}
+
+	if r.Node != nil {
+		client.Node, client.Cluster = r.Node.Id, r.Node.Cluster
+	}
+
+	var denied []string
+	for _, name := range r.ResourceNames {
+		var allowed bool
+		for _, rule := range authorization {
+			if rule.matchClient(client) && matchAny(rule.Resources, name) && rule.matchSANs(name, render) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			denied = append(denied, name)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+
+	fields := logging.Fields{
+		"audit":                 "authorization",
+		"authz.listener":        l.name,
+		"authz.identities":      client.Identities,
+		"authz.node":            client.Node,
+		"authz.cluster":         client.Cluster,
+		"authz.resourceNames":   r.ResourceNames,
+		"authz.deniedResources": denied,
+	}
+	if client.Credentials != nil {
+		fields["authz.peer"] = client.Credentials.String()
+	}
+	logging.GetRequestEntry(ctx).WithFields(fields).Warn("Permission denied")
+
+	return status.Errorf(codes.PermissionDenied, "client is not authorized to request %s", strings.Join(denied, ", "))
+}
@@ -0,0 +1,164 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func Test_matchAny(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		value    string
+		want     bool
+	}{
+		{"ok exact", []string{"foo.smallstep.com"}, "foo.smallstep.com", true},
+		{"ok pattern", []string{"bar", "*.smallstep.com"}, "foo.smallstep.com", true},
+		{"ok invalid pattern exact", []string{"[foo"}, "[foo", true},
+		{"ok pattern segment", []string{"spiffe://prod/ns/*/sa/envoy"}, "spiffe://prod/ns/default/sa/envoy", true},
+		{"fail no match", []string{"*.example.com"}, "foo.smallstep.com", false},
+		{"fail pattern segments", []string{"spiffe://prod/*"}, "spiffe://prod/ns/default/sa/envoy", false},
+		{"fail empty value", []string{"*"}, "", false},
+		{"fail empty patterns", nil, "foo", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchAny(tt.patterns, tt.value); got != tt.want {
+				t.Errorf("matchAny() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizationRule_matchClient(t *testing.T) {
+	type args struct {
+		identities  []string
+		node        string
+		cluster     string
+		credentials *PeerCredentials
+	}
+	creds := &PeerCredentials{UID: 1000, GID: 100, PID: 1234, Executable: "/usr/local/bin/envoy"}
+	tests := []struct {
+		name string
+		rule AuthorizationRule
+		args args
+		want bool
+	}{
+		{"ok any", AuthorizationRule{}, args{nil, "", "", nil}, true},
+		{"ok identity", AuthorizationRule{Identities: []string{"Envoy.smallstep.com"}}, args{[]string{"envoy.SMALLSTEP.com"}, "", "", nil}, true},
+		{"ok node", AuthorizationRule{Nodes: []string{"node-*"}}, args{nil, "node-1", "", nil}, true},
+		{"ok cluster", AuthorizationRule{Clusters: []string{"backend"}}, args{nil, "", "backend", nil}, true},
+		{"ok all", AuthorizationRule{Identities: []string{"*.smallstep.com"}, Nodes: []string{"node-1"}, Clusters: []string{"backend"}}, args{[]string{"envoy.smallstep.com"}, "node-1", "backend", nil}, true},
+		{"ok any identity", AuthorizationRule{Identities: []string{"spiffe://prod/*"}}, args{[]string{"envoy", "spiffe://prod/envoy"}, "", "", nil}, true},
+		{"ok uid", AuthorizationRule{UIDs: []uint32{0, 1000}}, args{nil, "", "", creds}, true},
+		{"ok gid", AuthorizationRule{GIDs: []uint32{100}}, args{nil, "", "", creds}, true},
+		{"ok executable", AuthorizationRule{Executables: []string{"/usr/local/bin/*"}}, args{nil, "", "", creds}, true},
+		{"ok uid and executable", AuthorizationRule{UIDs: []uint32{1000}, Executables: []string{"/usr/local/bin/envoy"}}, args{nil, "", "", creds}, true},
+		{"fail identity", AuthorizationRule{Identities: []string{"envoy.smallstep.com"}}, args{[]string{"other.smallstep.com"}, "", "", nil}, false},
+		{"fail empty identity", AuthorizationRule{Identities: []string{"*"}}, args{nil, "node-1", "", nil}, false},
+		{"fail node", AuthorizationRule{Nodes: []string{"node-*"}}, args{nil, "other", "", nil}, false},
+		{"fail cluster", AuthorizationRule{Identities: []string{"*.smallstep.com"}, Clusters: []string{"backend"}}, args{[]string{"envoy.smallstep.com"}, "", "frontend", nil}, false},
+		{"fail uid", AuthorizationRule{UIDs: []uint32{0}}, args{nil, "", "", creds}, false},
+		{"fail gid", AuthorizationRule{UIDs: []uint32{1000}, GIDs: []uint32{0}}, args{nil, "", "", creds}, false},
+		{"fail executable", AuthorizationRule{Executables: []string{"/usr/bin/*"}}, args{nil, "", "", creds}, false},
+		{"fail no credentials", AuthorizationRule{UIDs: []uint32{1000}}, args{nil, "", "", nil}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &authzClient{
+				Identities:  tt.args.identities,
+				Node:        tt.args.node,
+				Cluster:     tt.args.cluster,
+				Credentials: tt.args.credentials,
+			}
+			if got := tt.rule.matchClient(client); got != tt.want {
+				t.Errorf("AuthorizationRule.matchClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestService_validateRequest_authorization(t *testing.T) {
+	b, _ := pem.Decode([]byte(testCert))
+	cert, err := x509.ParseCertificate(b.Bytes)
+	assert.FatalError(t, err)
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+		},
+	})
+
+	rules := []AuthorizationRule{
+		{Identities: []string{"foo.smallstep.com"}, Resources: []string{"*.smallstep.com", "trusted_ca"}},
+		{Nodes: []string{"node-*"}, Clusters: []string{"backend"}, Resources: []string{"backend.internal"}},
+	}
+	request := func(node *core.Node, names ...string) *discovery.DiscoveryRequest {
+		return &discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: names,
+			TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		}
+	}
+	backend := &core.Node{Id: "node-1", Cluster: "backend"}
+
+	// The SANs of the default resource are rendered from the node
+	profiles, err := newResourceProfiles([]ResourceConfig{
+		{Name: "default", CommonName: "{{.Node.Id}}", URIs: []string{"spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}"}},
+	})
+	assert.FatalError(t, err)
+	sansRules := []AuthorizationRule{
+		{Clusters: []string{"backend*"}, Resources: []string{"default", "trusted_ca"}, SANs: []string{"node-*", "spiffe://prod/backend/*"}},
+	}
+
+	tests := []struct {
+		name          string
+		isTCP         bool
+		authorization []AuthorizationRule
+		ctx           context.Context
+		req           *discovery.DiscoveryRequest
+		wantErr       bool
+	}{
+		{"ok no policy", true, nil, ctx, request(nil, "bar.example.com"), false},
+		{"ok identity", true, rules, ctx, request(nil, "foo.smallstep.com", "trusted_ca"), false},
+		{"ok node", false, rules, context.Background(), request(backend, "backend.internal"), false},
+		{"ok identity and node", true, rules, ctx, request(backend, "foo.smallstep.com", "backend.internal"), false},
+		{"ok empty names", false, rules, context.Background(), request(nil), false},
+		{"fail resource", true, rules, ctx, request(nil, "foo.smallstep.com", "bar.example.com"), true},
+		{"fail no identity", false, rules, context.Background(), request(nil, "foo.smallstep.com"), true},
+		{"fail no node", false, rules, context.Background(), request(nil, "backend.internal"), true},
+		{"fail cluster", false, rules, context.Background(), request(&core.Node{Id: "node-1", Cluster: "frontend"}, "backend.internal"), true},
+		{"ok sans", false, sansRules, context.Background(), request(backend, "default", "trusted_ca"), false},
+		{"fail sans common name", false, sansRules, context.Background(), request(&core.Node{Id: "admin", Cluster: "backend"}, "default"), true},
+		{"fail sans uri", false, sansRules, context.Background(), request(&core.Node{Id: "node-1", Cluster: "backend-admin"}, "default"), true},
+		{"fail sans without node", false, sansRules, context.Background(), request(nil, "default"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Service{}
+			srv.config.Store(&serviceConfig{listeners: map[string]*listenerPolicy{
+				DefaultListenerName: {isTCP: tt.isTCP, authorization: tt.authorization},
+			}, profiles: profiles})
+			err := srv.validateRequest(tt.ctx, tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Service.validateRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				assert.Equals(t, codes.PermissionDenied, status.Code(err))
+			}
+		})
+	}
+}
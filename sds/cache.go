@@ -0,0 +1,415 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SecretIdleTimeout is the time that a secret without subscribers is kept in
+// the cache before stopping its renewal.
+var SecretIdleTimeout = 5 * time.Minute
+
+// secretCache is a process-wide cache of secrets shared by all the streams.
+// Secrets are indexed by the key of the secret request and reference counted,
+// only one certificate is signed and renewed for each key, and renewals are
+// pushed to all the subscribers of that key.
+type secretCache struct {
+	m          sync.Mutex
+	entries    map[string]*cacheEntry
+	newRenewer func(ctx context.Context, req *secretRequest) (*secretRenewer, error)
+}
+
+// cacheEntry is a secret in the cache.
+type cacheEntry struct {
+	name        string
+	key         string
+	request     *secretRequest
+	ready       chan struct{}
+	err         error
+	renewer     *secretRenewer
+	refs        int
+	subscribers map[*subscriber]int
+	idleTimer   *time.Timer
+}
+
+// newSecretCache creates a new secret cache that will use the given function
+// to sign the certificates and create the renewer of new secrets.
+func newSecretCache(newRenewer func(ctx context.Context, req *secretRequest) (*secretRenewer, error)) *secretCache {
+	return &secretCache{
+		entries:    make(map[string]*cacheEntry),
+		newRenewer: newRenewer,
+	}
+}
+
+// Acquire returns the cache entry for the given request, creating it if
+// necessary, and subscribes the given subscriber to its renewals. Concurrent
+// calls with the same request will wait for the same certificate. Each
+// successful call must be paired with a call to Release with the key of the
+// entry. New certificates are signed in a trace that is a child of the span in
+// the given context, but the signing is not cancelled with it because other
+// calls may be waiting for the same certificate.
+func (c *secretCache) Acquire(ctx context.Context, req *secretRequest, sub *subscriber) (*cacheEntry, error) {
+	key := req.Key()
+	c.m.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cacheEntry{
+			name:        req.Name,
+			key:         key,
+			request:     req,
+			ready:       make(chan struct{}),
+			subscribers: make(map[*subscriber]int),
+		}
+		c.entries[key] = e
+		go c.load(context.WithoutCancel(ctx), e)
+	}
+	e.refs++
+	if sub != nil {
+		e.subscribers[sub]++
+	}
+	if e.idleTimer != nil {
+		e.idleTimer.Stop()
+		e.idleTimer = nil
+	}
+	c.m.Unlock()
+
+	<-e.ready
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e, nil
+}
+
+// Release unsubscribes the given subscriber from the entry with the given key.
+// The renewal of the secret is stopped after SecretIdleTimeout if the entry does
+// not have any other reference, and the secret is removed from the state
+// directory.
+func (c *secretCache) Release(key string, sub *subscriber) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	if sub != nil {
+		if e.subscribers[sub]--; e.subscribers[sub] <= 0 {
+			delete(e.subscribers, sub)
+		}
+	}
+	if e.refs--; e.refs > 0 {
+		return
+	}
+	if SecretIdleTimeout <= 0 {
+		c.evict(e)
+		return
+	}
+	e.idleTimer = time.AfterFunc(SecretIdleTimeout, func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if e.refs == 0 {
+			c.evict(e)
+		}
+	})
+}
+
+// Entries returns the entries in the cache that have been signed.
+func (c *secretCache) Entries() []*cacheEntry {
+	c.m.Lock()
+	defer c.m.Unlock()
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		select {
+		case <-e.ready:
+			if e.err == nil && e.renewer != nil {
+				entries = append(entries, e)
+			}
+		default:
+		}
+	}
+	return entries
+}
+
+// References returns the number of references to the given entry and the
+// number of streams subscribed to it.
+func (c *secretCache) References(e *cacheEntry) (refs, subscribers int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return e.refs, len(e.subscribers)
+}
+
+// Stop stops the renewal of all the secrets in the cache.
+func (c *secretCache) Stop() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, e := range c.entries {
+		c.remove(e)
+	}
+}
+
+// load signs the certificate for the given entry and starts the goroutine that
+// notifies the renewals to the subscribers.
+func (c *secretCache) load(ctx context.Context, e *cacheEntry) {
+	defer close(e.ready)
+
+	var err error
+	if e.renewer, err = c.newRenewer(ctx, e.request); err != nil {
+		e.err = err
+		c.m.Lock()
+		if c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+		c.m.Unlock()
+		return
+	}
+
+	// The cache might have been stopped while signing
+	c.m.Lock()
+	if c.entries[e.key] != e {
+		e.renewer.Stop()
+	}
+	c.m.Unlock()
+
+	go func(ch chan secrets) {
+		for range ch {
+			c.m.Lock()
+			subs := make([]*subscriber, 0, len(e.subscribers))
+			for sub := range e.subscribers {
+				subs = append(subs, sub)
+			}
+			c.m.Unlock()
+			for _, sub := range subs {
+				sub.notify(e.name)
+			}
+		}
+	}(e.renewer.RenewChannel())
+}
+
+// remove deletes the entry from the cache and stops the renewer. It must be
+// called with the lock held.
+func (c *secretCache) remove(e *cacheEntry) {
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	if e.idleTimer != nil {
+		e.idleTimer.Stop()
+		e.idleTimer = nil
+	}
+	if e.renewer != nil {
+		e.renewer.Stop()
+	}
+}
+
+// evict removes the entry from the cache and forgets its stored secrets. It
+// must be called with the lock held.
+func (c *secretCache) evict(e *cacheEntry) {
+	c.remove(e)
+	if e.renewer != nil {
+		e.renewer.Forget()
+	}
+}
+
+// Secrets returns the current secrets of the entry.
+func (e *cacheEntry) Secrets() secrets {
+	return e.renewer.Secrets()
+}
+
+// collectSecrets returns the certificates in the given entries in the same
+// order, and the roots of the validation contexts. The roots of the entries
+// with certificates are not used, they can be signed by a different CA than
+// the one of the validation context. The roots of multiple validation contexts
+// are merged without duplicates.
+func collectSecrets(entries []*cacheEntry) ([]*tls.Certificate, []*x509.Certificate) {
+	var certs []*tls.Certificate
+	var roots []*x509.Certificate
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		secs := e.Secrets()
+		certs = append(certs, secs.Certificates...)
+		if !isValidationContext(e.name) {
+			continue
+		}
+		for _, root := range secs.Roots {
+			if !seen[string(root.Raw)] {
+				seen[string(root.Raw)] = true
+				roots = append(roots, root)
+			}
+		}
+	}
+	return certs, roots
+}
+
+// subscriber receives the names of the secrets renewed in the cache. A stream
+// uses one subscriber for all the secrets it serves.
+type subscriber struct {
+	m       sync.Mutex
+	renewed map[string]struct{}
+	ch      chan struct{}
+}
+
+func newSubscriber() *subscriber {
+	return &subscriber{
+		renewed: make(map[string]struct{}),
+		ch:      make(chan struct{}, 1),
+	}
+}
+
+// C returns the channel that will be notified when a secret is renewed.
+func (s *subscriber) C() <-chan struct{} {
+	return s.ch
+}
+
+// Renewed returns and clears the names of the secrets renewed since the last
+// call.
+func (s *subscriber) Renewed() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	names := make([]string, 0, len(s.renewed))
+	for name := range s.renewed {
+		names = append(names, name)
+	}
+	s.renewed = make(map[string]struct{})
+	sort.Strings(names)
+	return names
+}
+
+func (s *subscriber) notify(name string) {
+	s.m.Lock()
+	s.renewed[name] = struct{}{}
+	s.m.Unlock()
+	select {
+	case s.ch <- struct{}{}:
+	default:
+	}
+}
+
+// subscription is the set of secrets used by a stream.
+type subscription struct {
+	cache      *secretCache
+	sub        *subscriber
+	newRequest func(name string) (*secretRequest, error)
+	entries    map[string]*cacheEntry
+}
+
+// newSubscription creates a new subscription using the given cache, renewals
+// will be notified to the given subscriber if it's not nil. The given function
+// creates the secret request for each name, if it's nil the default request
+// will be used.
+func newSubscription(c *secretCache, sub *subscriber, newRequest func(name string) (*secretRequest, error)) *subscription {
+	if newRequest == nil {
+		newRequest = func(name string) (*secretRequest, error) {
+			return newSecretRequest(name, nil, nil)
+		}
+	}
+	return &subscription{
+		cache:      c,
+		sub:        sub,
+		newRequest: newRequest,
+		entries:    make(map[string]*cacheEntry),
+	}
+}
+
+// Subscribe acquires the given names that are not yet in the subscription and
+// returns them. If one of them fails, the names acquired in this call are
+// released.
+func (s *subscription) Subscribe(ctx context.Context, names []string) ([]string, error) {
+	var added []string
+	for _, name := range names {
+		if _, ok := s.entries[name]; ok {
+			continue
+		}
+		req, err := s.newRequest(name)
+		if err != nil {
+			s.Unsubscribe(added)
+			return nil, err
+		}
+		e, err := s.cache.Acquire(ctx, req, s.sub)
+		if err != nil {
+			s.Unsubscribe(added)
+			return nil, err
+		}
+		s.entries[name] = e
+		added = append(added, name)
+	}
+	return added, nil
+}
+
+// Unsubscribe releases the given names and returns the ones that were in the
+// subscription.
+func (s *subscription) Unsubscribe(names []string) []string {
+	var removed []string
+	for _, name := range names {
+		if e, ok := s.entries[name]; ok {
+			s.cache.Release(e.key, s.sub)
+			delete(s.entries, name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// Update sets the subscription to the given names, it only acquires the names
+// that are new and releases the ones that are not present anymore. It returns
+// the names added and removed.
+func (s *subscription) Update(ctx context.Context, names []string) (added, removed []string, err error) {
+	if added, err = s.Subscribe(ctx, names); err != nil {
+		return nil, nil, err
+	}
+
+	keep := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		keep[name] = struct{}{}
+	}
+	var old []string
+	for name := range s.entries {
+		if _, ok := keep[name]; !ok {
+			old = append(old, name)
+		}
+	}
+	sort.Strings(old)
+	return added, s.Unsubscribe(old), nil
+}
+
+// Names returns the names in the subscription sorted.
+func (s *subscription) Names() []string {
+	names := make([]string, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has returns if the given name is in the subscription.
+func (s *subscription) Has(name string) bool {
+	_, ok := s.entries[name]
+	return ok
+}
+
+// Entry returns the cache entry for the given name.
+func (s *subscription) Entry(name string) *cacheEntry {
+	return s.entries[name]
+}
+
+// Entries returns the cache entries for the given names in the same order.
+func (s *subscription) Entries(names []string) []*cacheEntry {
+	entries := make([]*cacheEntry, 0, len(names))
+	for _, name := range names {
+		if e, ok := s.entries[name]; ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Close releases all the names in the subscription.
+func (s *subscription) Close() {
+	for _, e := range s.entries {
+		s.cache.Release(e.key, s.sub)
+	}
+	s.entries = make(map[string]*cacheEntry)
+}
@@ -0,0 +1,236 @@
+package sds
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func Test_secretCache(t *testing.T) {
+	foo := &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com"}}
+	srv := caServer(3 * time.Second)
+	defer srv.Close()
+
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 0
+
+	p := caProvisioner(srv)
+	var m sync.Mutex
+	var count int
+	c := newSecretCache(tokenRenewer(func(name string) (string, error) {
+		m.Lock()
+		count++
+		m.Unlock()
+		return p.Token(name)
+	}))
+	defer c.Stop()
+
+	// Concurrent acquires share the same entry
+	var wg sync.WaitGroup
+	subs := make([]*subscriber, 10)
+	entries := make([]*cacheEntry, 10)
+	for i := range subs {
+		subs[i] = newSubscriber()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e, err := c.Acquire(context.Background(), foo, subs[i])
+			assert.FatalError(t, err)
+			entries[i] = e
+		}(i)
+	}
+	wg.Wait()
+	assert.Equals(t, 1, count)
+	for _, e := range entries {
+		assert.True(t, e == entries[0])
+	}
+	crt := entries[0].Secrets().Certificates[0].Leaf
+	assert.Equals(t, "foo.smallstep.com", crt.DNSNames[0])
+
+	// Renewals are pushed to all subscribers
+	for _, sub := range subs {
+		select {
+		case <-sub.C():
+			assert.Equals(t, []string{"foo.smallstep.com"}, sub.Renewed())
+			assert.Equals(t, []string{}, sub.Renewed())
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for renewal")
+		}
+	}
+	assert.NotEquals(t, crt.SerialNumber, entries[0].Secrets().Certificates[0].Leaf.SerialNumber)
+
+	// The entry is removed with the last release
+	for _, sub := range subs[1:] {
+		c.Release(foo.Key(), sub)
+	}
+	assert.Len(t, 1, c.entries)
+	c.Release(foo.Key(), subs[0])
+	assert.Len(t, 0, c.entries)
+
+	// A new entry is created after the removal
+	e, err := c.Acquire(context.Background(), foo, nil)
+	assert.FatalError(t, err)
+	assert.True(t, e != entries[0])
+	assert.Equals(t, 2, count)
+	c.Release(foo.Key(), nil)
+}
+
+func Test_secretCache_idle(t *testing.T) {
+	foo := &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com"}}
+	srv := caServer(60 * time.Second)
+	defer srv.Close()
+
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 100 * time.Millisecond
+
+	p := caProvisioner(srv)
+	c := newSecretCache(tokenRenewer(func(name string) (string, error) {
+		return p.Token(name)
+	}))
+	defer c.Stop()
+
+	e1, err := c.Acquire(context.Background(), foo, nil)
+	assert.FatalError(t, err)
+	c.Release(foo.Key(), nil)
+
+	// Acquired before the idle timeout
+	e2, err := c.Acquire(context.Background(), foo, nil)
+	assert.FatalError(t, err)
+	assert.True(t, e1 == e2)
+	c.Release(foo.Key(), nil)
+
+	time.Sleep(200 * time.Millisecond)
+	c.m.Lock()
+	assert.Len(t, 0, c.entries)
+	c.m.Unlock()
+}
+
+func Test_secretCache_fail(t *testing.T) {
+	foo := &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com"}}
+	srv := caServer(60 * time.Second)
+	defer srv.Close()
+
+	c := newSecretCache(tokenRenewer(func(name string) (string, error) {
+		return "", errors.New("an error")
+	}))
+	defer c.Stop()
+
+	e, err := c.Acquire(context.Background(), foo, nil)
+	assert.Error(t, err)
+	assert.Nil(t, e)
+	assert.Len(t, 0, c.entries)
+
+	c = newSecretCache(tokenRenewer(func(name string) (string, error) {
+		return "badtoken", nil
+	}))
+	defer c.Stop()
+
+	e, err = c.Acquire(context.Background(), foo, nil)
+	assert.Error(t, err)
+	assert.Nil(t, e)
+	assert.Len(t, 0, c.entries)
+}
+
+func Test_collectSecrets(t *testing.T) {
+	roots := rootCAs(t)
+	certs := tlsCerts(t)
+
+	foo := &cacheEntry{name: "foo.smallstep.com", renewer: &secretRenewer{roots: roots, certificates: certs}}
+	trustedCA := &cacheEntry{name: "trusted_ca", renewer: &secretRenewer{roots: roots}}
+
+	gotCerts, gotRoots := collectSecrets([]*cacheEntry{trustedCA, foo, foo})
+	assert.Equals(t, append(certs, certs...), gotCerts)
+	assert.Equals(t, roots, gotRoots)
+
+	gotCerts, gotRoots = collectSecrets(nil)
+	assert.Len(t, 0, gotCerts)
+	assert.Len(t, 0, gotRoots)
+
+	// The roots of a different CA are only used by its validation context
+	otherRoots := []*x509.Certificate{storeCertificate(t, "Other Root CA", time.Hour).Leaf}
+	bar := &cacheEntry{name: "bar.smallstep.com", renewer: &secretRenewer{roots: otherRoots, certificates: certs}}
+	validationContext := &cacheEntry{name: "validation_context", renewer: &secretRenewer{roots: otherRoots}}
+	for _, entries := range [][]*cacheEntry{
+		{foo, bar, trustedCA},
+		{trustedCA, bar, foo},
+	} {
+		_, gotRoots = collectSecrets(entries)
+		assert.Equals(t, roots, gotRoots)
+		want, err := getSecret("trusted_ca", trustedCA.Secrets())
+		assert.FatalError(t, err)
+		got, err := getTrustedCA("trusted_ca", gotRoots)
+		assert.FatalError(t, err)
+		assert.Equals(t, want, got)
+	}
+	_, gotRoots = collectSecrets([]*cacheEntry{validationContext, foo})
+	assert.Equals(t, otherRoots, gotRoots)
+	_, gotRoots = collectSecrets([]*cacheEntry{trustedCA, validationContext, trustedCA})
+	assert.Equals(t, append(roots, otherRoots...), gotRoots)
+}
+
+func Test_subscription(t *testing.T) {
+	srv := caServer(60 * time.Second)
+	defer srv.Close()
+
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 0
+
+	p := caProvisioner(srv)
+	var count int
+	c := newSecretCache(tokenRenewer(func(name string) (string, error) {
+		count++
+		return p.Token(name)
+	}))
+	defer c.Stop()
+
+	s := newSubscription(c, newSubscriber(), nil)
+	added, removed, err := s.Update(context.Background(), []string{"foo.smallstep.com", "trusted_ca", "foo.smallstep.com"})
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"foo.smallstep.com", "trusted_ca"}, added)
+	assert.Len(t, 0, removed)
+	assert.Equals(t, 2, count)
+	assert.Len(t, 3, s.Entries([]string{"foo.smallstep.com", "trusted_ca", "foo.smallstep.com"}))
+
+	added, removed, err = s.Update(context.Background(), []string{"bar.smallstep.com", "foo.smallstep.com"})
+	assert.FatalError(t, err)
+	assert.Equals(t, []string{"bar.smallstep.com"}, added)
+	assert.Equals(t, []string{"trusted_ca"}, removed)
+	assert.Equals(t, 3, count)
+	assert.True(t, s.Has("foo.smallstep.com"))
+	assert.True(t, s.Has("bar.smallstep.com"))
+	assert.False(t, s.Has("trusted_ca"))
+	assert.Len(t, 2, c.entries)
+
+	assert.Equals(t, []string{"bar.smallstep.com"}, s.Unsubscribe([]string{"bar.smallstep.com", "zar.smallstep.com"}))
+	assert.Len(t, 1, c.entries)
+
+	s.Close()
+	assert.Len(t, 0, c.entries)
+	assert.False(t, s.Has("foo.smallstep.com"))
+}
+
+// tokenRenewer returns a function that creates a renewer using the tokens
+// generated by the given function.
+func tokenRenewer(newToken func(name string) (string, error)) func(ctx context.Context, req *secretRequest) (*secretRenewer, error) {
+	return func(ctx context.Context, req *secretRequest) (*secretRenewer, error) {
+		token, err := newToken(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		return newSecretRenewer(ctx, []string{token}, nil, nil)
+	}
+}
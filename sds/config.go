@@ -2,23 +2,44 @@ package sds
 
 import (
 	"encoding/json"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"runtime"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // Config is the configuration used to initialize the SDS Service.
 type Config struct {
-	Network               string            `json:"network"`
-	Address               string            `json:"address"`
-	Root                  string            `json:"root,omitempty"`
-	Certificate           string            `json:"crt,omitempty"`
-	CertificateKey        string            `json:"key,omitempty"`
-	Password              string            `json:"password,omitempty"` // #nosec G117 -- JSON property for (un)marshaling
-	AuthorizedIdentity    string            `json:"authorizedIdentity"`
-	AuthorizedFingerprint string            `json:"authorizedFingerprint"`
-	Provisioner           ProvisionerConfig `json:"provisioner"`
-	Logger                json.RawMessage   `json:"logger"`
+	Network                string                   `json:"network"`
+	Address                string                   `json:"address"`
+	Root                   string                   `json:"root,omitempty"`
+	Certificate            string                   `json:"crt,omitempty"`
+	CertificateKey         string                   `json:"key,omitempty"`
+	Password               string                   `json:"password,omitempty"`              // #nosec G117 -- JSON property for (un)marshaling
+	AuthorizedIdentity     string                   `json:"authorizedIdentity,omitempty"`    // Deprecated: use AuthorizedIdentities
+	AuthorizedFingerprint  string                   `json:"authorizedFingerprint,omitempty"` // Deprecated: use AuthorizedFingerprints
+	AuthorizedIdentities   []string                 `json:"authorizedIdentities,omitempty"`
+	AuthorizedFingerprints []string                 `json:"authorizedFingerprints,omitempty"`
+	RESTAddress            string                   `json:"restAddress,omitempty"`
+	RESTNetwork            string                   `json:"restNetwork,omitempty"`
+	MetricsAddress         string                   `json:"metricsAddress,omitempty"`
+	SocketMode             string                   `json:"socketMode,omitempty"`
+	SocketOwner            string                   `json:"socketOwner,omitempty"`
+	SocketGroup            string                   `json:"socketGroup,omitempty"`
+	ServerCertificate      *ServerCertificateConfig `json:"serverCertificate,omitempty"`
+	Provisioner            ProvisionerConfig        `json:"provisioner"`
+	Provisioners           []ProvisionerConfig      `json:"provisioners,omitempty"`
+	Resources              []ResourceConfig         `json:"resources,omitempty"`
+	Authorization          []AuthorizationRule      `json:"authorization,omitempty"`
+	Listeners              []ListenerConfig         `json:"listeners,omitempty"`
+	Tracing                *TracingConfig           `json:"tracing,omitempty"`
+	Admin                  *ListenerConfig          `json:"admin,omitempty"`
+	State                  *StateConfig             `json:"state,omitempty"`
+	Logger                 json.RawMessage          `json:"logger"`
 }
 
 // IsTCP returns if the network is tcp, tcp4, or tcp6.
@@ -26,8 +47,231 @@ func (c Config) IsTCP() bool {
 	return c.Network == "tcp" || c.Network == "tcp4" || c.Network == "tcp6"
 }
 
+// GetAuthorizedIdentities returns the identities allowed to connect to the
+// server, including the deprecated authorizedIdentity.
+func (c Config) GetAuthorizedIdentities() []string {
+	if c.AuthorizedIdentity == "" {
+		return c.AuthorizedIdentities
+	}
+	return append([]string{c.AuthorizedIdentity}, c.AuthorizedIdentities...)
+}
+
+// GetAuthorizedFingerprints returns the certificate fingerprints allowed to
+// connect to the server, including the deprecated authorizedFingerprint.
+func (c Config) GetAuthorizedFingerprints() []string {
+	if c.AuthorizedFingerprint == "" {
+		return c.AuthorizedFingerprints
+	}
+	return append([]string{c.AuthorizedFingerprint}, c.AuthorizedFingerprints...)
+}
+
+// GetListeners returns the configuration of all the listeners of the server.
+// The first one is the default listener, defined by the top-level network,
+// address, TLS, and authorization settings.
+func (c Config) GetListeners() []ListenerConfig {
+	return append([]ListenerConfig{{
+		Name:                   DefaultListenerName,
+		Network:                c.Network,
+		Address:                c.Address,
+		Root:                   c.Root,
+		Certificate:            c.Certificate,
+		CertificateKey:         c.CertificateKey,
+		Password:               c.Password,
+		AuthorizedIdentities:   c.GetAuthorizedIdentities(),
+		AuthorizedFingerprints: c.GetAuthorizedFingerprints(),
+		SocketMode:             c.SocketMode,
+		SocketOwner:            c.SocketOwner,
+		SocketGroup:            c.SocketGroup,
+		ServerCertificate:      c.ServerCertificate,
+		Authorization:          c.Authorization,
+	}}, c.Listeners...)
+}
+
+// GetREST returns the configuration of the listener of the REST-JSON server,
+// and whether it is enabled. It uses the TLS and authorization settings of the
+// default listener, and its network unless restNetwork is set.
+func (c Config) GetREST() (ListenerConfig, bool) {
+	if c.RESTAddress == "" {
+		return ListenerConfig{}, false
+	}
+	rest := c.GetListeners()[0]
+	rest.Name = RESTListenerName
+	rest.Address = c.RESTAddress
+	if c.RESTNetwork != "" {
+		rest.Network = c.RESTNetwork
+	}
+	return rest, true
+}
+
+// GetAdmin returns the configuration of the listener of the admin API, and
+// whether it is enabled. The socket file of the admin API is only accessible
+// by its owner unless socketMode is set.
+func (c Config) GetAdmin() (ListenerConfig, bool) {
+	if c.Admin == nil {
+		return ListenerConfig{}, false
+	}
+	admin := *c.Admin
+	admin.Name = AdminListenerName
+	if !admin.IsTCP() && !isAbstractSocket(admin.Address) && admin.SocketMode == "" {
+		admin.SocketMode = "0600"
+	}
+	return admin, true
+}
+
+// GetStatePassword returns the password used to encrypt the private keys in
+// the state directory, by default the password of the provisioner.
+func (c Config) GetStatePassword() string {
+	if c.State != nil && c.State.Password != "" {
+		return c.State.Password
+	}
+	return c.Provisioner.Password
+}
+
 // Validate validates the configuration in Config.
 func (c Config) Validate() error {
+	listeners := c.GetListeners()
+	if err := listeners[0].Validate(); err != nil {
+		return err
+	}
+
+	// Additional listeners are identified by name and cannot share an
+	// address
+	listenerNames := map[string]bool{DefaultListenerName: true}
+	addresses := map[string]bool{c.Network + "://" + c.Address: true}
+	for _, l := range c.Listeners {
+		if l.Name == "" {
+			return errors.New("listeners.name cannot be empty")
+		}
+		if listenerNames[l.Name] {
+			return errors.Errorf("listeners.name %s is duplicated", l.Name)
+		}
+		if err := l.Validate(); err != nil {
+			return errors.Wrapf(err, "listener %s", l.Name)
+		}
+		if addresses[l.Network+"://"+l.Address] {
+			return errors.Errorf("listeners.address %s is duplicated", l.Address)
+		}
+		listenerNames[l.Name] = true
+		addresses[l.Network+"://"+l.Address] = true
+	}
+
+	// The REST server uses the mTLS settings of the default listener, so it
+	// can only use TCP if the default listener does.
+	if rest, ok := c.GetREST(); ok {
+		if err := rest.Validate(); err != nil {
+			return errors.Wrap(err, "rest")
+		}
+		switch {
+		case listenerNames[RESTListenerName]:
+			return errors.Errorf("listeners.name %s is reserved", RESTListenerName)
+		case addresses[rest.Network+"://"+rest.Address]:
+			return errors.Errorf("restAddress %s is duplicated", rest.Address)
+		case rest.IsTCP() && !listeners[0].IsTCP():
+			return errors.Errorf("restNetwork %s cannot be used if network is %s", rest.Network, c.Network)
+		}
+		addresses[rest.Network+"://"+rest.Address] = true
+	}
+
+	// The admin API is only available to authenticated clients, on TCP the
+	// client certificate must be explicitly authorized, and on UNIX domain
+	// sockets the permissions of the socket file restrict the clients, so
+	// abstract sockets, that have no permissions, are not allowed.
+	if admin, ok := c.GetAdmin(); ok {
+		if err := admin.Validate(); err != nil {
+			return errors.Wrap(err, "admin")
+		}
+		switch {
+		case listenerNames[AdminListenerName]:
+			return errors.Errorf("listeners.name %s is reserved", AdminListenerName)
+		case addresses[admin.Network+"://"+admin.Address]:
+			return errors.Errorf("admin.address %s is duplicated", admin.Address)
+		case admin.IsTCP() && len(admin.AuthorizedIdentities) == 0 && len(admin.AuthorizedFingerprints) == 0:
+			return errors.New("admin.authorizedIdentities or admin.authorizedFingerprints are required if network is tcp")
+		case !admin.IsTCP() && isAbstractSocket(admin.Address):
+			return errAbstractAdminAddress(admin.Address)
+		case len(admin.Authorization) > 0:
+			return errors.New("admin.authorization is not supported")
+		}
+		listeners = append(listeners, admin)
+	}
+
+	if err := c.Provisioner.Validate(); err != nil {
+		return err
+	}
+
+	// Additional provisioners are referenced by name
+	names := map[string]bool{c.Provisioner.Name: true}
+	for _, p := range c.Provisioners {
+		if p.Name == "" {
+			return errors.New("provisioners.name cannot be empty")
+		}
+		if names[p.Name] {
+			return errors.Errorf("provisioners.name %s is duplicated", p.Name)
+		}
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		names[p.Name] = true
+	}
+
+	for _, r := range c.Resources {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if !names[r.Provisioner] {
+			return errors.Errorf("resources.provisioner %s is not defined", r.Provisioner)
+		}
+	}
+
+	for _, l := range listeners {
+		if l.ServerCertificate != nil && !names[l.ServerCertificate.Provisioner] {
+			return errors.Errorf("serverCertificate.provisioner %s is not defined", l.ServerCertificate.Provisioner)
+		}
+	}
+
+	if c.Tracing != nil {
+		if err := c.Tracing.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.State != nil {
+		if err := c.State.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListenerConfig is the configuration of a listener of the server. Each
+// listener has its own network and address, TLS material, authorized
+// identities, and authorization policy, and all of them share the same
+// provisioners, resource profiles and secrets.
+type ListenerConfig struct {
+	Name                   string                   `json:"name"`
+	Network                string                   `json:"network"`
+	Address                string                   `json:"address"`
+	Root                   string                   `json:"root,omitempty"`
+	Certificate            string                   `json:"crt,omitempty"`
+	CertificateKey         string                   `json:"key,omitempty"`
+	Password               string                   `json:"password,omitempty"` // #nosec G117 -- JSON property for (un)marshaling
+	AuthorizedIdentities   []string                 `json:"authorizedIdentities,omitempty"`
+	AuthorizedFingerprints []string                 `json:"authorizedFingerprints,omitempty"`
+	SocketMode             string                   `json:"socketMode,omitempty"`
+	SocketOwner            string                   `json:"socketOwner,omitempty"`
+	SocketGroup            string                   `json:"socketGroup,omitempty"`
+	ServerCertificate      *ServerCertificateConfig `json:"serverCertificate,omitempty"`
+	Authorization          []AuthorizationRule      `json:"authorization,omitempty"`
+}
+
+// IsTCP returns if the network is tcp, tcp4, or tcp6.
+func (c ListenerConfig) IsTCP() bool {
+	return c.Network == "tcp" || c.Network == "tcp4" || c.Network == "tcp6"
+}
+
+// Validate validates the configuration in ListenerConfig. The provisioner of
+// the serverCertificate is validated by Config.
+func (c ListenerConfig) Validate() error {
 	switch {
 	case c.Network == "":
 		return errors.New("network cannot be empty")
@@ -43,8 +287,16 @@ func (c Config) Validate() error {
 	}
 
 	if tcp {
-		// root can be empty if the certs are trusted by the system
+		// root can be empty if the certs are trusted by the system, crt and key
+		// are not required if the certificate is signed by the CA
 		switch {
+		case c.ServerCertificate != nil:
+			if c.Certificate != "" || c.CertificateKey != "" {
+				return errors.New("crt and key cannot be used with serverCertificate")
+			}
+			if err := c.ServerCertificate.Validate(); err != nil {
+				return err
+			}
 		case c.Certificate == "":
 			return errors.Errorf("crt cannot be empty if network is %s", c.Network)
 		case c.CertificateKey == "":
@@ -52,11 +304,43 @@ func (c Config) Validate() error {
 		}
 	}
 
-	return c.Provisioner.Validate()
+	// The socket file options are only valid for file system sockets
+	if c.SocketMode != "" || c.SocketOwner != "" || c.SocketGroup != "" {
+		switch {
+		case tcp:
+			return errors.Errorf("socketMode, socketOwner and socketGroup cannot be used if network is %s", c.Network)
+		case isAbstractSocket(c.Address):
+			return errors.New("socketMode, socketOwner and socketGroup cannot be used with abstract sockets")
+		}
+		if c.SocketMode != "" {
+			if _, err := parseSocketMode(c.SocketMode); err != nil {
+				return err
+			}
+		}
+	}
+	if !tcp && isAbstractSocket(c.Address) && runtime.GOOS != "linux" {
+		return errors.Errorf("abstract socket %s is only supported on linux", c.Address)
+	}
+
+	if _, err := newIdentityMatcher(c.AuthorizedIdentities); err != nil {
+		return err
+	}
+	if err := validateFingerprints(c.AuthorizedFingerprints); err != nil {
+		return err
+	}
+
+	for _, a := range c.Authorization {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // ProvisionerConfig is the configuration used to initialize the provisioner.
 type ProvisionerConfig struct {
+	Name     string `json:"name,omitempty"`
 	Issuer   string `json:"issuer"`
 	KeyID    string `json:"kid"`
 	Password string `json:"password,omitempty"` // #nosec G117 -- JSON property for (un)marshaling
@@ -79,6 +363,277 @@ func (c ProvisionerConfig) Validate() error {
 	return nil
 }
 
+// ResourceConfig is the certificate profile used for the resources matching
+// its name. The name can be a resource name or a glob pattern like
+// "*.smallstep.com". The common name and the SANs can be templates using the
+// resource name and the Envoy node, e.g. "spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}".
+type ResourceConfig struct {
+	Name             string   `json:"name"`
+	CommonName       string   `json:"commonName,omitempty"`
+	DNSNames         []string `json:"dnsNames,omitempty"`
+	IPAddresses      []string `json:"ipAddresses,omitempty"`
+	URIs             []string `json:"uris,omitempty"`
+	KeyType          string   `json:"keyType,omitempty"`
+	Validity         string   `json:"validity,omitempty"`
+	RenewFraction    float64  `json:"renewFraction,omitempty"`
+	RenewBefore      string   `json:"renewBefore,omitempty"`
+	KeyRotation      string   `json:"keyRotation,omitempty"`
+	KeyRotationEvery int      `json:"keyRotationEvery,omitempty"`
+	Provisioner      string   `json:"provisioner,omitempty"`
+}
+
+// Validate validates the configuration in ResourceConfig.
+func (c ResourceConfig) Validate() error {
+	if c.Name == "" {
+		return errors.New("resources.name cannot be empty")
+	}
+	if _, err := path.Match(c.Name, ""); err != nil {
+		return errors.Errorf("resources.name %s is not a valid pattern", c.Name)
+	}
+	for _, s := range c.IPAddresses {
+		if !isTemplate(s) && net.ParseIP(s) == nil {
+			return errors.Errorf("resources.ipAddresses %s is not a valid IP address", s)
+		}
+	}
+	for _, s := range c.URIs {
+		if isTemplate(s) {
+			continue
+		}
+		if u, err := url.Parse(s); err != nil || u.Scheme == "" {
+			return errors.Errorf("resources.uris %s is not a valid URI", s)
+		}
+	}
+	for _, list := range [][]string{{c.CommonName}, c.DNSNames, c.IPAddresses, c.URIs} {
+		for _, s := range list {
+			if _, err := parseTemplate(s); err != nil {
+				return errors.Wrap(err, "resources contains an invalid template")
+			}
+		}
+	}
+	if _, ok := keyTypes[c.KeyType]; c.KeyType != "" && !ok {
+		return errors.Errorf(`invalid value "%s" for "resources.keyType", options are P-256, P-384, RSA-2048, RSA-4096 or Ed25519`, c.KeyType)
+	}
+	if c.Validity != "" {
+		if d, err := time.ParseDuration(c.Validity); err != nil || d <= 0 {
+			return errors.Errorf("resources.validity %s is not a valid duration", c.Validity)
+		}
+	}
+	if err := validateRenewPolicy("resources", c.RenewFraction, c.RenewBefore); err != nil {
+		return err
+	}
+	if err := validateKeyRotation("resources", c.KeyRotation, c.KeyRotationEvery); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Match returns if the given resource name matches the name or pattern in
+// ResourceConfig.
+func (c ResourceConfig) Match(name string) bool {
+	if c.Name == name {
+		return true
+	}
+	ok, err := path.Match(c.Name, name)
+	return err == nil && ok
+}
+
+// ServerCertificateConfig is the configuration of the TLS certificate of the
+// server when it is signed and renewed by the CA instead of being read from
+// disk.
+type ServerCertificateConfig struct {
+	CommonName       string   `json:"commonName"`
+	DNSNames         []string `json:"dnsNames,omitempty"`
+	IPAddresses      []string `json:"ipAddresses,omitempty"`
+	KeyType          string   `json:"keyType,omitempty"`
+	Validity         string   `json:"validity,omitempty"`
+	RenewFraction    float64  `json:"renewFraction,omitempty"`
+	RenewBefore      string   `json:"renewBefore,omitempty"`
+	KeyRotation      string   `json:"keyRotation,omitempty"`
+	KeyRotationEvery int      `json:"keyRotationEvery,omitempty"`
+	Provisioner      string   `json:"provisioner,omitempty"`
+}
+
+// Validate validates the configuration in ServerCertificateConfig.
+func (c ServerCertificateConfig) Validate() error {
+	if c.CommonName == "" {
+		return errors.New("serverCertificate.commonName cannot be empty")
+	}
+	for _, s := range c.IPAddresses {
+		if net.ParseIP(s) == nil {
+			return errors.Errorf("serverCertificate.ipAddresses %s is not a valid IP address", s)
+		}
+	}
+	if _, ok := keyTypes[c.KeyType]; c.KeyType != "" && !ok {
+		return errors.Errorf(`invalid value "%s" for "serverCertificate.keyType", options are P-256, P-384, RSA-2048, RSA-4096 or Ed25519`, c.KeyType)
+	}
+	if c.Validity != "" {
+		if d, err := time.ParseDuration(c.Validity); err != nil || d <= 0 {
+			return errors.Errorf("serverCertificate.validity %s is not a valid duration", c.Validity)
+		}
+	}
+	if err := validateRenewPolicy("serverCertificate", c.RenewFraction, c.RenewBefore); err != nil {
+		return err
+	}
+	if err := validateKeyRotation("serverCertificate", c.KeyRotation, c.KeyRotationEvery); err != nil {
+		return err
+	}
+	return nil
+}
+
+// secretRequest returns the request used to sign the server certificate. The
+// common name is always the first SAN.
+func (c ServerCertificateConfig) secretRequest() (*secretRequest, error) {
+	req := &secretRequest{
+		Name:        c.CommonName,
+		CommonName:  c.CommonName,
+		SANs:        appendUnique(appendUnique([]string{c.CommonName}, c.DNSNames...), c.IPAddresses...),
+		KeyType:     c.KeyType,
+		Provisioner: c.Provisioner,
+	}
+	if c.Validity != "" {
+		d, err := time.ParseDuration(c.Validity)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing validity %s", c.Validity)
+		}
+		req.Validity = d
+	}
+	renewal, err := newRenewPolicy(c.RenewFraction, c.RenewBefore)
+	if err != nil {
+		return nil, err
+	}
+	req.Renewal = renewal
+	req.Rotation = keyRotation{Method: c.KeyRotation, Every: c.KeyRotationEvery}
+	return req, nil
+}
+
+// validateRenewPolicy validates the renewFraction and renewBefore properties
+// of the given object.
+func validateRenewPolicy(object string, fraction float64, before string) error {
+	switch {
+	case fraction < 0 || fraction >= 1:
+		return errors.Errorf("%s.renewFraction %v is not between 0 and 1", object, fraction)
+	case fraction > 0 && before != "":
+		return errors.Errorf("%s.renewFraction and %s.renewBefore cannot be used together", object, object)
+	case before != "":
+		if d, err := time.ParseDuration(before); err != nil || d <= 0 {
+			return errors.Errorf("%s.renewBefore %s is not a valid duration", object, before)
+		}
+	}
+	return nil
+}
+
+// validateKeyRotation validates the keyRotation and keyRotationEvery
+// properties of the given object.
+func validateKeyRotation(object, rotation string, every int) error {
+	switch {
+	case rotation != "" && rotation != keyRotationRekey && rotation != keyRotationSign:
+		return errors.Errorf(`invalid value "%s" for "%s.keyRotation", options are rekey or sign`, rotation, object)
+	case every < 0:
+		return errors.Errorf("%s.keyRotationEvery %d cannot be negative", object, every)
+	case every > 0 && rotation == "":
+		return errors.Errorf("%s.keyRotationEvery requires %s.keyRotation", object, object)
+	}
+	return nil
+}
+
+// newRenewPolicy returns the renew policy for the given renewFraction and
+// renewBefore properties.
+func newRenewPolicy(fraction float64, before string) (renewPolicy, error) {
+	p := renewPolicy{Fraction: fraction}
+	if before != "" {
+		d, err := time.ParseDuration(before)
+		if err != nil {
+			return p, errors.Wrapf(err, "error parsing renewBefore %s", before)
+		}
+		p.Before = d
+	}
+	return p, nil
+}
+
+// TracingConfig is the configuration used to export OpenTelemetry traces to
+// an OTLP collector using gRPC.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`
+	Insecure    bool              `json:"insecure,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"serviceName,omitempty"`
+	SampleRatio *float64          `json:"sampleRatio,omitempty"`
+}
+
+// Validate validates the configuration in TracingConfig.
+func (c TracingConfig) Validate() error {
+	if c.Endpoint == "" {
+		return errors.New("tracing.endpoint cannot be empty")
+	}
+	if _, _, err := net.SplitHostPort(c.Endpoint); err != nil {
+		return errors.Errorf("tracing.endpoint %s is not a valid host:port", c.Endpoint)
+	}
+	if c.SampleRatio != nil && (*c.SampleRatio < 0 || *c.SampleRatio > 1) {
+		return errors.Errorf("tracing.sampleRatio %v is not between 0 and 1", *c.SampleRatio)
+	}
+	return nil
+}
+
+// StateConfig is the configuration of the directory where the signed
+// certificates, their private keys and the roots are stored, so they can be
+// served after a restart. The private keys are encrypted with the password, or
+// with the password of the provisioner if it's empty.
+type StateConfig struct {
+	Directory string `json:"directory"`
+	Password  string `json:"password,omitempty"` // #nosec G117 -- JSON property for (un)marshaling
+}
+
+// Validate validates the configuration in StateConfig.
+func (c StateConfig) Validate() error {
+	if c.Directory == "" {
+		return errors.New("state.directory cannot be empty")
+	}
+	return nil
+}
+
+// AuthorizationRule allows the SDS clients matching its identities, nodes and
+// clusters to request the resource names matching its resources. An empty list
+// of identities, nodes or clusters matches any client. All the values can be
+// glob patterns like "*.smallstep.com", where "*" does not match "/". The
+// identities of a client are the common name, the DNS SANs and the URI SANs of
+// its certificate.
+//
+// The common name and SANs of the certificates are rendered from the node sent
+// by the client if the resource profile uses templates. If the rule sets sans,
+// the common name and all the SANs rendered for a resource must match them too.
+//
+// On UNIX domain sockets, the rule can also match the credentials of the peer
+// process: its uid, gid, or the path of its executable. These lists never
+// match clients without peer credentials.
+type AuthorizationRule struct {
+	Identities  []string `json:"identities,omitempty"`
+	Nodes       []string `json:"nodes,omitempty"`
+	Clusters    []string `json:"clusters,omitempty"`
+	UIDs        []uint32 `json:"uids,omitempty"`
+	GIDs        []uint32 `json:"gids,omitempty"`
+	Executables []string `json:"executables,omitempty"`
+	Resources   []string `json:"resources"`
+	SANs        []string `json:"sans,omitempty"`
+}
+
+// Validate validates the configuration in AuthorizationRule.
+func (c AuthorizationRule) Validate() error {
+	if len(c.Resources) == 0 {
+		return errors.New("authorization.resources cannot be empty")
+	}
+	for _, list := range [][]string{c.Identities, c.Nodes, c.Clusters, c.Executables, c.Resources, c.SANs} {
+		for _, s := range list {
+			if s == "" {
+				return errors.New("authorization cannot contain empty values")
+			}
+			if _, err := path.Match(s, ""); err != nil {
+				return errors.Errorf("authorization value %s is not a valid pattern", s)
+			}
+		}
+	}
+	return nil
+}
+
 // LoadConfiguration parses the given filename in JSON format and returns the
 // configuration struct.
 func LoadConfiguration(filename string) (Config, error) {
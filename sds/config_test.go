@@ -2,7 +2,9 @@ package sds
 
 import (
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestConfig_IsTCP(t *testing.T) {
@@ -88,6 +90,383 @@ func TestConfig_Validate(t *testing.T) {
 	}
 }
 
+func TestConfig_Validate_authorized(t *testing.T) {
+	p := ProvisionerConfig{
+		Issuer:   "issuer",
+		KeyID:    "key-id",
+		Password: "password",
+		CaURL:    "https://ca",
+		CaRoot:   "root.crt",
+	}
+	fp := "8597a5d0b86f4a630f64fbb903b613ceb04756319a156bb6a6faed95394040ff"
+	type fields struct {
+		AuthorizedIdentity     string
+		AuthorizedFingerprint  string
+		AuthorizedIdentities   []string
+		AuthorizedFingerprints []string
+	}
+	tests := []struct {
+		name             string
+		fields           fields
+		wantIdentities   []string
+		wantFingerprints []string
+		wantErr          bool
+	}{
+		{"ok empty", fields{}, nil, nil, false},
+		{"ok deprecated", fields{"envoy", fp, nil, nil}, []string{"envoy"}, []string{fp}, false},
+		{"ok lists", fields{"", "", []string{"*.smallstep.com", "regexp:spiffe://prod/.+"}, []string{fp, "abcd"}}, []string{"*.smallstep.com", "regexp:spiffe://prod/.+"}, []string{fp, "abcd"}, false},
+		{"ok both", fields{"envoy", fp, []string{"spiffe://prod/envoy"}, []string{"abcd"}}, []string{"envoy", "spiffe://prod/envoy"}, []string{fp, "abcd"}, false},
+		{"fail identity pattern", fields{"", "", []string{"[envoy"}, nil}, nil, nil, true},
+		{"fail identity regexp", fields{"", "", []string{"regexp:[envoy"}, nil}, nil, nil, true},
+		{"fail fingerprint", fields{"", "", nil, []string{"zz"}}, nil, nil, true},
+		{"fail deprecated fingerprint", fields{"", "zz", nil, nil}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				Network:                "unix",
+				Address:                "/tmp/sds.unix",
+				AuthorizedIdentity:     tt.fields.AuthorizedIdentity,
+				AuthorizedFingerprint:  tt.fields.AuthorizedFingerprint,
+				AuthorizedIdentities:   tt.fields.AuthorizedIdentities,
+				AuthorizedFingerprints: tt.fields.AuthorizedFingerprints,
+				Provisioner:            p,
+			}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if got := c.GetAuthorizedIdentities(); !reflect.DeepEqual(got, tt.wantIdentities) {
+					t.Errorf("Config.GetAuthorizedIdentities() = %v, want %v", got, tt.wantIdentities)
+				}
+				if got := c.GetAuthorizedFingerprints(); !reflect.DeepEqual(got, tt.wantFingerprints) {
+					t.Errorf("Config.GetAuthorizedFingerprints() = %v, want %v", got, tt.wantFingerprints)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_serverCertificate(t *testing.T) {
+	p := ProvisionerConfig{
+		Issuer:   "issuer",
+		KeyID:    "key-id",
+		Password: "password",
+		CaURL:    "https://ca",
+		CaRoot:   "root.crt",
+	}
+	sc := &ServerCertificateConfig{CommonName: "sds.smallstep.com"}
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{"ok", Config{Network: "tcp", Address: ":443", ServerCertificate: sc, Provisioner: p}, false},
+		{"ok root", Config{Network: "tcp", Address: ":443", Root: "root.crt", ServerCertificate: sc, Provisioner: p}, false},
+		{"ok unix", Config{Network: "unix", Address: "/tmp/sds.unix", ServerCertificate: &ServerCertificateConfig{}, Provisioner: p}, false},
+		{"fail crt", Config{Network: "tcp", Address: ":443", Certificate: "cert.crt", ServerCertificate: sc, Provisioner: p}, true},
+		{"fail key", Config{Network: "tcp", Address: ":443", CertificateKey: "cert.key", ServerCertificate: sc, Provisioner: p}, true},
+		{"fail common name", Config{Network: "tcp", Address: ":443", ServerCertificate: &ServerCertificateConfig{}, Provisioner: p}, true},
+		{"fail provisioner", Config{Network: "tcp", Address: ":443", ServerCertificate: &ServerCertificateConfig{CommonName: "sds", Provisioner: "missing"}, Provisioner: p}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTracingConfig_Validate(t *testing.T) {
+	ratio := func(f float64) *float64 {
+		return &f
+	}
+	tests := []struct {
+		name    string
+		c       TracingConfig
+		wantErr bool
+	}{
+		{"ok", TracingConfig{Endpoint: "localhost:4317"}, false},
+		{"ok all", TracingConfig{Endpoint: "otel.smallstep.com:4317", Insecure: true, Headers: map[string]string{"x-api-key": "secret"}, ServiceName: "sds", SampleRatio: ratio(0.5)}, false},
+		{"ok zero ratio", TracingConfig{Endpoint: "localhost:4317", SampleRatio: ratio(0)}, false},
+		{"fail endpoint", TracingConfig{}, true},
+		{"fail endpoint port", TracingConfig{Endpoint: "localhost"}, true},
+		{"fail ratio", TracingConfig{Endpoint: "localhost:4317", SampleRatio: ratio(1.5)}, true},
+		{"fail negative ratio", TracingConfig{Endpoint: "localhost:4317", SampleRatio: ratio(-1)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("TracingConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStateConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       StateConfig
+		wantErr bool
+	}{
+		{"ok", StateConfig{Directory: "/var/lib/step-sds"}, false},
+		{"ok password", StateConfig{Directory: "/var/lib/step-sds", Password: "password"}, false},
+		{"fail directory", StateConfig{Password: "password"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("StateConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_GetStatePassword(t *testing.T) {
+	p := ProvisionerConfig{Password: "provisioner"}
+	tests := []struct {
+		name string
+		c    Config
+		want string
+	}{
+		{"ok", Config{Provisioner: p, State: &StateConfig{Directory: "state", Password: "state"}}, "state"},
+		{"ok provisioner", Config{Provisioner: p, State: &StateConfig{Directory: "state"}}, "provisioner"},
+		{"ok no state", Config{Provisioner: p}, "provisioner"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.GetStatePassword(); got != tt.want {
+				t.Errorf("Config.GetStatePassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_listeners(t *testing.T) {
+	p := ProvisionerConfig{
+		Issuer:   "issuer",
+		KeyID:    "key-id",
+		Password: "password",
+		CaURL:    "https://ca",
+		CaRoot:   "root.crt",
+	}
+	uds := ListenerConfig{Name: "local", Network: "unix", Address: "/tmp/local.unix"}
+	mtls := ListenerConfig{Name: "gateway", Network: "tcp", Address: ":8443", Certificate: "sds.crt", CertificateKey: "sds.key", AuthorizedIdentities: []string{"*.gateway.internal"}}
+	withName := func(l ListenerConfig, name string) ListenerConfig {
+		l.Name = name
+		return l
+	}
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{"ok", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{uds, mtls}, Provisioner: p}, false},
+		{"ok serverCertificate", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{
+			{Name: "gateway", Network: "tcp", Address: ":8443", ServerCertificate: &ServerCertificateConfig{CommonName: "sds"}},
+		}, Provisioner: p}, false},
+		{"fail name", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{withName(uds, "")}, Provisioner: p}, true},
+		{"fail default name", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{withName(uds, "default")}, Provisioner: p}, true},
+		{"fail duplicated name", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{uds, withName(mtls, "local")}, Provisioner: p}, true},
+		{"fail duplicated address", Config{Network: "unix", Address: "/tmp/local.unix", Listeners: []ListenerConfig{uds}, Provisioner: p}, true},
+		{"fail rest address", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", RESTAddress: ":8443", Listeners: []ListenerConfig{mtls}, Provisioner: p}, true},
+		{"ok rest unix", Config{Network: "unix", Address: "/tmp/sds.unix", RESTAddress: "/tmp/rest.unix", Provisioner: p}, false},
+		{"ok rest tcp", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", RESTAddress: ":8443", Provisioner: p}, false},
+		{"ok rest unix with tcp", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", RESTNetwork: "unix", RESTAddress: "/tmp/rest.unix", Provisioner: p}, false},
+		{"fail rest tcp with unix", Config{Network: "unix", Address: "/tmp/sds.unix", RESTNetwork: "tcp", RESTAddress: ":8443", Provisioner: p}, true},
+		{"fail rest network", Config{Network: "unix", Address: "/tmp/sds.unix", RESTNetwork: "udp", RESTAddress: ":8443", Provisioner: p}, true},
+		{"fail rest duplicated address", Config{Network: "unix", Address: "/tmp/sds.unix", RESTAddress: "/tmp/sds.unix", Provisioner: p}, true},
+		{"fail rest name", Config{Network: "unix", Address: "/tmp/sds.unix", RESTAddress: "/tmp/rest.unix", Listeners: []ListenerConfig{withName(uds, "rest")}, Provisioner: p}, true},
+		{"fail network", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "udp", Address: ":53"}}, Provisioner: p}, true},
+		{"fail crt", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "tcp", Address: ":8443", CertificateKey: "sds.key"}}, Provisioner: p}, true},
+		{"fail identities", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "unix", Address: "/tmp/foo.unix", AuthorizedIdentities: []string{"regexp:("}}}, Provisioner: p}, true},
+		{"fail fingerprints", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "unix", Address: "/tmp/foo.unix", AuthorizedFingerprints: []string{"xyz"}}}, Provisioner: p}, true},
+		{"fail authorization", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "unix", Address: "/tmp/foo.unix", Authorization: []AuthorizationRule{{Identities: []string{"foo"}}}}}, Provisioner: p}, true},
+		{"ok socket", Config{Network: "unix", Address: "/tmp/sds.unix", SocketMode: "0660", SocketOwner: "envoy", SocketGroup: "101", Provisioner: p}, false},
+		{"ok abstract", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "unix", Address: "@sds"}}, Provisioner: p}, runtime.GOOS != "linux"},
+		{"fail socket mode", Config{Network: "unix", Address: "/tmp/sds.unix", SocketMode: "rw", Provisioner: p}, true},
+		{"fail socket tcp", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", SocketGroup: "envoy", Provisioner: p}, true},
+		{"fail socket abstract", Config{Network: "unix", Address: "@sds", SocketMode: "0660", Provisioner: p}, true},
+		{"fail listener socket", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "foo", Network: "unix", Address: "/tmp/foo.unix", SocketMode: "0999"}}, Provisioner: p}, true},
+		{"fail serverCertificate provisioner", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{
+			{Name: "gateway", Network: "tcp", Address: ":8443", ServerCertificate: &ServerCertificateConfig{CommonName: "sds", Provisioner: "missing"}},
+		}, Provisioner: p}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate_admin(t *testing.T) {
+	p := ProvisionerConfig{
+		Issuer:   "issuer",
+		KeyID:    "key-id",
+		Password: "password",
+		CaURL:    "https://ca",
+		CaRoot:   "root.crt",
+	}
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr bool
+	}{
+		{"ok unix", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix"}, Provisioner: p}, false},
+		{"ok tcp", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "tcp", Address: "127.0.0.1:9443", Certificate: "sds.crt", CertificateKey: "sds.key", AuthorizedIdentities: []string{"admin.smallstep.com"}}, Provisioner: p}, false},
+		{"ok tcp fingerprints", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "tcp", Address: "127.0.0.1:9443", ServerCertificate: &ServerCertificateConfig{CommonName: "sds"}, AuthorizedFingerprints: []string{"abcd"}}, Provisioner: p}, false},
+		{"fail tcp identities", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "tcp", Address: "127.0.0.1:9443", Certificate: "sds.crt", CertificateKey: "sds.key"}, Provisioner: p}, true},
+		{"fail tcp crt", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "tcp", Address: "127.0.0.1:9443", AuthorizedIdentities: []string{"admin"}}, Provisioner: p}, true},
+		{"fail address", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "unix", Address: "/tmp/sds.unix"}, Provisioner: p}, true},
+		{"fail listener name", Config{Network: "unix", Address: "/tmp/sds.unix", Listeners: []ListenerConfig{{Name: "admin", Network: "unix", Address: "/tmp/foo.unix"}}, Admin: &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix"}, Provisioner: p}, true},
+		{"fail abstract", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "unix", Address: "@admin"}, Provisioner: p}, true},
+		{"fail authorization", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix", Authorization: []AuthorizationRule{{Resources: []string{"*"}}}}, Provisioner: p}, true},
+		{"fail serverCertificate provisioner", Config{Network: "unix", Address: "/tmp/sds.unix", Admin: &ListenerConfig{Network: "tcp", Address: "127.0.0.1:9443", ServerCertificate: &ServerCertificateConfig{CommonName: "sds", Provisioner: "missing"}, AuthorizedIdentities: []string{"admin"}}, Provisioner: p}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfig_GetAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		admin  *ListenerConfig
+		want   ListenerConfig
+		wantOK bool
+	}{
+		{"disabled", nil, ListenerConfig{}, false},
+		{"unix", &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix"}, ListenerConfig{Name: "admin", Network: "unix", Address: "/tmp/admin.unix", SocketMode: "0600"}, true},
+		{"unix mode", &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix", SocketMode: "0660"}, ListenerConfig{Name: "admin", Network: "unix", Address: "/tmp/admin.unix", SocketMode: "0660"}, true},
+		{"abstract", &ListenerConfig{Network: "unix", Address: "@admin"}, ListenerConfig{Name: "admin", Network: "unix", Address: "@admin"}, true},
+		{"tcp", &ListenerConfig{Network: "tcp", Address: ":9443"}, ListenerConfig{Name: "admin", Network: "tcp", Address: ":9443"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Config{Admin: tt.admin}.GetAdmin()
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("Config.GetAdmin() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestConfig_GetREST(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      Config
+		want   ListenerConfig
+		wantOK bool
+	}{
+		{"disabled", Config{Network: "unix", Address: "/tmp/sds.unix"}, ListenerConfig{}, false},
+		{"unix", Config{Network: "unix", Address: "/tmp/sds.unix", SocketMode: "0660", RESTAddress: "/tmp/rest.unix"},
+			ListenerConfig{Name: "rest", Network: "unix", Address: "/tmp/rest.unix", SocketMode: "0660"}, true},
+		{"tcp", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", RESTAddress: ":8443"},
+			ListenerConfig{Name: "rest", Network: "tcp", Address: ":8443", Certificate: "sds.crt", CertificateKey: "sds.key"}, true},
+		{"unix with tcp", Config{Network: "tcp", Address: ":443", Certificate: "sds.crt", CertificateKey: "sds.key", RESTNetwork: "unix", RESTAddress: "/tmp/rest.unix"},
+			ListenerConfig{Name: "rest", Network: "unix", Address: "/tmp/rest.unix", Certificate: "sds.crt", CertificateKey: "sds.key"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.c.GetREST()
+			if !reflect.DeepEqual(got, tt.want) || ok != tt.wantOK {
+				t.Errorf("Config.GetREST() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestConfig_GetListeners(t *testing.T) {
+	rules := []AuthorizationRule{{Resources: []string{"*"}}}
+	gateway := ListenerConfig{Name: "gateway", Network: "tcp", Address: ":8443"}
+	c := Config{
+		Network:                "unix",
+		Address:                "/tmp/sds.unix",
+		AuthorizedIdentity:     "foo",
+		AuthorizedIdentities:   []string{"bar"},
+		AuthorizedFingerprints: []string{"abcd"},
+		Authorization:          rules,
+		Listeners:              []ListenerConfig{gateway},
+	}
+	want := []ListenerConfig{{
+		Name:                   DefaultListenerName,
+		Network:                "unix",
+		Address:                "/tmp/sds.unix",
+		AuthorizedIdentities:   []string{"foo", "bar"},
+		AuthorizedFingerprints: []string{"abcd"},
+		Authorization:          rules,
+	}, gateway}
+	if got := c.GetListeners(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Config.GetListeners() = %v, want %v", got, want)
+	}
+}
+
+func TestServerCertificateConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       ServerCertificateConfig
+		wantErr bool
+	}{
+		{"ok", ServerCertificateConfig{CommonName: "sds.smallstep.com"}, false},
+		{"ok all", ServerCertificateConfig{CommonName: "sds.smallstep.com", DNSNames: []string{"sds"}, IPAddresses: []string{"127.0.0.1", "::1"}, KeyType: "P-384", Validity: "24h", Provisioner: "sds"}, false},
+		{"fail common name", ServerCertificateConfig{DNSNames: []string{"sds"}}, true},
+		{"fail ip", ServerCertificateConfig{CommonName: "sds.smallstep.com", IPAddresses: []string{"foo"}}, true},
+		{"fail key type", ServerCertificateConfig{CommonName: "sds.smallstep.com", KeyType: "RSA-1024"}, true},
+		{"fail validity", ServerCertificateConfig{CommonName: "sds.smallstep.com", Validity: "1d"}, true},
+		{"fail negative validity", ServerCertificateConfig{CommonName: "sds.smallstep.com", Validity: "-1h"}, true},
+		{"ok renew fraction", ServerCertificateConfig{CommonName: "sds.smallstep.com", RenewFraction: 0.5}, false},
+		{"ok renew before", ServerCertificateConfig{CommonName: "sds.smallstep.com", RenewBefore: "8h"}, false},
+		{"fail renew fraction", ServerCertificateConfig{CommonName: "sds.smallstep.com", RenewFraction: 1}, true},
+		{"fail renew before", ServerCertificateConfig{CommonName: "sds.smallstep.com", RenewBefore: "-8h"}, true},
+		{"ok key rotation", ServerCertificateConfig{CommonName: "sds.smallstep.com", KeyRotation: "rekey", KeyRotationEvery: 3}, false},
+		{"fail key rotation", ServerCertificateConfig{CommonName: "sds.smallstep.com", KeyRotation: "always"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("ServerCertificateConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerCertificateConfig_secretRequest(t *testing.T) {
+	c := ServerCertificateConfig{
+		CommonName:  "sds.smallstep.com",
+		DNSNames:    []string{"sds.internal", "sds.smallstep.com"},
+		IPAddresses: []string{"127.0.0.1"},
+		KeyType:     "P-384",
+		Validity:    "24h",
+		RenewBefore: "8h",
+		KeyRotation: "sign",
+		Provisioner: "sds",
+	}
+	got, err := c.secretRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &secretRequest{
+		Name:        "sds.smallstep.com",
+		CommonName:  "sds.smallstep.com",
+		SANs:        []string{"sds.smallstep.com", "sds.internal", "127.0.0.1"},
+		KeyType:     "P-384",
+		Validity:    24 * time.Hour,
+		Provisioner: "sds",
+		Renewal:     renewPolicy{Before: 8 * time.Hour},
+		Rotation:    keyRotation{Method: "sign"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ServerCertificateConfig.secretRequest() = %v, want %v", got, want)
+	}
+}
+
 func TestProvisionerConfig_Validate(t *testing.T) {
 	type fields struct {
 		Issuer   string
@@ -124,6 +503,201 @@ func TestProvisionerConfig_Validate(t *testing.T) {
 	}
 }
 
+func TestConfig_Validate_resources(t *testing.T) {
+	p := ProvisionerConfig{
+		Issuer:   "issuer",
+		KeyID:    "key-id",
+		Password: "password",
+		CaURL:    "https://ca",
+		CaRoot:   "root.crt",
+	}
+	named := func(name string) ProvisionerConfig {
+		pp := p
+		pp.Name = name
+		return pp
+	}
+	type fields struct {
+		Provisioner  ProvisionerConfig
+		Provisioners []ProvisionerConfig
+		Resources    []ResourceConfig
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		wantErr bool
+	}{
+		{"ok", fields{p, nil, []ResourceConfig{{Name: "*.smallstep.com"}}}, false},
+		{"ok provisioners", fields{p, []ProvisionerConfig{named("ingress"), named("backend")}, []ResourceConfig{
+			{Name: "ingress.smallstep.com", Provisioner: "ingress"},
+			{Name: "*.smallstep.com", Provisioner: "backend"},
+			{Name: "*"},
+		}}, false},
+		{"ok named default", fields{named("default"), nil, []ResourceConfig{{Name: "*", Provisioner: "default"}}}, false},
+		{"fail provisioner name", fields{p, []ProvisionerConfig{p}, nil}, true},
+		{"fail provisioner duplicated", fields{named("ingress"), []ProvisionerConfig{named("ingress")}, nil}, true},
+		{"fail provisioner", fields{p, []ProvisionerConfig{{Name: "ingress"}}, nil}, true},
+		{"fail resource", fields{p, nil, []ResourceConfig{{}}}, true},
+		{"fail resource provisioner", fields{p, []ProvisionerConfig{named("ingress")}, []ResourceConfig{{Name: "*", Provisioner: "backend"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{
+				Network:      "unix",
+				Address:      "/tmp/sds.unix",
+				Provisioner:  tt.fields.Provisioner,
+				Provisioners: tt.fields.Provisioners,
+				Resources:    tt.fields.Resources,
+			}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceConfig_Validate(t *testing.T) {
+	type fields struct {
+		Name        string
+		DNSNames    []string
+		IPAddresses []string
+		URIs        []string
+		KeyType     string
+		Validity    string
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		wantErr bool
+	}{
+		{"ok", fields{"foo.smallstep.com", nil, nil, nil, "", ""}, false},
+		{"ok pattern", fields{"*.smallstep.com", nil, nil, nil, "", ""}, false},
+		{"ok all", fields{"foo.smallstep.com", []string{"bar.smallstep.com"}, []string{"10.0.0.1", "::1"}, []string{"spiffe://smallstep.com/foo"}, "RSA-4096", "24h"}, false},
+		{"ok P-256", fields{"foo.smallstep.com", nil, nil, nil, "P-256", ""}, false},
+		{"ok P-384", fields{"foo.smallstep.com", nil, nil, nil, "P-384", ""}, false},
+		{"ok RSA-2048", fields{"foo.smallstep.com", nil, nil, nil, "RSA-2048", ""}, false},
+		{"ok Ed25519", fields{"foo.smallstep.com", nil, nil, nil, "Ed25519", ""}, false},
+		{"ok templates", fields{"default", []string{"{{.Node.Metadata.namespace}}.svc.cluster.local"}, []string{"{{.Node.Metadata.ip}}"}, []string{"spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}"}, "", ""}, false},
+		{"fail name", fields{"", nil, nil, nil, "", ""}, true},
+		{"fail template", fields{"default", []string{"{{.Node.Id"}, nil, nil, "", ""}, true},
+		{"fail uri template", fields{"default", nil, nil, []string{"spiffe://{{.Node.Id"}, "", ""}, true},
+		{"fail pattern", fields{"[foo", nil, nil, nil, "", ""}, true},
+		{"fail ip", fields{"foo.smallstep.com", nil, []string{"foo"}, nil, "", ""}, true},
+		{"fail uri", fields{"foo.smallstep.com", nil, nil, []string{"foo"}, "", ""}, true},
+		{"fail key type", fields{"foo.smallstep.com", nil, nil, nil, "RSA-1024", ""}, true},
+		{"fail validity", fields{"foo.smallstep.com", nil, nil, nil, "", "1d"}, true},
+		{"fail negative validity", fields{"foo.smallstep.com", nil, nil, nil, "", "-1h"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ResourceConfig{
+				Name:        tt.fields.Name,
+				DNSNames:    tt.fields.DNSNames,
+				IPAddresses: tt.fields.IPAddresses,
+				URIs:        tt.fields.URIs,
+				KeyType:     tt.fields.KeyType,
+				Validity:    tt.fields.Validity,
+			}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("ResourceConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceConfig_Validate_renew(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       ResourceConfig
+		wantErr bool
+	}{
+		{"ok fraction", ResourceConfig{Name: "foo", RenewFraction: 0.66}, false},
+		{"ok before", ResourceConfig{Name: "foo", RenewBefore: "1h30m"}, false},
+		{"fail fraction zero", ResourceConfig{Name: "foo", RenewFraction: -0.5}, true},
+		{"fail fraction one", ResourceConfig{Name: "foo", RenewFraction: 1}, true},
+		{"fail before", ResourceConfig{Name: "foo", RenewBefore: "1d"}, true},
+		{"fail negative before", ResourceConfig{Name: "foo", RenewBefore: "-1h"}, true},
+		{"fail both", ResourceConfig{Name: "foo", RenewFraction: 0.5, RenewBefore: "1h"}, true},
+		{"ok rekey", ResourceConfig{Name: "foo", KeyRotation: "rekey"}, false},
+		{"ok sign every", ResourceConfig{Name: "foo", KeyRotation: "sign", KeyRotationEvery: 5}, false},
+		{"fail key rotation", ResourceConfig{Name: "foo", KeyRotation: "renew"}, true},
+		{"fail key rotation every", ResourceConfig{Name: "foo", KeyRotation: "rekey", KeyRotationEvery: -1}, true},
+		{"fail key rotation every without method", ResourceConfig{Name: "foo", KeyRotationEvery: 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("ResourceConfig.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResourceConfig_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		resource string
+		want     bool
+	}{
+		{"ok exact", "foo.smallstep.com", "foo.smallstep.com", true},
+		{"ok pattern", "*.smallstep.com", "foo.smallstep.com", true},
+		{"ok any", "*", "foo.smallstep.com", true},
+		{"ok invalid pattern", "[foo", "[foo", true},
+		{"fail exact", "foo.smallstep.com", "bar.smallstep.com", false},
+		{"fail pattern", "*.smallstep.com", "foo.example.com", false},
+		{"fail invalid pattern", "[foo", "foo", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ResourceConfig{Name: tt.pattern}
+			if got := c.Match(tt.resource); got != tt.want {
+				t.Errorf("ResourceConfig.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizationRule_Validate(t *testing.T) {
+	type fields struct {
+		Identities  []string
+		Nodes       []string
+		Clusters    []string
+		Resources   []string
+		Executables []string
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		wantErr bool
+	}{
+		{"ok", fields{nil, nil, nil, []string{"*.smallstep.com"}, nil}, false},
+		{"ok all", fields{[]string{"envoy"}, []string{"node-*"}, []string{"cluster"}, []string{"foo.smallstep.com", "trusted_ca"}, nil}, false},
+		{"fail no resources", fields{[]string{"envoy"}, nil, nil, nil, nil}, true},
+		{"fail empty resource", fields{nil, nil, nil, []string{""}, nil}, true},
+		{"fail empty identity", fields{[]string{""}, nil, nil, []string{"foo"}, nil}, true},
+		{"fail node pattern", fields{nil, []string{"[node"}, nil, []string{"foo"}, nil}, true},
+		{"fail cluster pattern", fields{nil, nil, []string{"[cluster"}, []string{"foo"}, nil}, true},
+		{"fail resource pattern", fields{nil, nil, nil, []string{"[foo"}, nil}, true},
+		{"ok executables", fields{nil, nil, nil, []string{"foo"}, []string{"/usr/local/bin/envoy", "/opt/*/envoy"}}, false},
+		{"fail empty executable", fields{nil, nil, nil, []string{"foo"}, []string{""}}, true},
+		{"fail executable pattern", fields{nil, nil, nil, []string{"foo"}, []string{"/usr/[bin"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := AuthorizationRule{
+				Identities:  tt.fields.Identities,
+				Nodes:       tt.fields.Nodes,
+				Clusters:    tt.fields.Clusters,
+				Resources:   tt.fields.Resources,
+				Executables: tt.fields.Executables,
+			}
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("AuthorizationRule.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestLoadConfiguration(t *testing.T) {
 	c := Config{
 		Network:               "tcp",
@@ -0,0 +1,422 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/smallstep/step-sds/logging"
+	"go.step.sm/crypto/randutil"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// deltaResource is the state of a resource subscribed in an incremental
+// stream.
+type deltaResource struct {
+	entry      *cacheEntry
+	version    string
+	value      []byte
+	acked      string
+	ackedValue []byte
+}
+
+// maxPendingNonces is the number of responses of an incremental stream that
+// are remembered while waiting for an ACK or NACK.
+const maxPendingNonces = 100
+
+// pendingNonces contains the resources and versions sent on the latest nonces
+// that are waiting for an ACK or NACK. A resource is only pending on the
+// latest nonce that sent it, but the previous nonces are still remembered, so
+// they can be acknowledged. Only the last maxPendingNonces are kept, so a
+// client that does not answer some responses cannot grow it.
+type pendingNonces struct {
+	nonces []string
+	sent   map[string]map[string]string
+}
+
+func newPendingNonces() *pendingNonces {
+	return &pendingNonces{
+		sent: make(map[string]map[string]string),
+	}
+}
+
+// Add adds the resources sent on the given nonce, and removes them from the
+// previous nonces. The oldest nonce is forgotten if there are too many.
+func (p *pendingNonces) Add(nonce string, sent map[string]string) {
+	for name := range sent {
+		p.remove(name)
+	}
+	if len(p.nonces) == maxPendingNonces {
+		delete(p.sent, p.nonces[0])
+		p.nonces = p.nonces[1:]
+	}
+	p.nonces = append(p.nonces, nonce)
+	p.sent[nonce] = sent
+}
+
+// Remove removes the given resources from the pending nonces.
+func (p *pendingNonces) Remove(names []string) {
+	for _, name := range names {
+		p.remove(name)
+	}
+}
+
+// Take returns and forgets the resources still pending on the given nonce. It
+// returns false if the nonce was not sent or it has been forgotten.
+func (p *pendingNonces) Take(nonce string) (map[string]string, bool) {
+	sent, ok := p.sent[nonce]
+	if !ok {
+		return nil, false
+	}
+	delete(p.sent, nonce)
+	for i, n := range p.nonces {
+		if n == nonce {
+			p.nonces = append(p.nonces[:i], p.nonces[i+1:]...)
+			break
+		}
+	}
+	return sent, true
+}
+
+func (p *pendingNonces) remove(name string) {
+	for _, s := range p.sent {
+		delete(s, name)
+	}
+}
+
+// DeltaSecrets implements the gRPC SecretDiscoveryService service and returns
+// an incremental stream of TLS certificates. Only the resources that have been
+// added or modified are sent to the client.
+func (srv *Service) DeltaSecrets(sds secret.SecretDiscoveryService_DeltaSecretsServer) (err error) {
+	ctx, span := startServerSpan(sds.Context(), "sds.DeltaSecrets")
+	defer func() {
+		endSpan(span, err)
+	}()
+	errCh := make(chan error)
+	reqCh := make(chan *discovery.DeltaDiscoveryRequest)
+
+	// Sends also wait for the stream context, as in StreamSecrets.
+	go func() {
+		var node *core.Node
+		for {
+			r, err := sds.Recv()
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+			// Requests for other types can be sent using ADS, they are
+			// expected and ignored
+			if !isSecretTypeURL(r.TypeUrl) {
+				logging.GetRequestEntry(ctx).WithField("typeUrl", r.TypeUrl).Debug("Ignored request for unsupported type url")
+				continue
+			}
+			// The node is usually sent only in the first request
+			if r.Node == nil {
+				r.Node = node
+			} else {
+				node = r.Node
+			}
+			if err := srv.validateRequest(ctx, &discovery.DiscoveryRequest{
+				Node:          r.Node,
+				ResourceNames: r.ResourceNamesSubscribe,
+				TypeUrl:       r.TypeUrl,
+			}); err != nil {
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case reqCh <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// resources contains the state of each subscribed resource, and pending
+	// the resources and versions sent on each nonce that are waiting for an
+	// ACK or NACK.
+	resources := make(map[string]*deltaResource)
+	pending := newPendingNonces()
+	backoff := new(nackBackoff)
+	defer backoff.Stop()
+	var rejected []string
+	// The node is usually sent only in the first request
+	var node *core.Node
+	sub := newSubscriber()
+	subscription := newSubscription(srv.cache, sub, func(name string) (*secretRequest, error) {
+		return srv.newSecretRequest(name, node)
+	})
+	defer subscription.Close()
+	stream := newStreamMetric("delta")
+	defer stream.Close()
+	active := srv.streams.Add(ctx, "delta")
+	defer srv.streams.Remove(active)
+
+	var req *discovery.DeltaDiscoveryRequest
+	for {
+		var t1 time.Time
+		var names, removed []string
+		var initialVersions map[string]string
+		var isRenewal, isRetry, useAcked bool
+
+		select {
+		case r := <-reqCh:
+			t1 = time.Now()
+			switch {
+			case r.ResponseNonce != "" && r.ErrorDetail != nil:
+				stream.Request("nack", r.Node)
+			case r.ResponseNonce != "":
+				stream.Request("ack", r.Node)
+			case req == nil:
+				stream.Request("initial", r.Node)
+			default:
+				stream.Request("update", r.Node)
+			}
+			req = r
+			if r.Node != nil {
+				node = r.Node
+				setNodeAttributes(span, node)
+				active.SetNode(node)
+			}
+
+			// ACK or NACK of a previous response
+			if r.ResponseNonce != "" {
+				sent, ok := pending.Take(r.ResponseNonce)
+				switch {
+				case !ok:
+					srv.logDeltaRequest(ctx, r, "Invalid responseNonce", t1, fmt.Errorf("invalid responseNonce"))
+				case r.ErrorDetail != nil:
+					rejected = rejected[:0]
+					for name := range sent {
+						rejected = append(rejected, name)
+					}
+					sort.Strings(rejected)
+					if d, ok := backoff.NACK(); ok {
+						srv.logDeltaRequest(ctx, r, "NACK", t1, nil, logging.Fields{
+							"retry":       backoff.Attempts(),
+							"retry.after": d.String(),
+						})
+					} else {
+						srv.logDeltaRequest(ctx, r, "NACK", t1, nil)
+					}
+				default:
+					backoff.Reset()
+					for name, version := range sent {
+						if res, ok := resources[name]; ok && res.version == version {
+							res.acked, res.ackedValue = version, res.value
+						}
+					}
+					srv.logDeltaRequest(ctx, r, "ACK", t1, nil)
+				}
+			}
+
+			// Subscription changes
+			initialVersions = r.InitialResourceVersions
+			added, err := subscription.Subscribe(ctx, r.ResourceNamesSubscribe)
+			if err != nil {
+				srv.logDeltaRequest(ctx, r, "Error getting secrets", t1, err)
+				return err
+			}
+			for _, name := range added {
+				resources[name] = &deltaResource{entry: subscription.Entry(name)}
+			}
+			names = added
+			removed = subscription.Unsubscribe(r.ResourceNamesUnsubscribe)
+			for _, name := range removed {
+				delete(resources, name)
+			}
+			pending.Remove(removed)
+			if len(added) > 0 || len(removed) > 0 {
+				active.SetResourceNames(subscription.Names())
+			}
+		case <-sub.C():
+			t1 = time.Now()
+			for _, name := range sub.Renewed() {
+				if subscription.Has(name) {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			isRenewal = true
+		case <-backoff.C():
+			t1 = time.Now()
+			isRetry = true
+			useAcked = backoff.Retry()
+			// Force the resources rejected to be sent again
+			for _, name := range rejected {
+				if res, ok := resources[name]; ok {
+					res.version = ""
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+		case err := <-errCh:
+			t1 = time.Now()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			srv.logDeltaRequest(ctx, nil, "Recv failed", t1, err)
+			return err
+		case <-srv.stopCh:
+			return nil
+		case <-active.Done():
+			return errStreamClosed
+		}
+
+		// Send the resources that have changed
+		dr, sent, expired, err := getDeltaDiscoveryResponse(resources, names, removed, initialVersions, useAcked)
+		if err != nil {
+			srv.logDeltaRequest(ctx, req, "Creation of DeltaDiscoveryResponse failed", t1, err)
+			return err
+		}
+		if len(expired) > 0 {
+			srv.logDeltaRequest(ctx, req, "Expired certificates removed", t1, fmt.Errorf("certificates for %s have expired", strings.Join(expired, ", ")))
+		}
+		if len(dr.Resources) == 0 && len(dr.RemovedResources) == 0 {
+			continue
+		}
+		if isRenewal {
+			backoff.Reset()
+		}
+		dr.SystemVersionInfo = getDeltaVersionInfo(dr.Resources)
+		if err := sds.Send(dr); err != nil {
+			srv.logDeltaRequest(ctx, req, "Send failed", t1, err)
+			return err
+		}
+
+		pending.Add(dr.Nonce, sent)
+		extra := logging.Fields{
+			"nonce":            dr.Nonce,
+			"sentResources":    sent,
+			"removedResources": dr.RemovedResources,
+		}
+		switch {
+		case useAcked:
+			srv.logDeltaRequest(ctx, req, "Acknowledged secrets sent", t1, nil, extra)
+		case isRetry:
+			extra["retry"] = backoff.Attempts()
+			srv.logDeltaRequest(ctx, req, "Secrets sent again", t1, nil, extra)
+		case isRenewal:
+			srv.logDeltaRequest(ctx, req, "Certificate renewed", t1, nil, extra)
+		case len(dr.Resources) > 0:
+			srv.logDeltaRequest(ctx, req, "Secrets sent", t1, nil, extra)
+		default:
+			srv.logDeltaRequest(ctx, req, "Secrets removed", t1, nil, extra)
+		}
+	}
+}
+
+// getDeltaDiscoveryResponse returns the api.DeltaDiscoveryResponse with the
+// given resource names, if the version of a resource has not changed it will
+// be skipped. If useAcked is true, the last version acknowledged by the client
+// will be used if available. Certificates that have expired are never sent,
+// they are added to the removed resources and sent again when they are
+// renewed. It also returns a map with the name and versions of the resources
+// in the response, and the names of the expired certificates.
+func getDeltaDiscoveryResponse(resources map[string]*deltaResource, names, removed []string, initialVersions map[string]string, useAcked bool) (*discovery.DeltaDiscoveryResponse, map[string]string, []string, error) {
+	nonce, err := randutil.Hex(64)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	sent := make(map[string]string)
+	removed = append([]string(nil), removed...)
+	var expired []string
+	var list []*discovery.Resource
+	for _, name := range names {
+		res := resources[name]
+		b := res.ackedValue
+		if !useAcked || b == nil {
+			secs := res.entry.Secrets()
+			if !isValidationContext(name) && len(secs.Certificates) > 0 && certificateExpired(secs.Certificates[0]) {
+				res.version, res.value = "", nil
+				expired = append(expired, name)
+				removed = append(removed, name)
+				continue
+			}
+			if b, err = getSecret(name, secs); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		version := resourceVersion(b)
+		switch {
+		case version == res.version:
+			continue
+		case version == initialVersions[name]:
+			// The client already has this version
+			res.version, res.value = version, b
+			res.acked, res.ackedValue = version, b
+			continue
+		}
+		res.version, res.value = version, b
+		sent[name] = version
+		list = append(list, &discovery.Resource{
+			Name:    name,
+			Version: version,
+			Resource: &anypb.Any{
+				TypeUrl: secretTypeURL,
+				Value:   b,
+			},
+		})
+	}
+
+	return &discovery.DeltaDiscoveryResponse{
+		Resources:        list,
+		TypeUrl:          secretTypeURL,
+		RemovedResources: removed,
+		Nonce:            nonce,
+		ControlPlane: &core.ControlPlane{
+			Identifier: Identifier,
+		},
+	}, sent, expired, nil
+}
+
+// getDeltaVersionInfo returns the version of an incremental response based on
+// the content of its resources.
+func getDeltaVersionInfo(resources []*discovery.Resource) string {
+	list := make([]*anypb.Any, len(resources))
+	for i, r := range resources {
+		list[i] = r.Resource
+	}
+	return getVersionInfo(list)
+}
+
+func (srv *Service) logDeltaRequest(ctx context.Context, r *discovery.DeltaDiscoveryRequest, msg string, start time.Time, err error, extra ...logging.Fields) {
+	var fields logging.Fields
+	if r != nil {
+		fields = logging.Fields{
+			"resourceNamesSubscribe":   r.ResourceNamesSubscribe,
+			"resourceNamesUnsubscribe": r.ResourceNamesUnsubscribe,
+			"responseNonce":            r.ResponseNonce,
+		}
+		if len(r.InitialResourceVersions) > 0 {
+			fields["initialResourceVersions"] = r.InitialResourceVersions
+		}
+		if r.Node != nil {
+			fields["node"] = r.Node.Id
+			fields["cluster"] = r.Node.Cluster
+		}
+		if r.ErrorDetail != nil {
+			fields["code"] = r.ErrorDetail.Code
+			fields[logging.ErrorKey] = r.ErrorDetail.Message
+		}
+	}
+	srv.logEntry(ctx, fields, msg, start, err, extra...)
+}
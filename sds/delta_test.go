@@ -0,0 +1,513 @@
+package sds
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/step-sds/logging"
+	rpc "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestService_DeltaSecrets(t *testing.T) {
+	ca := caServer(3 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	recv := func(t *testing.T, stream secret.SecretDiscoveryService_DeltaSecretsClient) (*discovery.DeltaDiscoveryResponse, map[string]*discovery.Resource) {
+		t.Helper()
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, secretTypeURL, got.TypeUrl)
+		assert.Len(t, 64, got.Nonce)
+		assert.Equals(t, &core.ControlPlane{Identifier: Identifier}, got.ControlPlane)
+		resources := make(map[string]*discovery.Resource)
+		for _, r := range got.Resources {
+			assert.True(t, r.Version != "")
+			assert.Equals(t, secretTypeURL, r.Resource.TypeUrl)
+			var sec auth.Secret
+			assert.FatalError(t, proto.Unmarshal(r.Resource.Value, &sec))
+			assert.Equals(t, r.Name, sec.Name)
+			if isValidationContext(sec.Name) {
+				assert.Type(t, &auth.Secret_ValidationContext{}, sec.Type)
+			} else {
+				assert.Type(t, &auth.Secret_TlsCertificate{}, sec.Type)
+			}
+			resources[r.Name] = r
+		}
+		return got, resources
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		stream, err := client.DeltaSecrets(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResourceNamesSubscribe: []string{"foo.smallstep.com", "trusted_ca"},
+		}))
+		got, resources := recv(t, stream)
+		assert.Len(t, 2, resources)
+		assert.NotNil(t, resources["foo.smallstep.com"])
+		assert.NotNil(t, resources["trusted_ca"])
+		trustedCA := resources["trusted_ca"].Version
+		version := resources["foo.smallstep.com"].Version
+
+		// ACK and subscribe to a new resource
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResponseNonce:          got.Nonce,
+			ResourceNamesSubscribe: []string{"bar.smallstep.com"},
+		}))
+		got, resources = recv(t, stream)
+		assert.Len(t, 1, resources)
+		assert.NotNil(t, resources["bar.smallstep.com"])
+
+		// NACK and unsubscribe
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                     node,
+			TypeUrl:                  secretTypeURL,
+			ResponseNonce:            got.Nonce,
+			ErrorDetail:              &rpc.Status{Code: 123, Message: "an error"},
+			ResourceNamesUnsubscribe: []string{"bar.smallstep.com", "trusted_ca"},
+		}))
+		got, resources = recv(t, stream)
+		assert.Len(t, 0, resources)
+		assert.Equals(t, []string{"bar.smallstep.com", "trusted_ca"}, got.RemovedResources)
+
+		// Renewals only contain the renewed resource
+		for i := 0; i < 3; i++ {
+			got, resources = recv(t, stream)
+			assert.Len(t, 1, resources)
+			assert.Len(t, 0, got.RemovedResources)
+			assert.NotNil(t, resources["foo.smallstep.com"])
+			assert.NotEquals(t, version, resources["foo.smallstep.com"].Version)
+			version = resources["foo.smallstep.com"].Version
+			assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+				Node:          node,
+				TypeUrl:       secretTypeURL,
+				ResponseNonce: got.Nonce,
+			}))
+		}
+
+		// Reconnect with an unknown version and a known one
+		stream2, err := client.DeltaSecrets(context.Background())
+		assert.FatalError(t, err)
+		defer stream2.CloseSend()
+		assert.FatalError(t, stream2.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResourceNamesSubscribe: []string{"foo.smallstep.com", "trusted_ca"},
+			InitialResourceVersions: map[string]string{
+				"foo.smallstep.com": "unknown",
+				"trusted_ca":        trustedCA,
+			},
+		}))
+		_, resources = recv(t, stream2)
+		assert.Len(t, 1, resources)
+		assert.NotNil(t, resources["foo.smallstep.com"])
+	})
+
+	t.Run("ok ignore type url", func(t *testing.T) {
+		stream, err := client.DeltaSecrets(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+			ResourceNamesSubscribe: []string{"foo.smallstep.com"},
+		}))
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResourceNamesSubscribe: []string{"trusted_ca"},
+		}))
+		_, resources := recv(t, stream)
+		assert.Len(t, 1, resources)
+		assert.NotNil(t, resources["trusted_ca"])
+	})
+}
+
+func TestService_DeltaSecrets_nack(t *testing.T) {
+	ca := caServer(3 * time.Second)
+	defer ca.Close()
+
+	tmpInterval, tmpRetries := NACKRetryInterval, NACKMaxRetries
+	t.Cleanup(func() {
+		NACKRetryInterval, NACKMaxRetries = tmpInterval, tmpRetries
+	})
+	NACKRetryInterval, NACKMaxRetries = 10*time.Millisecond, 1
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	stream, err := client.DeltaSecrets(context.Background())
+	assert.FatalError(t, err)
+	defer stream.CloseSend()
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	recv := func() (*discovery.DeltaDiscoveryResponse, *discovery.Resource) {
+		t.Helper()
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Len(t, 1, got.Resources)
+		assert.Equals(t, "foo.smallstep.com", got.Resources[0].Name)
+		assert.Equals(t, getDeltaVersionInfo(got.Resources), got.SystemVersionInfo)
+		return got, got.Resources[0]
+	}
+	send := func(got *discovery.DeltaDiscoveryResponse, nack bool) {
+		t.Helper()
+		r := &discovery.DeltaDiscoveryRequest{
+			Node:          node,
+			TypeUrl:       secretTypeURL,
+			ResponseNonce: got.Nonce,
+		}
+		if nack {
+			r.ErrorDetail = &rpc.Status{Code: 123, Message: "an error"}
+		}
+		assert.FatalError(t, stream.Send(r))
+	}
+
+	// Initial request and ACK
+	assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+		Node:                   node,
+		TypeUrl:                secretTypeURL,
+		ResourceNamesSubscribe: []string{"foo.smallstep.com"},
+	}))
+	got, acked := recv()
+	send(got, false)
+
+	// Renewal is rejected and sent again
+	got, renewed := recv()
+	assert.NotEquals(t, acked.Version, renewed.Version)
+	send(got, true)
+	got, res := recv()
+	assert.Equals(t, renewed.Version, res.Version)
+	send(got, true)
+
+	// Fall back to the acknowledged version
+	got, res = recv()
+	assert.Equals(t, acked.Version, res.Version)
+	assert.True(t, proto.Equal(acked.Resource, res.Resource))
+	send(got, true)
+
+	// The next response is a new renewal
+	_, res = recv()
+	assert.NotEquals(t, acked.Version, res.Version)
+	assert.NotEquals(t, renewed.Version, res.Version)
+}
+
+func TestService_DeltaSecrets_nonces(t *testing.T) {
+	ca := caServer(3 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	var buf bytes.Buffer
+	logger, err := logging.New("step-sds", []byte(`{"format": "json"}`))
+	assert.FatalError(t, err)
+	logger.SetOutput(&buf)
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer(grpc.StreamInterceptor(logging.StreamServerInterceptor(logger)))
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	stream, err := client.DeltaSecrets(context.Background())
+	assert.FatalError(t, err)
+	defer stream.CloseSend()
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	recv := func() *discovery.DeltaDiscoveryResponse {
+		t.Helper()
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		return got
+	}
+	ack := func(nonce string) {
+		t.Helper()
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:          node,
+			TypeUrl:       secretTypeURL,
+			ResponseNonce: nonce,
+		}))
+	}
+
+	assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+		Node:                   node,
+		TypeUrl:                secretTypeURL,
+		ResourceNamesSubscribe: []string{"foo.smallstep.com", "trusted_ca"},
+	}))
+	initial := recv()
+	assert.Len(t, 2, initial.Resources)
+
+	// Removal only response acknowledged after a renewal
+	assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+		Node:                     node,
+		TypeUrl:                  secretTypeURL,
+		ResponseNonce:            initial.Nonce,
+		ResourceNamesUnsubscribe: []string{"trusted_ca"},
+	}))
+	removal := recv()
+	assert.Len(t, 0, removal.Resources)
+	assert.Equals(t, []string{"trusted_ca"}, removal.RemovedResources)
+	renewal1 := recv()
+	assert.Len(t, 1, renewal1.Resources)
+	ack(removal.Nonce)
+
+	// Two responses for the same resource before the first ACK
+	renewal2 := recv()
+	assert.Len(t, 1, renewal2.Resources)
+	assert.Equals(t, "foo.smallstep.com", renewal2.Resources[0].Name)
+	ack(renewal1.Nonce)
+	ack(renewal2.Nonce)
+
+	// Nonces never sent are still invalid
+	ack("unknown")
+
+	// Wait for the previous requests to be processed
+	assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+		Node:                   node,
+		TypeUrl:                secretTypeURL,
+		ResourceNamesSubscribe: []string{"trusted_ca"},
+	}))
+	for {
+		if got := recv(); len(got.Resources) == 1 && got.Resources[0].Name == "trusted_ca" {
+			break
+		}
+	}
+	assert.FatalError(t, stream.CloseSend())
+	s.GracefulStop()
+
+	logs := buf.String()
+	assert.Equals(t, 1, strings.Count(logs, `"level":"error"`), logs)
+	assert.Equals(t, 1, strings.Count(logs, `"msg":"Invalid responseNonce"`), logs)
+}
+
+func Test_getDeltaDiscoveryResponse(t *testing.T) {
+	roots := rootCAs(t)
+	certs := tlsCerts(t)
+
+	cert, err := getCertificateChain("foo.smallstep.com", certs[0])
+	assert.FatalError(t, err)
+	trustedCA, err := getTrustedCA("trusted_ca", roots)
+	assert.FatalError(t, err)
+
+	newResources := func() map[string]*deltaResource {
+		return map[string]*deltaResource{
+			"foo.smallstep.com": {entry: &cacheEntry{renewer: &secretRenewer{roots: roots, certificates: certs}}},
+			"trusted_ca":        {entry: &cacheEntry{renewer: &secretRenewer{roots: roots}}},
+		}
+	}
+	expiredResources := func() map[string]*deltaResource {
+		resources := newResources()
+		resources["bar.smallstep.com"] = &deltaResource{entry: &cacheEntry{renewer: &secretRenewer{
+			roots: roots, certificates: []*tls.Certificate{storeCertificate(t, "bar.smallstep.com", -time.Minute)},
+		}}}
+		return resources
+	}
+
+	type args struct {
+		resources       map[string]*deltaResource
+		names           []string
+		removed         []string
+		initialVersions map[string]string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		want        map[string][]byte
+		wantRemoved []string
+		wantExpired []string
+		wantErr     bool
+	}{
+		{"ok", args{newResources(), []string{"foo.smallstep.com", "trusted_ca"}, nil, nil}, map[string][]byte{
+			"foo.smallstep.com": cert, "trusted_ca": trustedCA,
+		}, nil, nil, false},
+		{"ok removed", args{newResources(), nil, []string{"bar.smallstep.com"}, nil}, map[string][]byte{}, []string{"bar.smallstep.com"}, nil, false},
+		{"ok initial versions", args{newResources(), []string{"foo.smallstep.com", "trusted_ca"}, nil, map[string]string{
+			"trusted_ca": resourceVersion(trustedCA),
+		}}, map[string][]byte{
+			"foo.smallstep.com": cert,
+		}, nil, nil, false},
+		{"ok expired", args{expiredResources(), []string{"foo.smallstep.com", "bar.smallstep.com"}, []string{"zar.smallstep.com"}, nil}, map[string][]byte{
+			"foo.smallstep.com": cert,
+		}, []string{"zar.smallstep.com", "bar.smallstep.com"}, []string{"bar.smallstep.com"}, false},
+		{"fail missing certificate", args{map[string]*deltaResource{
+			"foo.smallstep.com": {entry: &cacheEntry{renewer: &secretRenewer{roots: roots}}},
+		}, []string{"foo.smallstep.com"}, nil, nil}, nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, sent, expired, err := getDeltaDiscoveryResponse(tt.args.resources, tt.args.names, tt.args.removed, tt.args.initialVersions, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getDeltaDiscoveryResponse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			assert.Len(t, len(tt.want), got.Resources)
+			assert.Len(t, len(tt.want), sent)
+			assert.Equals(t, tt.wantRemoved, got.RemovedResources)
+			assert.Equals(t, tt.wantExpired, expired)
+			for _, r := range got.Resources {
+				assert.Equals(t, tt.want[r.Name], r.Resource.Value)
+				assert.Equals(t, resourceVersion(tt.want[r.Name]), r.Version)
+				assert.Equals(t, r.Version, sent[r.Name])
+				assert.Equals(t, r.Version, tt.args.resources[r.Name].version)
+			}
+
+			// A second response with the same resources is empty
+			got, _, _, err = getDeltaDiscoveryResponse(tt.args.resources, tt.args.names, nil, nil, false)
+			assert.FatalError(t, err)
+			assert.Len(t, 0, got.Resources)
+		})
+	}
+}
+
+func Test_pendingNonces(t *testing.T) {
+	p := newPendingNonces()
+	p.Add("nonce-1", map[string]string{"foo.smallstep.com": "v1", "trusted_ca": "v1"})
+	p.Add("nonce-2", map[string]string{})
+	p.Add("nonce-3", map[string]string{"foo.smallstep.com": "v2"})
+	assert.Equals(t, map[string]map[string]string{
+		"nonce-1": {"trusted_ca": "v1"},
+		"nonce-2": {},
+		"nonce-3": {"foo.smallstep.com": "v2"},
+	}, p.sent)
+
+	// Superseded and removal only nonces can be acknowledged
+	sent, ok := p.Take("nonce-2")
+	assert.True(t, ok)
+	assert.Len(t, 0, sent)
+	_, ok = p.Take("nonce-2")
+	assert.False(t, ok)
+	_, ok = p.Take("unknown")
+	assert.False(t, ok)
+
+	// Nonces that are never answered are forgotten
+	for i := 4; i < 4+maxPendingNonces; i++ {
+		p.Add(fmt.Sprintf("nonce-%d", i), map[string]string{"foo.smallstep.com": fmt.Sprintf("v%d", i)})
+	}
+	assert.Len(t, maxPendingNonces, p.nonces)
+	assert.Len(t, maxPendingNonces, p.sent)
+	_, ok = p.Take("nonce-3")
+	assert.False(t, ok)
+
+	last := fmt.Sprintf("nonce-%d", 3+maxPendingNonces)
+	p.Remove([]string{"foo.smallstep.com"})
+	sent, ok = p.Take(last)
+	assert.True(t, ok)
+	assert.Len(t, 0, sent)
+	assert.Len(t, maxPendingNonces-1, p.nonces)
+}
@@ -0,0 +1,274 @@
+package sds
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthCheckInterval is the interval used to check that the CA is reachable
+// and that the pre-configured secrets are ready.
+var HealthCheckInterval = 10 * time.Second
+
+// HealthCheckTimeout is the timeout of the requests to the CA health endpoint.
+var HealthCheckTimeout = 5 * time.Second
+
+// CAOutageTimeout is the time that the CA can be unreachable before the
+// service reports NOT_SERVING. Secrets already signed are still renewed when
+// the CA is back.
+var CAOutageTimeout = 5 * time.Minute
+
+// CAHealthService is the name of the service in the gRPC health service that
+// reports the status of the CAs. It is NOT_SERVING while the service is
+// degraded, because a provisioner is not initialized or its CA is not
+// reachable. In degraded mode, the secrets already signed or stored in the
+// state directory are still served.
+const CAHealthService = "step-sds.CA"
+
+// healthChecker keeps the status of the gRPC health service. The service is
+// SERVING once all the CAs have been reachable and the pre-configured secrets
+// are signed, and it goes back to NOT_SERVING if the CAs are unreachable for
+// more than CAOutageTimeout or when the service is stopped. The status of the
+// CAs is reported independently as CAHealthService.
+type healthChecker struct {
+	m         sync.Mutex
+	server    *health.Server
+	serving   bool
+	caOK      bool
+	degraded  bool
+	warmed    map[string]bool
+	warmedAll bool
+	lastOK    time.Time
+	lastErr   string
+	stopped   bool
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+}
+
+// healthServices are the services reported by the health service, the empty
+// name is the status of the whole server.
+var healthServices = []string{
+	"",
+	secret.SecretDiscoveryService_ServiceDesc.ServiceName,
+	discovery.AggregatedDiscoveryService_ServiceDesc.ServiceName,
+}
+
+func newHealthChecker() *healthChecker {
+	h := &healthChecker{
+		server: health.NewServer(),
+		warmed: make(map[string]bool),
+		stopCh: make(chan struct{}),
+	}
+	h.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+	h.server.SetServingStatus(CAHealthService, healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+func (h *healthChecker) setServingStatus(st healthpb.HealthCheckResponse_ServingStatus) {
+	for _, name := range healthServices {
+		h.server.SetServingStatus(name, st)
+	}
+}
+
+// StartHealthCheck starts the process that updates the status of the gRPC
+// health service. The first check runs immediately.
+func (srv *Service) StartHealthCheck() {
+	go func() {
+		ticker := time.NewTicker(HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			srv.checkHealth()
+			select {
+			case <-ticker.C:
+			case <-srv.health.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// SetNotServing sets the health service as NOT_SERVING for the rest of the
+// life of the process, it is used to drain the clients before a graceful stop.
+func (srv *Service) SetNotServing() {
+	srv.health.stopOnce.Do(func() {
+		srv.health.m.Lock()
+		srv.health.stopped = true
+		srv.health.m.Unlock()
+		close(srv.health.stopCh)
+		srv.health.server.Shutdown()
+	})
+}
+
+// checkHealth checks that the CAs are reachable and signs the pre-configured
+// secrets that are not ready yet, and updates the status of the health
+// service.
+func (srv *Service) checkHealth() {
+	sc := srv.getConfig()
+	err := checkCAs(sc)
+	caOK := err == nil
+	if caOK {
+		err = srv.warmSecrets(sc)
+	}
+
+	h := srv.health
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.stopped {
+		return
+	}
+
+	// Secrets are only signed if the CA is reachable
+	now := time.Now()
+	if caOK {
+		h.lastOK = now
+		h.warmedAll = err == nil
+	}
+	srv.setCAStatus(caOK, err)
+	serving := h.warmedAll && now.Sub(h.lastOK) <= CAOutageTimeout
+
+	// Errors are logged only when they change
+	switch {
+	case err != nil && err.Error() != h.lastErr:
+		srv.logger.WithError(err).Warn("Health check failed")
+		h.lastErr = err.Error()
+	case err == nil:
+		h.lastErr = ""
+	}
+
+	if serving == h.serving {
+		return
+	}
+	h.serving = serving
+	if serving {
+		h.setServingStatus(healthpb.HealthCheckResponse_SERVING)
+		srv.logger.Info("Health status changed to SERVING")
+	} else {
+		h.setServingStatus(healthpb.HealthCheckResponse_NOT_SERVING)
+		srv.logger.Warn("Health status changed to NOT_SERVING")
+	}
+}
+
+// setCAStatus updates the status of CAHealthService. Leaving and entering the
+// degraded mode is logged. It must be called with the health lock held.
+func (srv *Service) setCAStatus(caOK bool, err error) {
+	h := srv.health
+	switch {
+	case caOK && !h.caOK:
+		h.server.SetServingStatus(CAHealthService, healthpb.HealthCheckResponse_SERVING)
+		if h.degraded {
+			srv.logger.Info("CA is reachable, leaving degraded mode")
+		}
+	case !caOK && (h.caOK || !h.degraded):
+		h.server.SetServingStatus(CAHealthService, healthpb.HealthCheckResponse_NOT_SERVING)
+		srv.logger.WithError(err).Warn("CA is not reachable, running in degraded mode")
+	}
+	h.caOK, h.degraded = caOK, !caOK
+}
+
+// checkCAs checks that the provisioners are initialized and the health
+// endpoint of the CA of each of them.
+func checkCAs(sc *serviceConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HealthCheckTimeout)
+	defer cancel()
+	for name, p := range sc.provisioners {
+		if name == "" {
+			name = p.Name()
+		}
+		cp, err := p.Get()
+		if err != nil {
+			return errors.Errorf("provisioner %s is not initialized: %v", name, p.Err())
+		}
+		start := time.Now()
+		_, err = cp.HealthWithContext(ctx)
+		observeCA("health", start, err)
+		if err != nil {
+			return errors.Wrapf(err, "error checking health of provisioner %s", name)
+		}
+	}
+	return nil
+}
+
+// warmSecrets signs the certificates of the resources configured with a
+// literal name and without templates. The secrets are kept in the cache, and
+// renewed, while their profile does not change. The secrets of the profiles
+// changed or removed are released.
+func (srv *Service) warmSecrets(sc *serviceConfig) error {
+	reqs, err := staticRequests(sc)
+	if err != nil {
+		return err
+	}
+	srv.releaseWarmed(reqs)
+	for _, req := range reqs {
+		key := req.Key()
+		srv.health.m.Lock()
+		_, ok := srv.health.warmed[key]
+		srv.health.m.Unlock()
+		if ok {
+			continue
+		}
+		if _, err := srv.cache.Acquire(context.Background(), req, nil); err != nil {
+			return errors.Wrapf(err, "error signing %s", req.Name)
+		}
+		srv.health.m.Lock()
+		srv.health.warmed[key] = true
+		srv.health.m.Unlock()
+	}
+	return nil
+}
+
+// releaseWarmed releases the secrets signed by warmSecrets that are not in the
+// given requests, they are removed from the cache once no stream uses them.
+func (srv *Service) releaseWarmed(reqs []*secretRequest) {
+	keep := make(map[string]bool, len(reqs))
+	for _, req := range reqs {
+		keep[req.Key()] = true
+	}
+	srv.health.m.Lock()
+	defer srv.health.m.Unlock()
+	for key := range srv.health.warmed {
+		if !keep[key] {
+			delete(srv.health.warmed, key)
+			srv.cache.Release(key, nil)
+		}
+	}
+}
+
+// staticRequests returns the secret requests of the static profiles in the
+// given settings.
+func staticRequests(sc *serviceConfig) ([]*secretRequest, error) {
+	var reqs []*secretRequest
+	for _, p := range sc.profiles {
+		if !p.isStatic() {
+			continue
+		}
+		req, err := newSecretRequest(p.Name, nil, sc.profiles)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// isStatic returns if the profile is for a single resource name and it does
+// not use templates, so its secret can be signed before it is requested.
+func (p *resourceProfile) isStatic() bool {
+	if strings.ContainsAny(p.Name, `*?[\`) || isTemplate(p.CommonName) {
+		return false
+	}
+	for _, list := range [][]string{p.DNSNames, p.IPAddresses, p.URIs} {
+		for _, s := range list {
+			if isTemplate(s) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestService_health(t *testing.T) {
+	tmp := CAOutageTimeout
+	t.Cleanup(func() {
+		CAOutageTimeout = tmp
+	})
+
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Resources: []ResourceConfig{
+			{Name: "static.smallstep.com", KeyType: "P-384"},
+			{Name: "*.smallstep.com"},
+			{Name: "node.internal", CommonName: "{{.Node.Id}}"},
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+	defer s.Stop()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.FatalError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		assert.FatalError(t, err)
+		return resp.Status
+	}
+
+	// Not serving until the first check
+	for _, name := range healthServices {
+		assert.Equals(t, healthpb.HealthCheckResponse_NOT_SERVING, check(name))
+	}
+
+	// The CA is reachable and the static resources are signed
+	srv.checkHealth()
+	for _, name := range healthServices {
+		assert.Equals(t, healthpb.HealthCheckResponse_SERVING, check(name))
+	}
+	srv.cache.m.Lock()
+	assert.Len(t, 1, srv.cache.entries)
+	for _, e := range srv.cache.entries {
+		assert.Equals(t, "static.smallstep.com", e.name)
+		assert.Equals(t, 1, e.refs)
+	}
+	srv.cache.m.Unlock()
+
+	// Short CA outages keep serving
+	ca.Close()
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_SERVING, check(""))
+
+	// Long CA outages do not
+	CAOutageTimeout = 0
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+
+	// Not serving after the service is stopped
+	CAOutageTimeout = tmp
+	srv.health.lastOK = time.Now()
+	srv.SetNotServing()
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	srv.SetNotServing()
+}
+
+func TestService_StartHealthCheck(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+
+	srv.StartHealthCheck()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := srv.health.server.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.FatalError(t, err)
+		if resp.Status == healthpb.HealthCheckResponse_SERVING {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for health check")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.FatalError(t, srv.Stop())
+	resp, err := srv.health.server.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.FatalError(t, err)
+	assert.Equals(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+}
+
+func Test_resourceProfile_isStatic(t *testing.T) {
+	tests := []struct {
+		name string
+		r    ResourceConfig
+		want bool
+	}{
+		{"ok", ResourceConfig{Name: "foo.smallstep.com", DNSNames: []string{"bar.smallstep.com"}}, true},
+		{"pattern", ResourceConfig{Name: "*.smallstep.com"}, false},
+		{"class", ResourceConfig{Name: "foo[0-9].smallstep.com"}, false},
+		{"common name template", ResourceConfig{Name: "foo", CommonName: "{{.Node.Id}}"}, false},
+		{"uri template", ResourceConfig{Name: "foo", URIs: []string{"spiffe://prod/{{.Node.Cluster}}"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &resourceProfile{ResourceConfig: tt.r}
+			assert.Equals(t, tt.want, p.isStatic())
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package sds
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// regexpPrefix is the prefix used in the authorized identities that are
+// regular expressions, e.g. "regexp:spiffe://prod/ns/[a-z]+/sa/envoy".
+const regexpPrefix = "regexp:"
+
+// identityMatcher matches the identities of a client certificate against a
+// list of names, glob patterns and regular expressions.
+type identityMatcher struct {
+	patterns []string
+	regexps  []*regexp.Regexp
+}
+
+// newIdentityMatcher parses the given authorized identities. Names and glob
+// patterns are case insensitive, regular expressions must match the whole
+// identity. Regular expressions are required to match identities with any
+// number of segments, a "*" in a glob pattern does not match "/".
+func newIdentityMatcher(identities []string) (*identityMatcher, error) {
+	m := new(identityMatcher)
+	for _, s := range identities {
+		switch {
+		case s == "":
+			return nil, errors.New("authorizedIdentities cannot contain empty values")
+		case strings.HasPrefix(s, regexpPrefix):
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(s, regexpPrefix) + ")$")
+			if err != nil {
+				return nil, errors.Wrapf(err, "authorizedIdentities %s is not a valid regular expression", s)
+			}
+			m.regexps = append(m.regexps, re)
+		default:
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, errors.Errorf("authorizedIdentities %s is not a valid pattern", s)
+			}
+			m.patterns = append(m.patterns, strings.ToLower(s))
+		}
+	}
+	return m, nil
+}
+
+// Empty returns if the matcher does not contain any identity.
+func (m *identityMatcher) Empty() bool {
+	return m == nil || len(m.patterns)+len(m.regexps) == 0
+}
+
+// Match returns if any of the given identities is authorized.
+func (m *identityMatcher) Match(identities []string) bool {
+	for _, id := range identities {
+		if matchAny(m.patterns, strings.ToLower(id)) {
+			return true
+		}
+		for _, re := range m.regexps {
+			if re.MatchString(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certificateIdentities returns the identities in a client certificate: the
+// common name, the DNS SANs and the URI SANs, including SPIFFE IDs.
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	return identities
+}
+
+// validateFingerprints validates that the given fingerprints are hex encoded.
+func validateFingerprints(fingerprints []string) error {
+	for _, s := range fingerprints {
+		if b, err := hex.DecodeString(s); err != nil || len(b) == 0 {
+			return errors.Errorf("authorizedFingerprints %s is not a valid fingerprint", s)
+		}
+	}
+	return nil
+}
+
+// matchFingerprint returns if the fingerprint is in the given list.
+func matchFingerprint(fingerprints []string, fp string) bool {
+	for _, s := range fingerprints {
+		if strings.EqualFold(s, fp) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package sds
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func Test_newIdentityMatcher(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities []string
+		wantEmpty  bool
+		wantErr    bool
+	}{
+		{"ok nil", nil, true, false},
+		{"ok names", []string{"envoy.smallstep.com", "spiffe://prod/envoy"}, false, false},
+		{"ok patterns", []string{"*.smallstep.com", "spiffe://prod/ns/*/sa/envoy"}, false, false},
+		{"ok regexp", []string{"regexp:spiffe://prod/ns/[a-z-]+/sa/envoy"}, false, false},
+		{"fail empty", []string{""}, false, true},
+		{"fail pattern", []string{"[envoy"}, false, true},
+		{"fail regexp", []string{"regexp:[envoy"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newIdentityMatcher(tt.identities)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newIdentityMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				assert.Equals(t, tt.wantEmpty, got.Empty())
+			}
+		})
+	}
+}
+
+func Test_identityMatcher_Match(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorized []string
+		identities []string
+		want       bool
+	}{
+		{"ok name", []string{"envoy.smallstep.com"}, []string{"Envoy.Smallstep.com"}, true},
+		{"ok any identity", []string{"spiffe://prod/envoy"}, []string{"envoy", "envoy.smallstep.com", "spiffe://prod/envoy"}, true},
+		{"ok pattern", []string{"*.smallstep.com"}, []string{"envoy.smallstep.com"}, true},
+		{"ok spiffe pattern", []string{"spiffe://prod/ns/*/sa/envoy"}, []string{"spiffe://prod/ns/default/sa/envoy"}, true},
+		{"ok regexp", []string{"regexp:spiffe://prod/ns/[a-z-]+/sa/envoy"}, []string{"spiffe://prod/ns/kube-system/sa/envoy"}, true},
+		{"fail name", []string{"envoy.smallstep.com"}, []string{"other.smallstep.com"}, false},
+		{"fail pattern", []string{"*.smallstep.com"}, []string{"smallstep.com"}, false},
+		{"fail spiffe pattern", []string{"spiffe://prod/ns/*/sa/envoy"}, []string{"spiffe://prod/ns/a/b/sa/envoy"}, false},
+		{"fail regexp partial", []string{"regexp:spiffe://prod/.*"}, []string{"x-spiffe://prod/envoy"}, false},
+		{"fail regexp case", []string{"regexp:spiffe://prod/envoy"}, []string{"spiffe://prod/Envoy"}, false},
+		{"fail no identities", []string{"*"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newIdentityMatcher(tt.authorized)
+			assert.FatalError(t, err)
+			if got := m.Match(tt.identities); got != tt.want {
+				t.Errorf("identityMatcher.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_certificateIdentities(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://prod/ns/default/sa/envoy")
+	assert.FatalError(t, err)
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want []string
+	}{
+		{"ok", &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "envoy"},
+			DNSNames: []string{"envoy.smallstep.com"},
+			URIs:     []*url.URL{spiffe},
+		}, []string{"envoy", "envoy.smallstep.com", "spiffe://prod/ns/default/sa/envoy"}},
+		{"ok no common name", &x509.Certificate{
+			URIs: []*url.URL{spiffe},
+		}, []string{"spiffe://prod/ns/default/sa/envoy"}},
+		{"ok empty", &x509.Certificate{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, certificateIdentities(tt.cert))
+		})
+	}
+}
+
+func Test_validateFingerprints(t *testing.T) {
+	assert.NoError(t, validateFingerprints(nil))
+	assert.NoError(t, validateFingerprints([]string{"8597a5d0b86f4a630f64fbb903b613ceb04756319a156bb6a6faed95394040ff", "ABCD"}))
+	assert.Error(t, validateFingerprints([]string{"not-hex"}))
+	assert.Error(t, validateFingerprints([]string{""}))
+}
+
+func Test_matchFingerprint(t *testing.T) {
+	fingerprints := []string{"abcd", "8597A5D0"}
+	assert.True(t, matchFingerprint(fingerprints, "8597a5d0"))
+	assert.True(t, matchFingerprint(fingerprints, "abcd"))
+	assert.False(t, matchFingerprint(fingerprints, "1234"))
+	assert.False(t, matchFingerprint(nil, "abcd"))
+}
@@ -0,0 +1,140 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"go.step.sm/crypto/x509util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultListenerName is the name of the listener defined by the top-level
+// network and address of the configuration.
+const DefaultListenerName = "default"
+
+// listenerPolicy contains the settings used to validate the requests received
+// by a listener.
+type listenerPolicy struct {
+	name                   string
+	isTCP                  bool
+	authorization          []AuthorizationRule
+	authorizedIdentities   *identityMatcher
+	authorizedFingerprints []string
+}
+
+func newListenerPolicy(c ListenerConfig) (*listenerPolicy, error) {
+	identities, err := newIdentityMatcher(c.AuthorizedIdentities)
+	if err != nil {
+		return nil, err
+	}
+	return &listenerPolicy{
+		name:                   c.Name,
+		isTCP:                  c.IsTCP(),
+		authorization:          c.Authorization,
+		authorizedIdentities:   identities,
+		authorizedFingerprints: c.AuthorizedFingerprints,
+	}, nil
+}
+
+type listenerKey struct{}
+
+// NewListenerContext returns a new context with the given listener name. The
+// requests are validated using the policy of the listener in the context, or
+// the default listener if there's none.
+func NewListenerContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, name)
+}
+
+// ListenerFromContext returns the listener name in the given context.
+func ListenerFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(listenerKey{}).(string)
+	return name, ok
+}
+
+// UnaryListenerInterceptor returns a new unary server interceptor that adds
+// the given listener name to the request context. It must be used in the gRPC
+// server of each additional listener.
+func UnaryListenerInterceptor(name string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(NewListenerContext(ctx, name), req)
+	}
+}
+
+// StreamListenerInterceptor returns a new stream server interceptor that adds
+// the given listener name to the stream context. It must be used in the gRPC
+// server of each additional listener.
+func StreamListenerInterceptor(name string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = NewListenerContext(stream.Context(), name)
+		return handler(srv, wrapped)
+	}
+}
+
+// getListener returns the policy of the listener in the given context.
+func (srv *Service) getListener(ctx context.Context) (*listenerPolicy, error) {
+	name, ok := ListenerFromContext(ctx)
+	if !ok {
+		name = DefaultListenerName
+	}
+	if l, ok := srv.getConfig().listeners[name]; ok {
+		return l, nil
+	}
+	return nil, status.Errorf(codes.Internal, "listener %s is not defined", name)
+}
+
+// validatePeer validates the client certificate on TCP connections and returns
+// the identities of the client. On UNIX domain sockets it returns the
+// credentials of the peer process if they are available.
+func (l *listenerPolicy) validatePeer(ctx context.Context) (*authzClient, error) {
+	if !l.isTCP {
+		client := new(authzClient)
+		if p, ok := peer.FromContext(ctx); ok {
+			client.Credentials, _ = p.AuthInfo.(*PeerCredentials)
+		}
+		return client, nil
+	}
+
+	// TLS validation
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to obtain peer for request")
+	}
+
+	var cs *tls.ConnectionState
+	switch tlsInfo := p.AuthInfo.(type) {
+	case credentials.TLSInfo:
+		cs = &tlsInfo.State
+	case *credentials.TLSInfo:
+		cs = &tlsInfo.State
+	default:
+		return nil, status.Errorf(codes.Internal, "failed to obtain connection state for request")
+	}
+
+	if len(cs.PeerCertificates) == 0 {
+		return nil, status.Errorf(codes.PermissionDenied, "missing peer certificate")
+	}
+
+	cert := cs.PeerCertificates[0]
+	identities := certificateIdentities(cert)
+	if !l.authorizedIdentities.Empty() {
+		if !l.authorizedIdentities.Match(identities) {
+			return nil, status.Errorf(codes.PermissionDenied, "certificate identities [%s] are not authorized", strings.Join(identities, ", "))
+		}
+	}
+
+	if len(l.authorizedFingerprints) > 0 {
+		fp := x509util.Fingerprint(cert)
+		if !matchFingerprint(l.authorizedFingerprints, fp) {
+			return nil, status.Errorf(codes.PermissionDenied, "certificate fingerprint %s is not authorized", fp)
+		}
+	}
+
+	return &authzClient{Identities: identities}, nil
+}
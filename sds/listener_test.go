@@ -0,0 +1,121 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestListenerContext(t *testing.T) {
+	_, ok := ListenerFromContext(context.Background())
+	assert.False(t, ok)
+
+	name, ok := ListenerFromContext(NewListenerContext(context.Background(), "gateway"))
+	assert.True(t, ok)
+	assert.Equals(t, "gateway", name)
+}
+
+func TestService_listeners(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Network: "unix",
+		Address: "/tmp/sds.unix",
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Authorization: []AuthorizationRule{
+			{Resources: []string{"foo.smallstep.com", "shared.smallstep.com"}},
+		},
+		Listeners: []ListenerConfig{{
+			Name:    "gateway",
+			Network: "unix",
+			Address: "/tmp/gateway.unix",
+			Authorization: []AuthorizationRule{
+				{Resources: []string{"bar.smallstep.com", "shared.smallstep.com"}},
+			},
+		}},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Start a server for each listener
+	newClient := func(name string) secret.SecretDiscoveryServiceClient {
+		lis := bufconn.Listen(1024 * 1024)
+		s := grpc.NewServer(
+			grpc.UnaryInterceptor(UnaryListenerInterceptor(name)),
+			grpc.StreamInterceptor(StreamListenerInterceptor(name)),
+		)
+		srv.Register(s)
+		go func() {
+			if err := s.Serve(lis); err != nil {
+				panic(fmt.Sprintf("Server exited with error: %v", err))
+			}
+		}()
+		t.Cleanup(s.Stop)
+
+		dialer := func(ctx context.Context, s string) (net.Conn, error) {
+			return lis.Dial()
+		}
+		conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.FatalError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return secret.NewSecretDiscoveryServiceClient(conn)
+	}
+	local := newClient(DefaultListenerName)
+	gateway := newClient("gateway")
+	missing := newClient("missing")
+
+	request := func(names ...string) *discovery.DiscoveryRequest {
+		return &discovery.DiscoveryRequest{
+			Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+			ResourceNames: names,
+			TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		}
+	}
+
+	// Each listener uses its own policy
+	_, err = local.FetchSecrets(context.Background(), request("foo.smallstep.com"))
+	assert.FatalError(t, err)
+	_, err = local.FetchSecrets(context.Background(), request("bar.smallstep.com"))
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+	_, err = gateway.FetchSecrets(context.Background(), request("bar.smallstep.com"))
+	assert.FatalError(t, err)
+	_, err = gateway.FetchSecrets(context.Background(), request("foo.smallstep.com"))
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+
+	stream, err := gateway.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, stream.Send(request("foo.smallstep.com")))
+	_, err = stream.Recv()
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+
+	// The secrets are shared by all the listeners
+	dr1, err := local.FetchSecrets(context.Background(), request("shared.smallstep.com"))
+	assert.FatalError(t, err)
+	dr2, err := gateway.FetchSecrets(context.Background(), request("shared.smallstep.com"))
+	assert.FatalError(t, err)
+	assert.Equals(t, dr1.VersionInfo, dr2.VersionInfo)
+
+	// Unknown listeners fail
+	_, err = missing.FetchSecrets(context.Background(), request("foo.smallstep.com"))
+	assert.Equals(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,218 @@
+package sds
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.step.sm/crypto/x509util"
+)
+
+// MetricsPath is the path used to serve the Prometheus metrics.
+const MetricsPath = "/metrics"
+
+const metricsNamespace = "step_sds"
+
+// MetricsMaxClusters is the maximum number of node clusters used as labels of
+// the active streams. Streams from other clusters are counted as "other", and
+// streams without a cluster as "unknown".
+var MetricsMaxClusters = 100
+
+var (
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_streams",
+		Help:      "Number of active streams by protocol and node cluster.",
+	}, []string{"protocol", "cluster"})
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of discovery requests by protocol and type.",
+	}, []string{"protocol", "type"})
+
+	certificatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificates_total",
+		Help:      "Number of certificate issuances and renewals by result.",
+	}, []string{"operation", "result"})
+
+	certificatesDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificates_duration_seconds",
+		Help:      "Time spent issuing and renewing certificates.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	caRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ca_request_duration_seconds",
+		Help:      "Latency of the requests to the CA by endpoint and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "result"})
+
+	certificateExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "certificate_expiry_seconds"),
+		"Seconds until the expiration of the certificate served for each resource name.",
+		[]string{"name"}, nil,
+	)
+
+	rootsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "roots"),
+		"Number of root certificates served.",
+		nil, nil,
+	)
+
+	rootInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "root_info"),
+		"Root certificates served by fingerprint.",
+		[]string{"fingerprint", "subject"}, nil,
+	)
+)
+
+var (
+	metricsRegistry     *prometheus.Registry
+	metricsRegistryOnce sync.Once
+)
+
+var (
+	clusterLabels      = make(map[string]bool)
+	clusterLabelsMutex sync.Mutex
+)
+
+// clusterLabel returns the label used for the given node cluster. The cluster
+// is sent by the client, so only the first MetricsMaxClusters clusters are
+// used as labels.
+func clusterLabel(cluster string) string {
+	if cluster == "" {
+		return "unknown"
+	}
+	clusterLabelsMutex.Lock()
+	defer clusterLabelsMutex.Unlock()
+	if !clusterLabels[cluster] {
+		if len(clusterLabels) >= MetricsMaxClusters {
+			return "other"
+		}
+		clusterLabels[cluster] = true
+	}
+	return cluster
+}
+
+// getMetricsRegistry returns the registry with the process-wide metrics.
+func getMetricsRegistry() *prometheus.Registry {
+	metricsRegistryOnce.Do(func() {
+		metricsRegistry = prometheus.NewRegistry()
+		metricsRegistry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+			activeStreams, requestsTotal,
+			certificatesTotal, certificatesDuration,
+			caRequestDuration,
+		)
+	})
+	return metricsRegistry
+}
+
+// MetricsHandler returns the http.Handler that serves the Prometheus metrics
+// of the service.
+func (srv *Service) MetricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&cacheCollector{cache: srv.cache})
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, promhttp.HandlerFor(prometheus.Gatherers{getMetricsRegistry(), reg}, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// observeCA records the latency of a request to the CA.
+func observeCA(endpoint string, start time.Time, err error) {
+	caRequestDuration.WithLabelValues(endpoint, result(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeCertificate records an issuance or renewal of a certificate.
+func observeCertificate(operation string, start time.Time, err error) {
+	certificatesTotal.WithLabelValues(operation, result(err)).Inc()
+	certificatesDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// streamMetric tracks an active stream by protocol and node cluster. The
+// stream is counted once the client sends its node.
+type streamMetric struct {
+	protocol string
+	cluster  string
+	counted  bool
+}
+
+func newStreamMetric(protocol string) *streamMetric {
+	return &streamMetric{protocol: protocol}
+}
+
+// Request counts a request of the given type and the stream if the node is
+// known.
+func (s *streamMetric) Request(typ string, node *core.Node) {
+	requestsTotal.WithLabelValues(s.protocol, typ).Inc()
+	if !s.counted && node != nil {
+		s.counted = true
+		s.cluster = clusterLabel(node.Cluster)
+		activeStreams.WithLabelValues(s.protocol, s.cluster).Inc()
+	}
+}
+
+// Close removes the stream from the active streams.
+func (s *streamMetric) Close() {
+	if s.counted {
+		activeStreams.WithLabelValues(s.protocol, s.cluster).Dec()
+	}
+}
+
+// cacheCollector collects the expiration of the certificates and the roots
+// currently in the secret cache.
+type cacheCollector struct {
+	cache *secretCache
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificateExpiryDesc
+	ch <- rootsDesc
+	ch <- rootInfoDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	// A resource name can be cached for different nodes, only the certificate
+	// that expires first is reported.
+	expiry := make(map[string]time.Time)
+	roots := make(map[string]string)
+	for _, e := range c.cache.Entries() {
+		s := e.Secrets()
+		for _, cert := range s.Certificates {
+			if cert.Leaf == nil {
+				continue
+			}
+			if t, ok := expiry[e.name]; !ok || cert.Leaf.NotAfter.Before(t) {
+				expiry[e.name] = cert.Leaf.NotAfter
+			}
+		}
+		for _, root := range s.Roots {
+			roots[x509util.Fingerprint(root)] = root.Subject.String()
+		}
+	}
+
+	now := time.Now()
+	for name, t := range expiry {
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue, t.Sub(now).Seconds(), name)
+	}
+	ch <- prometheus.MustNewConstMetric(rootsDesc, prometheus.GaugeValue, float64(len(roots)))
+	for fp, subject := range roots {
+		ch <- prometheus.MustNewConstMetric(rootInfoDesc, prometheus.GaugeValue, 1, fp, subject)
+	}
+}
@@ -0,0 +1,161 @@
+package sds
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/step-sds/logging"
+	"go.step.sm/crypto/x509util"
+)
+
+// metricValue returns the value of the given counter or gauge.
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	t.Helper()
+	var d dto.Metric
+	assert.FatalError(t, m.Write(&d))
+	switch {
+	case d.Counter != nil:
+		return d.Counter.GetValue()
+	case d.Gauge != nil:
+		return d.Gauge.GetValue()
+	default:
+		t.Fatalf("unsupported metric %v", m.Desc())
+		return 0
+	}
+}
+
+func TestService_MetricsHandler(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	fetches := metricValue(t, requestsTotal.WithLabelValues("fetch", "fetch"))
+	issued := metricValue(t, certificatesTotal.WithLabelValues("issue", "success"))
+
+	dr, err := srv.FetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	})
+	assert.FatalError(t, err)
+	assert.Len(t, 2, dr.Resources)
+	assert.Equals(t, fetches+1, metricValue(t, requestsTotal.WithLabelValues("fetch", "fetch")))
+	assert.Equals(t, issued+2, metricValue(t, certificatesTotal.WithLabelValues("issue", "success")))
+
+	w := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", MetricsPath, http.NoBody))
+	assert.Equals(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+
+	block, _ := pem.Decode([]byte(testRootCA))
+	root, err := x509.ParseCertificate(block.Bytes)
+	assert.FatalError(t, err)
+
+	for _, s := range []string{
+		`step_sds_certificate_expiry_seconds{name="foo.smallstep.com"}`,
+		"step_sds_roots 1",
+		fmt.Sprintf(`step_sds_root_info{fingerprint="%s"`, x509util.Fingerprint(root)),
+		`step_sds_requests_total{protocol="fetch",type="fetch"}`,
+		`step_sds_certificates_total{operation="issue",result="success"}`,
+		`step_sds_ca_request_duration_seconds_count{endpoint="sign",result="success"}`,
+		"go_goroutines",
+	} {
+		assert.True(t, strings.Contains(body, s), s)
+	}
+
+	w = httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", http.NoBody))
+	assert.Equals(t, http.StatusNotFound, w.Code)
+}
+
+func Test_streamMetric(t *testing.T) {
+	gauge := activeStreams.WithLabelValues("test", "backend")
+	initial := metricValue(t, requestsTotal.WithLabelValues("test", "initial"))
+
+	s := newStreamMetric("test")
+	s.Request("initial", nil)
+	assert.Equals(t, float64(0), metricValue(t, gauge))
+	s.Request("update", &core.Node{Id: "node-1", Cluster: "backend"})
+	s.Request("ack", &core.Node{Id: "node-1", Cluster: "backend"})
+	assert.Equals(t, float64(1), metricValue(t, gauge))
+	assert.Equals(t, initial+1, metricValue(t, requestsTotal.WithLabelValues("test", "initial")))
+
+	other := newStreamMetric("test")
+	other.Request("initial", &core.Node{Id: "node-2", Cluster: "backend"})
+	assert.Equals(t, float64(2), metricValue(t, gauge))
+
+	s.Close()
+	other.Close()
+	assert.Equals(t, float64(0), metricValue(t, gauge))
+
+	// Streams without node are not counted
+	newStreamMetric("test").Close()
+	assert.Equals(t, float64(0), metricValue(t, gauge))
+}
+
+func Test_clusterLabel(t *testing.T) {
+	defer func(n int) { MetricsMaxClusters = n }(MetricsMaxClusters)
+	clusterLabelsMutex.Lock()
+	MetricsMaxClusters = len(clusterLabels) + 1
+	clusterLabelsMutex.Unlock()
+
+	assert.Equals(t, "unknown", clusterLabel(""))
+	assert.Equals(t, "cluster-1", clusterLabel("cluster-1"))
+	assert.Equals(t, "other", clusterLabel("cluster-2"))
+	assert.Equals(t, "cluster-1", clusterLabel("cluster-1"))
+
+	gauge := activeStreams.WithLabelValues("test", "other")
+	s := newStreamMetric("test")
+	s.Request("initial", &core.Node{Id: "node-1", Cluster: "cluster-3"})
+	assert.Equals(t, float64(1), metricValue(t, gauge))
+	s.Close()
+	assert.Equals(t, float64(0), metricValue(t, gauge))
+}
+
+func Test_secretRenewer_renewError(t *testing.T) {
+	ca := caServer(60 * time.Second)
+
+	var buf bytes.Buffer
+	logger, err := logging.New("step-sds", []byte(`{"format": "json"}`))
+	assert.FatalError(t, err)
+	logger.SetOutput(&buf)
+
+	token, err := caProvisioner(ca).Token("foo.smallstep.com")
+	assert.FatalError(t, err)
+	sr, err := newSecretRenewer(context.Background(), []string{token}, nil, logger)
+	assert.FatalError(t, err)
+	defer sr.Stop()
+
+	failures := metricValue(t, certificatesTotal.WithLabelValues("renew", "error"))
+	ca.Close()
+	assert.Error(t, sr.Renew(context.Background()))
+	assert.Equals(t, failures+1, metricValue(t, certificatesTotal.WithLabelValues("renew", "error")))
+
+	assert.True(t, strings.Contains(buf.String(), `"msg":"Error renewing certificate"`))
+	assert.True(t, strings.Contains(buf.String(), `"resourceName":"foo.smallstep.com"`))
+}
@@ -0,0 +1,76 @@
+package sds
+
+import "time"
+
+// NACKRetryInterval is the time to wait before sending again a response
+// rejected by the client. The interval is doubled on each retry.
+var NACKRetryInterval = time.Second
+
+// NACKMaxRetries is the number of times a rejected response is sent again
+// before falling back to the last secrets acknowledged by the client.
+var NACKMaxRetries = 3
+
+// nackBackoff implements the retry policy of a stream when the client rejects
+// a response. A response is retried NACKMaxRetries times with an exponential
+// backoff, then the stream will fall back to the last acknowledged secrets, if
+// this is rejected too, the stream will wait for new secrets.
+type nackBackoff struct {
+	attempts int
+	fallback bool
+	timer    *time.Timer
+}
+
+// C returns the channel that will be notified when a retry is due, it will be
+// nil if there's no retry scheduled.
+func (b *nackBackoff) C() <-chan time.Time {
+	if b.timer == nil {
+		return nil
+	}
+	return b.timer.C
+}
+
+// NACK schedules a new retry and returns the time to wait before it. It
+// returns false if the retries have been exhausted.
+func (b *nackBackoff) NACK() (time.Duration, bool) {
+	b.Stop()
+	b.attempts++
+	switch {
+	case b.attempts <= NACKMaxRetries:
+		b.fallback = false
+	case b.attempts == NACKMaxRetries+1:
+		b.fallback = true
+	default:
+		return 0, false
+	}
+	d := NACKRetryInterval << (b.attempts - 1)
+	b.timer = time.NewTimer(d)
+	return d, true
+}
+
+// Retry must be called when the channel returned by C is notified, it returns
+// if the retry must use the last acknowledged secrets.
+func (b *nackBackoff) Retry() (fallback bool) {
+	b.timer = nil
+	return b.fallback
+}
+
+// Attempts returns the number of consecutive responses rejected.
+func (b *nackBackoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset stops any pending retry and resets the number of attempts. It must be
+// called when the client acknowledges a response or when new secrets are sent.
+func (b *nackBackoff) Reset() {
+	b.Stop()
+	b.attempts = 0
+	b.fallback = false
+}
+
+// Stop stops the pending retry if any.
+func (b *nackBackoff) Stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
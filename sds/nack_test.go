@@ -0,0 +1,54 @@
+package sds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+)
+
+func Test_nackBackoff(t *testing.T) {
+	tmpInterval, tmpRetries := NACKRetryInterval, NACKMaxRetries
+	t.Cleanup(func() {
+		NACKRetryInterval, NACKMaxRetries = tmpInterval, tmpRetries
+	})
+	NACKRetryInterval, NACKMaxRetries = time.Millisecond, 2
+
+	b := new(nackBackoff)
+	defer b.Stop()
+	assert.Nil(t, b.C())
+
+	// Retries with exponential backoff
+	for i, want := range []time.Duration{time.Millisecond, 2 * time.Millisecond} {
+		d, ok := b.NACK()
+		assert.True(t, ok)
+		assert.Equals(t, want, d)
+		assert.Equals(t, i+1, b.Attempts())
+		<-b.C()
+		assert.False(t, b.Retry())
+		assert.Nil(t, b.C())
+	}
+
+	// Fallback
+	d, ok := b.NACK()
+	assert.True(t, ok)
+	assert.Equals(t, 4*time.Millisecond, d)
+	<-b.C()
+	assert.True(t, b.Retry())
+
+	// No more retries
+	d, ok = b.NACK()
+	assert.False(t, ok)
+	assert.Equals(t, time.Duration(0), d)
+	assert.Nil(t, b.C())
+
+	// Reset
+	b.Reset()
+	assert.Equals(t, 0, b.Attempts())
+	d, ok = b.NACK()
+	assert.True(t, ok)
+	assert.Equals(t, time.Millisecond, d)
+	assert.NotNil(t, b.C())
+	b.Reset()
+	assert.Nil(t, b.C())
+}
@@ -0,0 +1,134 @@
+package sds
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+)
+
+// PeerCredentialsAuthType is the auth type of the connections authenticated
+// using the credentials of the peer process.
+const PeerCredentialsAuthType = "peercred"
+
+// PeerCredentials contains the credentials of the process in the other end of
+// a UNIX domain socket. It implements the credentials.AuthInfo interface.
+type PeerCredentials struct {
+	credentials.CommonAuthInfo
+	UID        uint32
+	GID        uint32
+	PID        int32
+	Executable string
+}
+
+// AuthType returns the auth type of the peer credentials.
+func (c *PeerCredentials) AuthType() string {
+	return PeerCredentialsAuthType
+}
+
+// peerCredentials is a credentials.TransportCredentials that adds the
+// credentials of the peer process to the UNIX domain socket connections.
+type peerCredentials struct {
+	info credentials.ProtocolInfo
+}
+
+// NewPeerCredentials returns the gRPC transport credentials used in the UNIX
+// domain socket servers. The credentials of the peer process (uid, gid, pid,
+// and executable) are attached to each connection, and they can be used in the
+// authorization policy.
+func NewPeerCredentials() credentials.TransportCredentials {
+	return &peerCredentials{
+		info: credentials.ProtocolInfo{SecurityProtocol: PeerCredentialsAuthType},
+	}
+}
+
+// ClientHandshake does not do anything, the peer credentials are only
+// available in the server.
+func (c *peerCredentials) ClientHandshake(_ context.Context, _ string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+// ServerHandshake reads the credentials of the peer process. If the
+// credentials cannot be read, for example on platforms without SO_PEERCRED,
+// the connection is accepted without them, and its requests will not match any
+// authorization rule based on them.
+func (c *peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	creds, err := getPeerCredentials(conn)
+	if err != nil {
+		return conn, nil, nil
+	}
+	return conn, creds, nil
+}
+
+func (c *peerCredentials) Info() credentials.ProtocolInfo {
+	return c.info
+}
+
+func (c *peerCredentials) Clone() credentials.TransportCredentials {
+	return &peerCredentials{info: c.info}
+}
+
+func (c *peerCredentials) OverrideServerName(name string) error {
+	c.info.ServerName = name
+	return nil
+}
+
+type peerCredentialsKey struct{}
+
+// PeerCredentialsConnContext adds the credentials of the peer process to the
+// context of the HTTP connections. It is meant to be used as the ConnContext of
+// an http.Server listening in a UNIX domain socket. If the credentials cannot
+// be read, the context is not modified and the requests will not match any
+// authorization rule based on them.
+func PeerCredentialsConnContext(ctx context.Context, conn net.Conn) context.Context {
+	creds, err := getPeerCredentials(conn)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, creds)
+}
+
+// peerCredentialsFromContext returns the peer credentials added by
+// PeerCredentialsConnContext.
+func peerCredentialsFromContext(ctx context.Context) (*PeerCredentials, bool) {
+	creds, ok := ctx.Value(peerCredentialsKey{}).(*PeerCredentials)
+	return creds, ok
+}
+
+// getPeerCredentials returns the credentials of the process in the other end
+// of a UNIX domain socket connection.
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.Errorf("peer credentials are not supported on %T connections", conn)
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting raw connection")
+	}
+	var creds *PeerCredentials
+	var credsErr error
+	if err := rc.Control(func(fd uintptr) {
+		creds, credsErr = getsockoptPeerCredentials(fd)
+	}); err != nil {
+		return nil, errors.Wrap(err, "error getting raw connection")
+	}
+	if credsErr != nil {
+		return nil, credsErr
+	}
+	creds.Executable = peerExecutable(creds.PID)
+	return creds, nil
+}
+
+// String returns a representation of the peer credentials used in the logs.
+func (c *PeerCredentials) String() string {
+	s := "uid=" + strconv.FormatUint(uint64(c.UID), 10) +
+		" gid=" + strconv.FormatUint(uint64(c.GID), 10) +
+		" pid=" + strconv.FormatInt(int64(c.PID), 10)
+	if c.Executable != "" {
+		s += " exe=" + c.Executable
+	}
+	return s
+}
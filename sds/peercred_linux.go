@@ -0,0 +1,37 @@
+//go:build linux
+
+package sds
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// getsockoptPeerCredentials reads the peer credentials using SO_PEERCRED.
+func getsockoptPeerCredentials(fd uintptr) (*PeerCredentials, error) {
+	ucred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting peer credentials")
+	}
+	return &PeerCredentials{
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+		PID: ucred.Pid,
+	}, nil
+}
+
+// peerExecutable returns the path of the executable of the given process, or
+// an empty string if it cannot be read.
+func peerExecutable(pid int32) string {
+	if pid <= 0 {
+		return ""
+	}
+	exe, err := os.Readlink("/proc/" + strconv.Itoa(int(pid)) + "/exe")
+	if err != nil {
+		return ""
+	}
+	return exe
+}
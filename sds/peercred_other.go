@@ -0,0 +1,17 @@
+//go:build !linux
+
+package sds
+
+import (
+	"github.com/pkg/errors"
+)
+
+// getsockoptPeerCredentials is not supported on this platform.
+func getsockoptPeerCredentials(uintptr) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
+
+// peerExecutable is not supported on this platform.
+func peerExecutable(int32) string {
+	return ""
+}
@@ -0,0 +1,160 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// unixConnPair returns the server and client ends of a UNIX domain socket
+// connection.
+func unixConnPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	lis, err := net.Listen("unix", filepath.Join(t.TempDir(), "sds.unix"))
+	assert.FatalError(t, err)
+	defer lis.Close()
+
+	client, err := net.Dial("unix", lis.Addr().String())
+	assert.FatalError(t, err)
+	t.Cleanup(func() { client.Close() })
+	server, err := lis.Accept()
+	assert.FatalError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func Test_getPeerCredentials(t *testing.T) {
+	server, _ := unixConnPair(t)
+	creds, err := getPeerCredentials(server)
+	if runtime.GOOS != "linux" {
+		assert.Error(t, err)
+		return
+	}
+	assert.FatalError(t, err)
+	exe, err := os.Executable()
+	assert.FatalError(t, err)
+	assert.Equals(t, uint32(os.Getuid()), creds.UID)
+	assert.Equals(t, uint32(os.Getgid()), creds.GID)
+	assert.Equals(t, int32(os.Getpid()), creds.PID)
+	assert.Equals(t, exe, creds.Executable)
+	assert.Equals(t, PeerCredentialsAuthType, creds.AuthType())
+
+	// Only UNIX domain sockets are supported
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, err = getPeerCredentials(c1)
+	assert.Error(t, err)
+}
+
+func Test_peerCredentials_ServerHandshake(t *testing.T) {
+	server, _ := unixConnPair(t)
+	conn, info, err := NewPeerCredentials().ServerHandshake(server)
+	assert.FatalError(t, err)
+	assert.True(t, conn == server)
+	if runtime.GOOS == "linux" {
+		creds, ok := info.(*PeerCredentials)
+		assert.Fatal(t, ok)
+		assert.Equals(t, int32(os.Getpid()), creds.PID)
+	}
+
+	// Connections without credentials are accepted
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn, info, err = NewPeerCredentials().ServerHandshake(c1)
+	assert.FatalError(t, err)
+	assert.True(t, conn == c1)
+	assert.Nil(t, info)
+}
+
+func TestPeerCredentialsConnContext(t *testing.T) {
+	server, _ := unixConnPair(t)
+	ctx := PeerCredentialsConnContext(context.Background(), server)
+	creds, ok := peerCredentialsFromContext(ctx)
+	assert.Equals(t, runtime.GOOS == "linux", ok)
+	if ok {
+		assert.Equals(t, uint32(os.Getuid()), creds.UID)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, ok = peerCredentialsFromContext(PeerCredentialsConnContext(context.Background(), c1))
+	assert.False(t, ok)
+}
+
+func TestService_FetchSecrets_peerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	uid := uint32(os.Getuid())
+	srv, err := New(Config{
+		Network: "unix",
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Authorization: []AuthorizationRule{
+			{UIDs: []uint32{uid}, Resources: []string{"foo.smallstep.com"}},
+			{UIDs: []uint32{uid + 1}, Resources: []string{"bar.smallstep.com"}},
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis, err := net.Listen("unix", filepath.Join(t.TempDir(), "sds.unix"))
+	assert.FatalError(t, err)
+	s := grpc.NewServer(grpc.Creds(NewPeerCredentials()))
+	defer s.Stop()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	conn, err := grpc.NewClient("unix://"+lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.FatalError(t, err)
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	_, err = client.FetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+		Node:          node,
+		ResourceNames: []string{"foo.smallstep.com"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	})
+	assert.FatalError(t, err)
+
+	_, err = client.FetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+		Node:          node,
+		ResourceNames: []string{"bar.smallstep.com"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	})
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,254 @@
+package sds
+
+import (
+	"crypto"
+	"crypto/x509"
+	"strings"
+	"text/template"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/ca"
+	"go.step.sm/crypto/keyutil"
+	"go.step.sm/crypto/x509util"
+)
+
+// keyType contains the parameters used to generate a private key.
+type keyType struct {
+	kty  string
+	crv  string
+	size int
+}
+
+// keyTypes are the key types supported in a resource profile.
+var keyTypes = map[string]keyType{
+	"P-256":    {"EC", "P-256", 0},
+	"P-384":    {"EC", "P-384", 0},
+	"RSA-2048": {"RSA", "", 2048},
+	"RSA-4096": {"RSA", "", 4096},
+	"Ed25519":  {"OKP", "Ed25519", 0},
+}
+
+// secretRequest contains the parameters used to sign the certificate of a
+// resource name.
+type secretRequest struct {
+	Name        string
+	CommonName  string
+	SANs        []string
+	KeyType     string
+	Validity    time.Duration
+	Provisioner string
+	Renewal     renewPolicy
+	Rotation    keyRotation
+}
+
+// Key returns the key used to cache the secret. Requests for the same resource
+// name can have different keys if they are rendered from different nodes. The
+// renew policy and the key rotation are not part of the key, changes to them
+// are applied to new secrets.
+func (r *secretRequest) Key() string {
+	fields := append([]string{
+		r.Name, r.CommonName, r.KeyType, r.Validity.String(), r.Provisioner,
+	}, r.SANs...)
+	return strings.Join(fields, "\x00")
+}
+
+// resourceProfile is a ResourceConfig with the templates already parsed.
+type resourceProfile struct {
+	ResourceConfig
+	validity   time.Duration
+	renewal    renewPolicy
+	rotation   keyRotation
+	commonName *template.Template
+	sans       []*template.Template
+}
+
+// newResourceProfiles parses the templates in the given resources.
+func newResourceProfiles(resources []ResourceConfig) ([]*resourceProfile, error) {
+	profiles := make([]*resourceProfile, len(resources))
+	for i, r := range resources {
+		p := &resourceProfile{ResourceConfig: r}
+		if r.Validity != "" {
+			d, err := time.ParseDuration(r.Validity)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing validity %s", r.Validity)
+			}
+			p.validity = d
+		}
+		renewal, err := newRenewPolicy(r.RenewFraction, r.RenewBefore)
+		if err != nil {
+			return nil, err
+		}
+		p.renewal = renewal
+		p.rotation = keyRotation{Method: r.KeyRotation, Every: r.KeyRotationEvery}
+		if r.CommonName != "" {
+			tmpl, err := parseTemplate(r.CommonName)
+			if err != nil {
+				return nil, err
+			}
+			p.commonName = tmpl
+		}
+		for _, list := range [][]string{r.DNSNames, r.IPAddresses, r.URIs} {
+			for _, san := range list {
+				tmpl, err := parseTemplate(san)
+				if err != nil {
+					return nil, err
+				}
+				p.sans = append(p.sans, tmpl)
+			}
+		}
+		profiles[i] = p
+	}
+	return profiles, nil
+}
+
+// newSecretRequest returns the secretRequest for the given resource name using
+// the first resource profile that matches it. The common name and SANs are
+// rendered using the name and the given node. By default the common name is
+// the resource name, and the name is the first SAN; if the profile sets a
+// common name, only the SANs in the profile are used, or the common name if
+// there are none.
+func newSecretRequest(name string, node *core.Node, profiles []*resourceProfile) (*secretRequest, error) {
+	req := &secretRequest{
+		Name:       name,
+		CommonName: name,
+		SANs:       []string{name},
+	}
+	for _, p := range profiles {
+		if !p.Match(name) {
+			continue
+		}
+		req.KeyType = p.KeyType
+		req.Validity = p.validity
+		req.Provisioner = p.Provisioner
+		req.Renewal = p.renewal
+		req.Rotation = p.rotation
+		if isValidationContext(name) {
+			break
+		}
+
+		data := newTemplateData(name, node)
+		if p.commonName != nil {
+			cn, err := renderTemplate(p.commonName, data)
+			if err != nil {
+				return nil, err
+			}
+			req.CommonName, req.SANs = cn, nil
+		}
+		for _, tmpl := range p.sans {
+			san, err := renderTemplate(tmpl, data)
+			if err != nil {
+				return nil, err
+			}
+			req.SANs = appendUnique(req.SANs, san)
+		}
+		if len(req.SANs) == 0 {
+			req.SANs = []string{req.CommonName}
+		}
+		break
+	}
+	return req, nil
+}
+
+// Token returns a new token for the secret request using the given
+// provisioner.
+func (r *secretRequest) Token(p *ca.Provisioner) (string, error) {
+	return p.Token(r.CommonName, r.SANs...)
+}
+
+// createSignRequest creates a new sign request for the given token using the
+// key type and validity in the secret request. A nil request will use the CA
+// defaults.
+func createSignRequest(token string, r *secretRequest) (*api.SignRequest, crypto.PrivateKey, error) {
+	if r == nil || r.KeyType == "" {
+		req, pk, err := ca.CreateSignRequest(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r != nil && r.Validity > 0 {
+			req.NotAfter.SetDuration(r.Validity)
+		}
+		return req, pk, nil
+	}
+
+	kt, ok := keyTypes[r.KeyType]
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported key type %s", r.KeyType)
+	}
+	signer, err := keyutil.GenerateSigner(kt.kty, kt.crv, kt.size)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error generating key")
+	}
+
+	subject, sans, err := getTokenSubjectAndSANs(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509util.CreateCertificateRequest(subject, sans, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := &api.SignRequest{
+		CsrPEM: api.CertificateRequest{CertificateRequest: csr},
+		OTT:    token,
+	}
+	if r.Validity > 0 {
+		req.NotAfter.SetDuration(r.Validity)
+	}
+	return req, signer, nil
+}
+
+// createRekeyRequest creates a rekey request for the given certificate with a
+// new key of the type in the secret request, or the CA default if it's not
+// set. The subject and the SANs of the certificate are kept.
+func createRekeyRequest(cert *x509.Certificate, r *secretRequest) (*api.RekeyRequest, crypto.PrivateKey, error) {
+	var signer crypto.Signer
+	var err error
+	if r == nil || r.KeyType == "" {
+		signer, err = keyutil.GenerateDefaultSigner()
+	} else {
+		kt, ok := keyTypes[r.KeyType]
+		if !ok {
+			return nil, nil, errors.Errorf("unsupported key type %s", r.KeyType)
+		}
+		signer, err = keyutil.GenerateSigner(kt.kty, kt.crv, kt.size)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error generating key")
+	}
+
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		sans = append(sans, u.String())
+	}
+	csr, err := x509util.CreateCertificateRequest(cert.Subject.CommonName, sans, signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &api.RekeyRequest{
+		CsrPEM: api.CertificateRequest{CertificateRequest: csr},
+	}, signer, nil
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		var found bool
+		for _, s := range list {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,346 @@
+package sds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"reflect"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func Test_newSecretRequest(t *testing.T) {
+	profiles, err := newResourceProfiles([]ResourceConfig{
+		{Name: "ingress.smallstep.com", DNSNames: []string{"www.smallstep.com", "ingress.smallstep.com"}, IPAddresses: []string{"10.0.0.1"}, URIs: []string{"spiffe://smallstep.com/ingress"}, KeyType: "RSA-2048", Validity: "48h", Provisioner: "ingress"},
+		{Name: "default", CommonName: "{{.Node.Id}}", URIs: []string{"spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}"}},
+		{Name: "svc", DNSNames: []string{"{{.Node.Metadata.namespace}}.svc.cluster.local", "{{.Node.Locality.Zone}}.{{.Name}}"}},
+		{Name: "node", CommonName: "{{.Node.Id}}"},
+		{Name: "*.smallstep.com", KeyType: "P-384", RenewFraction: 0.5, KeyRotation: "rekey", KeyRotationEvery: 2},
+		{Name: "trusted_ca", DNSNames: []string{"foo.smallstep.com"}, Provisioner: "ingress"},
+	})
+	assert.FatalError(t, err)
+
+	metadata, err := structpb.NewStruct(map[string]interface{}{
+		"namespace": "emojivoto",
+	})
+	assert.FatalError(t, err)
+	node := &core.Node{
+		Id:       "web-1",
+		Cluster:  "web",
+		Locality: &core.Locality{Region: "us-west1", Zone: "us-west1-a"},
+		Metadata: metadata,
+	}
+
+	tests := []struct {
+		name    string
+		node    *core.Node
+		want    *secretRequest
+		wantErr bool
+	}{
+		{"ingress.smallstep.com", node, &secretRequest{
+			Name:        "ingress.smallstep.com",
+			CommonName:  "ingress.smallstep.com",
+			SANs:        []string{"ingress.smallstep.com", "www.smallstep.com", "10.0.0.1", "spiffe://smallstep.com/ingress"},
+			KeyType:     "RSA-2048",
+			Validity:    48 * time.Hour,
+			Provisioner: "ingress",
+		}, false},
+		{"default", node, &secretRequest{
+			Name:       "default",
+			CommonName: "web-1",
+			SANs:       []string{"spiffe://prod/web/web-1"},
+		}, false},
+		{"svc", node, &secretRequest{
+			Name:       "svc",
+			CommonName: "svc",
+			SANs:       []string{"svc", "emojivoto.svc.cluster.local", "us-west1-a.svc"},
+		}, false},
+		{"node", node, &secretRequest{
+			Name:       "node",
+			CommonName: "web-1",
+			SANs:       []string{"web-1"},
+		}, false},
+		{"foo.smallstep.com", nil, &secretRequest{
+			Name:       "foo.smallstep.com",
+			CommonName: "foo.smallstep.com",
+			SANs:       []string{"foo.smallstep.com"},
+			KeyType:    "P-384",
+			Renewal:    renewPolicy{Fraction: 0.5},
+			Rotation:   keyRotation{Method: "rekey", Every: 2},
+		}, false},
+		{"trusted_ca", node, &secretRequest{
+			Name:        "trusted_ca",
+			CommonName:  "trusted_ca",
+			SANs:        []string{"trusted_ca"},
+			Provisioner: "ingress",
+		}, false},
+		{"foo.example.com", node, &secretRequest{
+			Name:       "foo.example.com",
+			CommonName: "foo.example.com",
+			SANs:       []string{"foo.example.com"},
+		}, false},
+		{"svc", &core.Node{Id: "web-1"}, nil, true},
+		{"default", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newSecretRequest(tt.name, tt.node, profiles)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newSecretRequest() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newSecretRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_secretRequest_Key(t *testing.T) {
+	a := &secretRequest{Name: "default", CommonName: "web-1", SANs: []string{"spiffe://prod/web/web-1"}}
+	b := &secretRequest{Name: "default", CommonName: "web-2", SANs: []string{"spiffe://prod/web/web-2"}}
+	c := &secretRequest{Name: "default", CommonName: "web-1", SANs: []string{"spiffe://prod/web/web-1"}}
+	assert.Equals(t, a.Key(), c.Key())
+	assert.NotEquals(t, a.Key(), b.Key())
+	assert.NotEquals(t, a.Key(), (&secretRequest{Name: "default", CommonName: "web-1", SANs: []string{"spiffe://prod/web/web-1"}, KeyType: "P-384"}).Key())
+}
+
+func Test_newResourceProfiles(t *testing.T) {
+	_, err := newResourceProfiles([]ResourceConfig{{Name: "foo", CommonName: "{{.Node.Id"}})
+	assert.Error(t, err)
+	_, err = newResourceProfiles([]ResourceConfig{{Name: "foo", URIs: []string{"spiffe://{{.Node.Id"}}})
+	assert.Error(t, err)
+	_, err = newResourceProfiles([]ResourceConfig{{Name: "foo", Validity: "1d"}})
+	assert.Error(t, err)
+	_, err = newResourceProfiles([]ResourceConfig{{Name: "foo", RenewBefore: "1d"}})
+	assert.Error(t, err)
+
+	profiles, err := newResourceProfiles([]ResourceConfig{{Name: "foo", CommonName: "{{.Node.Id}}", DNSNames: []string{"a", "b"}, URIs: []string{"spiffe://{{.Node.Id}}"}, Validity: "1h", RenewBefore: "10m"}})
+	assert.FatalError(t, err)
+	assert.Len(t, 1, profiles)
+	assert.NotNil(t, profiles[0].commonName)
+	assert.Len(t, 3, profiles[0].sans)
+	assert.Equals(t, time.Hour, profiles[0].validity)
+	assert.Equals(t, renewPolicy{Before: 10 * time.Minute}, profiles[0].renewal)
+}
+
+func Test_newSecretRenewer_profile(t *testing.T) {
+	srv := caServer(60 * time.Second)
+	defer srv.Close()
+
+	p := caProvisioner(srv)
+
+	tests := []struct {
+		name         string
+		req          *secretRequest
+		wantKey      interface{}
+		wantValidity time.Duration
+	}{
+		{"ok default", &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com"}}, &ecdsa.PublicKey{}, 60 * time.Second},
+		{"ok P-384", &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com", "bar.smallstep.com"}, KeyType: "P-384"}, &ecdsa.PublicKey{}, 60 * time.Second},
+		{"ok RSA-2048", &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com", "10.0.0.1"}, KeyType: "RSA-2048", Validity: time.Hour}, &rsa.PublicKey{}, time.Hour},
+		{"ok Ed25519", &secretRequest{Name: "foo.smallstep.com", CommonName: "foo.smallstep.com", SANs: []string{"foo.smallstep.com", "spiffe://smallstep.com/foo"}, KeyType: "Ed25519", Validity: 2 * time.Hour}, ed25519.PublicKey{}, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.req.Token(p)
+			assert.FatalError(t, err)
+			sr, err := newSecretRenewer(context.Background(), []string{token}, tt.req, nil)
+			assert.FatalError(t, err)
+			defer sr.Stop()
+
+			crt := sr.Secrets().Certificates[0].Leaf
+			assert.Type(t, tt.wantKey, crt.PublicKey)
+			if tt.req.KeyType == "P-384" {
+				assert.Equals(t, elliptic.P384(), crt.PublicKey.(*ecdsa.PublicKey).Curve)
+			}
+			assert.Equals(t, tt.wantValidity, crt.NotAfter.Sub(crt.NotBefore).Round(time.Second))
+			assert.Equals(t, "foo.smallstep.com", crt.Subject.CommonName)
+
+			var sans []string
+			sans = append(sans, crt.DNSNames...)
+			for _, ip := range crt.IPAddresses {
+				sans = append(sans, ip.String())
+			}
+			for _, u := range crt.URIs {
+				sans = append(sans, u.String())
+			}
+			assert.Equals(t, tt.req.SANs, sans)
+		})
+	}
+}
+
+func Test_createSignRequest(t *testing.T) {
+	srv := caServer(60 * time.Second)
+	defer srv.Close()
+
+	p := caProvisioner(srv)
+	token, err := p.Token("foo.smallstep.com")
+	assert.FatalError(t, err)
+
+	_, _, err = createSignRequest(token, &secretRequest{KeyType: "DSA"})
+	assert.Error(t, err)
+	_, _, err = createSignRequest("badtoken", &secretRequest{KeyType: "P-256"})
+	assert.Error(t, err)
+
+	req, pk, err := createSignRequest(token, nil)
+	assert.FatalError(t, err)
+	assert.Type(t, &ecdsa.PrivateKey{}, pk)
+	assert.True(t, req.NotAfter.IsZero())
+
+	req, pk, err = createSignRequest(token, &secretRequest{KeyType: "RSA-2048", Validity: time.Hour})
+	assert.FatalError(t, err)
+	assert.Type(t, &rsa.PrivateKey{}, pk)
+	assert.Equals(t, "foo.smallstep.com", req.CsrPEM.Subject.CommonName)
+	assert.Equals(t, []string{"foo.smallstep.com"}, req.CsrPEM.DNSNames)
+	b, err := req.NotAfter.MarshalJSON()
+	assert.FatalError(t, err)
+	assert.Equals(t, `"1h0m0s"`, string(b))
+}
+
+func Test_createRekeyRequest(t *testing.T) {
+	cert := storeCertificate(t, "foo.smallstep.com", time.Hour)
+
+	_, _, err := createRekeyRequest(cert.Leaf, &secretRequest{KeyType: "DSA"})
+	assert.Error(t, err)
+
+	req, pk, err := createRekeyRequest(cert.Leaf, nil)
+	assert.FatalError(t, err)
+	assert.Type(t, &ecdsa.PrivateKey{}, pk)
+	assert.NotEquals(t, cert.PrivateKey, pk)
+
+	req, pk, err = createRekeyRequest(cert.Leaf, &secretRequest{KeyType: "Ed25519"})
+	assert.FatalError(t, err)
+	assert.Type(t, ed25519.PrivateKey{}, pk)
+	assert.Equals(t, "foo.smallstep.com", req.CsrPEM.Subject.CommonName)
+	assert.Equals(t, []string{"foo.smallstep.com"}, req.CsrPEM.DNSNames)
+	assert.FatalError(t, req.Validate())
+}
+
+func TestService_newRenewer(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	p := ProvisionerConfig{
+		Issuer:   "sds@smallstep.com",
+		KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+		Password: "password",
+		CaURL:    ca.URL,
+		CaRoot:   "testdata/root_ca.crt",
+	}
+	ingress := p
+	ingress.Name = "ingress"
+
+	srv, err := New(Config{
+		Provisioner:  p,
+		Provisioners: []ProvisionerConfig{ingress},
+		Resources: []ResourceConfig{
+			{Name: "ingress.smallstep.com", DNSNames: []string{"www.smallstep.com"}, KeyType: "RSA-2048", Provisioner: "ingress"},
+			{Name: "missing.smallstep.com", Provisioner: "missing"},
+			{Name: "default", CommonName: "{{.Node.Id}}", URIs: []string{"spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}"}},
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	assert.Len(t, 2, srv.getConfig().provisioners)
+
+	newRenewer := func(name string, node *core.Node) (*secretRenewer, error) {
+		req, err := srv.newSecretRequest(name, node)
+		if err != nil {
+			return nil, err
+		}
+		return srv.newRenewer(context.Background(), req)
+	}
+
+	sr, err := newRenewer("ingress.smallstep.com", nil)
+	assert.FatalError(t, err)
+	defer sr.Stop()
+	crt := sr.Secrets().Certificates[0].Leaf
+	assert.Type(t, &rsa.PublicKey{}, crt.PublicKey)
+	assert.Equals(t, []string{"ingress.smallstep.com", "www.smallstep.com"}, crt.DNSNames)
+
+	sr, err = newRenewer("foo.smallstep.com", nil)
+	assert.FatalError(t, err)
+	defer sr.Stop()
+	crt = sr.Secrets().Certificates[0].Leaf
+	assert.Type(t, &ecdsa.PublicKey{}, crt.PublicKey)
+	assert.Equals(t, []string{"foo.smallstep.com"}, crt.DNSNames)
+
+	sr, err = newRenewer("default", &core.Node{Id: "web-1", Cluster: "web"})
+	assert.FatalError(t, err)
+	defer sr.Stop()
+	crt = sr.Secrets().Certificates[0].Leaf
+	assert.Equals(t, "web-1", crt.Subject.CommonName)
+	assert.Len(t, 0, crt.DNSNames)
+	assert.Len(t, 1, crt.URIs)
+	assert.Equals(t, "spiffe://prod/web/web-1", crt.URIs[0].String())
+
+	_, err = newRenewer("missing.smallstep.com", nil)
+	assert.Error(t, err)
+	_, err = newRenewer("default", nil)
+	assert.Equals(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestService_fetchSecrets_template(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Resources: []ResourceConfig{
+			{Name: "default", CommonName: "{{.Node.Id}}", URIs: []string{"spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}"}},
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	fetch := func(node *core.Node) *auth.Secret {
+		t.Helper()
+		dr, err := srv.fetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"default"},
+			TypeUrl:       secretTypeURL,
+		})
+		assert.FatalError(t, err)
+		assert.Len(t, 1, dr.Resources)
+		var sec auth.Secret
+		assert.FatalError(t, proto.Unmarshal(dr.Resources[0].Value, &sec))
+		assert.Equals(t, "default", sec.Name)
+		return &sec
+	}
+
+	// The same resource name yields a certificate for each node
+	web1 := fetch(&core.Node{Id: "web-1", Cluster: "web"})
+	web2 := fetch(&core.Node{Id: "web-2", Cluster: "web"})
+	assert.False(t, proto.Equal(web1, web2))
+	assert.True(t, proto.Equal(web1, fetch(&core.Node{Id: "web-1", Cluster: "web"})))
+	srv.cache.m.Lock()
+	assert.Len(t, 2, srv.cache.entries)
+	srv.cache.m.Unlock()
+
+	// Missing node fails
+	_, err = srv.fetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+		ResourceNames: []string{"default"},
+		TypeUrl:       secretTypeURL,
+	})
+	assert.Equals(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,170 @@
+package sds
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/step-sds/logging"
+	"go.step.sm/crypto/pemutil"
+	"go.step.sm/crypto/x509util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ProvisionerRetryInterval is the interval used to retry the initialization of
+// the provisioners whose CA was not reachable.
+var ProvisionerRetryInterval = 10 * time.Second
+
+// provisioner is a CA provisioner that can be initialized after the service
+// starts. The service starts without the CA, serving the secrets in the state
+// directory, and the provisioners are initialized once the CA is reachable.
+type provisioner struct {
+	m            sync.RWMutex
+	config       ProvisionerConfig
+	fingerprints map[string]bool
+	p            *ca.Provisioner
+	err          error
+}
+
+// newProvisioner initializes the provisioner in the given configuration. If
+// the CA is not reachable, the error is kept and the provisioner must be
+// initialized later using Init. Other errors, like a wrong password or a root
+// file that cannot be read, are returned.
+func newProvisioner(c ProvisionerConfig) (*provisioner, error) {
+	roots, err := pemutil.ReadCertificateBundle(c.CaRoot)
+	if err != nil {
+		return nil, err
+	}
+	p := &provisioner{
+		config:       c,
+		fingerprints: make(map[string]bool, len(roots)),
+	}
+	for _, root := range roots {
+		p.fingerprints[x509util.Fingerprint(root)] = true
+	}
+	if err := p.Init(); err != nil && !isCAUnavailable(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Name returns the name of the provisioner in the CA.
+func (p *provisioner) Name() string {
+	return p.config.Issuer
+}
+
+// Init initializes the provisioner if it's not ready yet.
+func (p *provisioner) Init() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.p != nil {
+		return nil
+	}
+	cp, err := ca.NewProvisioner(
+		p.config.Issuer, p.config.KeyID,
+		p.config.CaURL, []byte(p.config.Password),
+		ca.WithRootFile(p.config.CaRoot))
+	if err != nil {
+		p.err = err
+		return err
+	}
+	p.p, p.err = cp, nil
+	return nil
+}
+
+// Get returns the CA provisioner, or an Unavailable error if it has not been
+// initialized yet.
+func (p *provisioner) Get() (*ca.Provisioner, error) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	if p.p == nil {
+		return nil, status.Errorf(codes.Unavailable, "provisioner %s is not available: %v", p.Name(), p.err)
+	}
+	return p.p, nil
+}
+
+// Err returns the last error initializing the provisioner.
+func (p *provisioner) Err() error {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.err
+}
+
+// Trusts returns if the given roots contain one of the roots of the
+// provisioner.
+func (p *provisioner) Trusts(roots []*x509.Certificate) bool {
+	for _, root := range roots {
+		if p.fingerprints[x509util.Fingerprint(root)] {
+			return true
+		}
+	}
+	return false
+}
+
+// retryProvisioners initializes the provisioners whose CA was not reachable,
+// it runs until the service is stopped.
+func (srv *Service) retryProvisioners() {
+	ticker := time.NewTicker(ProvisionerRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-srv.stopCh:
+			return
+		}
+		for _, p := range srv.getConfig().provisioners {
+			prev := p.Err()
+			if prev == nil {
+				continue
+			}
+			// Errors are logged only when they change
+			if err := p.Init(); err != nil {
+				if err.Error() != prev.Error() {
+					srv.logger.WithError(err).WithField("provisioner", p.Name()).Warn("Error initializing provisioner")
+				}
+				continue
+			}
+			srv.logger.WithField("provisioner", p.Name()).Info("Provisioner initialized")
+		}
+	}
+}
+
+// logDegraded logs the provisioners that could not be initialized because
+// their CA is not reachable, and returns if there are any.
+func logDegraded(sc *serviceConfig, logger *logging.Logger) bool {
+	var degraded bool
+	for _, p := range sc.provisioners {
+		if err := p.Err(); err != nil {
+			logger.WithError(err).WithFields(logging.Fields{
+				"provisioner": p.Name(),
+				"retry.every": ProvisionerRetryInterval.String(),
+			}).Warn("CA is not reachable, running in degraded mode")
+			degraded = true
+		}
+	}
+	return degraded
+}
+
+// isCAUnavailable returns if the given error is caused by a CA that cannot be
+// reached or that is failing, instead of by the configuration.
+func isCAUnavailable(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var statusErr interface{ StatusCode() int }
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return true
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode() >= 500
+	default:
+		return false
+	}
+}
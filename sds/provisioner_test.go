@@ -0,0 +1,227 @@
+package sds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/errs"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// caProxy forwards the connections on a fixed address to a test CA. The
+// proxy can be stopped to simulate a CA outage and started again on the same
+// address.
+type caProxy struct {
+	m      sync.Mutex
+	addr   string
+	target string
+	lis    net.Listener
+}
+
+func newCAProxy(t *testing.T, target *httptest.Server) *caProxy {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	p := &caProxy{
+		addr:   lis.Addr().String(),
+		target: target.Listener.Addr().String(),
+	}
+	assert.FatalError(t, lis.Close())
+	t.Cleanup(p.Stop)
+	return p
+}
+
+// URL returns the URL of the CA using the proxy.
+func (p *caProxy) URL() string {
+	return "https://" + p.addr
+}
+
+func (p *caProxy) Start(t *testing.T) {
+	t.Helper()
+	lis, err := net.Listen("tcp", p.addr)
+	assert.FatalError(t, err)
+	p.m.Lock()
+	p.lis = lis
+	p.m.Unlock()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", p.target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+}
+
+func (p *caProxy) Stop() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.lis != nil {
+		p.lis.Close()
+		p.lis = nil
+	}
+}
+
+func Test_isCAUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", fmt.Errorf("client GET failed: %w", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "ca.smallstep.com"}, true},
+		{"timeout", fmt.Errorf("client GET failed: %w", context.DeadlineExceeded), true},
+		{"server error", &errs.Error{Status: http.StatusServiceUnavailable}, true},
+		{"client error", &errs.Error{Status: http.StatusNotFound}, false},
+		{"password", errors.New("error decrypting provisioner key with provided password"), false},
+		{"root", os.ErrNotExist, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, isCAUnavailable(tt.err))
+		})
+	}
+}
+
+func Test_newProvisioner(t *testing.T) {
+	ca := caServer(time.Hour)
+	defer ca.Close()
+	proxy := newCAProxy(t, ca)
+
+	pc := ProvisionerConfig{
+		Issuer:   "sds@smallstep.com",
+		KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+		Password: "password",
+		CaURL:    proxy.URL(),
+		CaRoot:   "testdata/root_ca.crt",
+	}
+
+	// The CA is not reachable
+	p, err := newProvisioner(pc)
+	assert.FatalError(t, err)
+	assert.Equals(t, "sds@smallstep.com", p.Name())
+	assert.Error(t, p.Err())
+	_, err = p.Get()
+	assert.Equals(t, codes.Unavailable, status.Code(err))
+	assert.True(t, p.Trusts(rootCAs(t)))
+	assert.False(t, p.Trusts(nil))
+
+	// The CA is back
+	proxy.Start(t)
+	assert.FatalError(t, p.Init())
+	assert.Nil(t, p.Err())
+	cp, err := p.Get()
+	assert.FatalError(t, err)
+	assert.Equals(t, "sds@smallstep.com", cp.Name())
+	assert.FatalError(t, p.Init())
+
+	// Configuration errors are not retried
+	bad := pc
+	bad.Password = "bad"
+	_, err = newProvisioner(bad)
+	assert.Error(t, err)
+	bad = pc
+	bad.CaRoot = "testdata/missing.crt"
+	_, err = newProvisioner(bad)
+	assert.Error(t, err)
+}
+
+func TestService_degraded(t *testing.T) {
+	tmp := ProvisionerRetryInterval
+	t.Cleanup(func() {
+		ProvisionerRetryInterval = tmp
+	})
+	ProvisionerRetryInterval = 10 * time.Millisecond
+
+	ca := caServer(time.Hour)
+	defer ca.Close()
+	proxy := newCAProxy(t, ca)
+	proxy.Start(t)
+
+	config := Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    proxy.URL(),
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		State: &StateConfig{
+			Directory: t.TempDir(),
+		},
+		Logger: []byte("{}"),
+	}
+	request := func(names ...string) *discovery.DiscoveryRequest {
+		return &discovery.DiscoveryRequest{
+			ResourceNames: names,
+			TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		}
+	}
+	caStatus := func(srv *Service) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := srv.health.server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: CAHealthService})
+		assert.FatalError(t, err)
+		return resp.Status
+	}
+
+	// Store the secrets
+	srv, err := New(config)
+	assert.FatalError(t, err)
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_SERVING, caStatus(srv))
+	_, err = srv.FetchSecrets(context.Background(), request("foo.smallstep.com", "trusted_ca"))
+	assert.FatalError(t, err)
+	srv.Stop()
+
+	// Start without the CA
+	proxy.Stop()
+	srv, err = New(config)
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_NOT_SERVING, caStatus(srv))
+	assert.True(t, srv.health.degraded)
+
+	// Stored secrets are served, new ones are not available
+	_, err = srv.FetchSecrets(context.Background(), request("foo.smallstep.com", "trusted_ca"))
+	assert.FatalError(t, err)
+	_, err = srv.FetchSecrets(context.Background(), request("bar.smallstep.com"))
+	assert.Equals(t, codes.Unavailable, status.Code(err))
+
+	// The provisioner is initialized when the CA is back
+	proxy.Start(t)
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.getConfig().provisioner.Err() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the provisioner")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.checkHealth()
+	assert.Equals(t, healthpb.HealthCheckResponse_SERVING, caStatus(srv))
+	assert.False(t, srv.health.degraded)
+	_, err = srv.FetchSecrets(context.Background(), request("bar.smallstep.com"))
+	assert.FatalError(t, err)
+}
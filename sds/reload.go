@@ -0,0 +1,94 @@
+package sds
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// Reload validates the given configuration and applies the new provisioners,
+// resource profiles, authorization settings, logger options, and TLS material.
+// The listeners, networks and addresses, including the admin API, cannot
+// change without a restart. All the settings are applied at once, if the
+// configuration is not valid the current one is kept. The tracing and state
+// settings are only applied on start.
+//
+// The existing streams are not interrupted. The secrets already served keep
+// being renewed with their current parameters, new settings are used for the
+// new resource names requested. The server certificates are only signed again
+// if the TLS settings of their listener change. The secrets signed in advance
+// for the profiles changed or removed are released, and the new ones are
+// signed in the next health check.
+func (srv *Service) Reload(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if !slices.Equal(listenAddresses(c), srv.addresses) {
+		return errors.New("listeners, network, address, restAddress, metricsAddress and admin cannot be changed without a restart")
+	}
+
+	sc, err := newServiceConfig(c, srv.getConfig(), srv.logger)
+	if err != nil {
+		return err
+	}
+	warm, err := staticRequests(sc)
+	if err != nil {
+		return err
+	}
+
+	srv.m.Lock()
+	defer srv.m.Unlock()
+
+	sources := make(map[string]*tlsSource, len(srv.tlsReloaders))
+	stopSources := func() {
+		for _, source := range sources {
+			source.Stop()
+		}
+	}
+	listeners := c.GetListeners()
+	if admin, ok := c.GetAdmin(); ok {
+		listeners = append(listeners, admin)
+	}
+	for _, l := range listeners {
+		// The current source is kept if its TLS settings have not changed
+		reloader, ok := srv.tlsReloaders[l.Name]
+		if !ok || reloader.getSource().sameConfig(l) {
+			continue
+		}
+		source, err := newTLSSource(srv.tlsRenewer(sc), l, srv.logger)
+		if err != nil {
+			stopSources()
+			return err
+		}
+		sources[l.Name] = source
+	}
+
+	if err := srv.logger.Reload(c.Logger); err != nil {
+		stopSources()
+		return err
+	}
+
+	srv.config.Store(sc)
+	for name, source := range sources {
+		srv.tlsReloaders[name].setSource(source)
+	}
+	srv.releaseWarmed(warm)
+	return nil
+}
+
+// listenAddresses returns the name, network and addresses of all the
+// listeners in the given configuration, including the REST, metrics and admin
+// servers.
+func listenAddresses(c Config) []string {
+	addresses := []string{"tcp://" + c.MetricsAddress}
+	if rest, ok := c.GetREST(); ok {
+		addresses = append(addresses, rest.Name+"="+rest.Network+"://"+rest.Address)
+	}
+	for _, l := range c.GetListeners() {
+		addresses = append(addresses, l.Name+"="+l.Network+"://"+l.Address)
+	}
+	if admin, ok := c.GetAdmin(); ok {
+		addresses = append(addresses, admin.Name+"="+admin.Network+"://"+admin.Address)
+	}
+	return addresses
+}
@@ -0,0 +1,270 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestService_Reload(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	c := Config{
+		Network: "unix",
+		Address: "/tmp/sds.unix",
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	}
+	srv, err := New(c)
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+	defer s.Stop()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.FatalError(t, err)
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	request := func(names ...string) *discovery.DiscoveryRequest {
+		return &discovery.DiscoveryRequest{
+			Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+			ResourceNames: names,
+			TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+		}
+	}
+
+	// Open a stream before the reload
+	stream, err := client.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	assert.FatalError(t, stream.Send(request("foo.smallstep.com")))
+	first, err := stream.Recv()
+	assert.FatalError(t, err)
+
+	// Invalid configurations are rejected and the current one is kept
+	current := srv.getConfig()
+	bad := c
+	bad.Authorization = []AuthorizationRule{{Identities: []string{"envoy"}}}
+	assert.Error(t, srv.Reload(bad))
+	bad = c
+	bad.Address = "/tmp/other.unix"
+	assert.Error(t, srv.Reload(bad))
+	bad = c
+	bad.Listeners = []ListenerConfig{{Name: "gateway", Network: "unix", Address: "/tmp/gateway.unix"}}
+	assert.Error(t, srv.Reload(bad))
+	bad = c
+	bad.Admin = &ListenerConfig{Network: "unix", Address: "/tmp/admin.unix"}
+	assert.Error(t, srv.Reload(bad))
+	bad = c
+	bad.Logger = []byte(`{"format": "xml"}`)
+	bad.Authorization = []AuthorizationRule{{Resources: []string{"foo.smallstep.com"}}}
+	assert.Error(t, srv.Reload(bad))
+	assert.True(t, current == srv.getConfig())
+	_, ok := srv.logger.Formatter.(*logrus.TextFormatter)
+	assert.True(t, ok)
+
+	// Apply a new authorization policy and logger
+	reload := c
+	reload.Authorization = []AuthorizationRule{{Resources: []string{"foo.smallstep.com"}}}
+	reload.Logger = []byte(`{"format": "json", "timeFormat": "2006-01-02"}`)
+	assert.FatalError(t, srv.Reload(reload))
+	assert.False(t, current == srv.getConfig())
+	_, ok = srv.logger.Formatter.(*logrus.JSONFormatter)
+	assert.True(t, ok)
+	assert.Equals(t, "2006-01-02", srv.logger.GetTimeFormat())
+
+	_, err = client.FetchSecrets(context.Background(), request("foo.smallstep.com"))
+	assert.FatalError(t, err)
+	_, err = client.FetchSecrets(context.Background(), request("bar.smallstep.com"))
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+
+	// The existing stream is still up and uses the new policy
+	assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+		VersionInfo:   first.VersionInfo,
+		ResourceNames: []string{"foo.smallstep.com", "bar.smallstep.com"},
+		TypeUrl:       first.TypeUrl,
+		ResponseNonce: first.Nonce,
+	}))
+	_, err = stream.Recv()
+	assert.Equals(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestService_Reload_tls(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	dir := t.TempDir()
+	crtFile, keyFile, rootFile := writeTLSFiles(t, dir, "sds.smallstep.com", testRootCA)
+	c := Config{
+		Network:        "tcp",
+		Address:        ":8443",
+		Root:           rootFile,
+		Certificate:    crtFile,
+		CertificateKey: keyFile,
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		State: &StateConfig{
+			Directory: t.TempDir(),
+		},
+		Logger: []byte("{}"),
+	}
+	srv, err := New(c)
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	r, err := srv.NewTLSReloader(c.GetListeners()[0])
+	assert.FatalError(t, err)
+	defer r.Stop()
+
+	cert, err := r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "sds.smallstep.com", cert.Leaf.Subject.CommonName)
+
+	// Missing files are rejected and the current certificate is kept
+	bad := c
+	bad.Certificate = filepath.Join(dir, "missing.crt")
+	assert.Error(t, srv.Reload(bad))
+	got, err := r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.True(t, got == cert)
+
+	// Switch to a certificate signed by the CA
+	reload := c
+	reload.Certificate, reload.CertificateKey = "", ""
+	reload.ServerCertificate = &ServerCertificateConfig{CommonName: "new.smallstep.com"}
+	assert.FatalError(t, srv.Reload(reload))
+	got, err = r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "new.smallstep.com", got.Leaf.Subject.CommonName)
+	stored, err := filepath.Glob(filepath.Join(c.State.Directory, "*"))
+	assert.FatalError(t, err)
+	assert.Len(t, 1, stored)
+
+	// The certificate is kept if the settings do not change
+	source := r.getSource()
+	reload.ServerCertificate = &ServerCertificateConfig{CommonName: "new.smallstep.com"}
+	reload.Authorization = []AuthorizationRule{{Resources: []string{"foo.smallstep.com"}}}
+	assert.FatalError(t, srv.Reload(reload))
+	assert.True(t, source == r.getSource())
+	cert, err = r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.True(t, got == cert)
+
+	// A new certificate replaces the stored one
+	reload.ServerCertificate = &ServerCertificateConfig{CommonName: "other.smallstep.com"}
+	assert.FatalError(t, srv.Reload(reload))
+	got, err = r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "other.smallstep.com", got.Leaf.Subject.CommonName)
+	files, err := filepath.Glob(filepath.Join(c.State.Directory, "*"))
+	assert.FatalError(t, err)
+	assert.Len(t, 1, files)
+	assert.NotEquals(t, stored, files)
+}
+
+func TestService_Reload_warm(t *testing.T) {
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 0
+
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	c := Config{
+		Network: "unix",
+		Address: "/tmp/sds.unix",
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Resources: []ResourceConfig{
+			{Name: "static.smallstep.com", KeyType: "P-256"},
+		},
+		Logger: []byte("{}"),
+	}
+	srv, err := New(c)
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	entries := func() []*cacheEntry {
+		srv.cache.m.Lock()
+		defer srv.cache.m.Unlock()
+		var list []*cacheEntry
+		for _, e := range srv.cache.entries {
+			list = append(list, e)
+		}
+		return list
+	}
+
+	srv.checkHealth()
+	list := entries()
+	assert.Len(t, 1, list)
+	assert.Equals(t, "P-256", list[0].request.KeyType)
+
+	// Changed profiles are signed again and the old secrets released
+	reload := c
+	reload.Resources = []ResourceConfig{
+		{Name: "static.smallstep.com", KeyType: "P-384"},
+	}
+	assert.FatalError(t, srv.Reload(reload))
+	assert.Len(t, 0, entries())
+	srv.checkHealth()
+	list = entries()
+	assert.Len(t, 1, list)
+	assert.Equals(t, "P-384", list[0].request.KeyType)
+	assert.Equals(t, 1, list[0].refs)
+
+	// Unchanged profiles are kept
+	assert.FatalError(t, srv.Reload(reload))
+	srv.checkHealth()
+	assert.Equals(t, list, entries())
+
+	// Removed profiles are released
+	reload.Resources = nil
+	assert.FatalError(t, srv.Reload(reload))
+	srv.checkHealth()
+	assert.Len(t, 0, entries())
+}
@@ -1,9 +1,11 @@
 package sds
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"sync"
@@ -12,6 +14,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/api"
 	"github.com/smallstep/certificates/ca"
+	"github.com/smallstep/step-sds/logging"
+	"go.opentelemetry.io/otel/attribute"
 	"go.step.sm/crypto/jose"
 	"golang.org/x/net/http2"
 )
@@ -22,35 +26,154 @@ type secrets struct {
 }
 
 type secretRenewer struct {
-	m            sync.RWMutex
+	m sync.RWMutex
+	// renewing serializes the renewals. The requests to the CA are done
+	// holding only this lock, so the secrets can be read while the CA is slow
+	// or unreachable. The secrets and their schedule are modified holding both
+	// locks, so they can be read holding any of them.
+	renewing     sync.Mutex
+	name         string
 	client       *ca.Client
 	roots        []*x509.Certificate
 	certificates []*tls.Certificate
 	transports   []*http.Transport
 	timer        *time.Timer
-	renewPeriod  time.Duration
+	request      *secretRequest
+	newToken     func(context.Context) (string, error)
+	policy       renewPolicy
+	rotation     keyRotation
+	renewAt      []time.Time
+	renewals     []int
+	rootsAt      time.Time
 	renewCh      chan secrets
+	stopped      bool
+	logger       *logging.Logger
+	store        *stateStore
+	storeKey     string
+	lastRenewal  time.Time
+	nextRenewal  time.Time
+	lastError    error
+	failures     int
 }
 
-func newSecretRenewer(tokens []string) (*secretRenewer, error) {
+// renewal contains the secrets and the schedule that replace the ones of a
+// renewer after a successful renewal.
+type renewal struct {
+	roots        []*x509.Certificate
+	certificates []*tls.Certificate
+	transports   []*http.Transport
+	renewAt      []time.Time
+	renewals     []int
+	rootsAt      time.Time
+}
+
+// renewerStatus is the state of the renewals of a secret. RenewAt contains
+// the time to renew each certificate, and Failures the number of consecutive
+// failed renewals.
+type renewerStatus struct {
+	LastRenewal time.Time
+	NextRenewal time.Time
+	RenewAt     []time.Time
+	LastError   error
+	Failures    int
+}
+
+// renewPolicy defines when a certificate is renewed, after a fraction of its
+// lifetime or a time before it expires. The zero value renews certificates
+// after DefaultRenewFraction of their lifetime.
+type renewPolicy struct {
+	Fraction float64
+	Before   time.Duration
+}
+
+// RenewAt returns the time to renew the given certificate, signed at the given
+// time. A random jitter of up to RenewJitter of the time between the issuance
+// and the renewal is subtracted from it, and certificates are never renewed
+// before a tenth of their lifetime has passed since they were signed.
+func (p renewPolicy) RenewAt(cert *x509.Certificate, signedAt time.Time) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	var d time.Duration
+	switch {
+	case p.Before > 0:
+		d = lifetime - p.Before
+	case p.Fraction > 0:
+		d = time.Duration(float64(lifetime) * p.Fraction)
+	default:
+		d = time.Duration(float64(lifetime) * DefaultRenewFraction)
+	}
+	renewAt := cert.NotBefore.Add(jitter(d))
+	if earliest := signedAt.Add(lifetime / 10); renewAt.Before(earliest) {
+		return earliest
+	}
+	return renewAt
+}
+
+// Key rotation methods.
+const (
+	keyRotationRekey = "rekey"
+	keyRotationSign  = "sign"
+)
+
+// keyRotation defines if and how the private key of a certificate is replaced
+// on renewals, using the rekey endpoint of the CA or signing a new certificate
+// with a new token. The key is rotated every given number of renewals, or on
+// every renewal if it's not set. The zero value keeps the key.
+type keyRotation struct {
+	Method string
+	Every  int
+}
+
+// Rotate returns if the key must be rotated on the next renewal, after the
+// given number of renewals with the same key.
+func (k keyRotation) Rotate(renewals int) bool {
+	return k.Method != "" && renewals+1 >= max(k.Every, 1)
+}
+
+// jitter subtracts a random duration of up to RenewJitter of d from d.
+func jitter(d time.Duration) time.Duration {
+	if n := time.Duration(float64(d) * RenewJitter); n > 0 {
+		return d - rand.N(n)
+	}
+	return d
+}
+
+// newSecretRenewer creates a new renewer that signs a certificate for each
+// token. The key type and validity of the certificates are defined by the given
+// secret request, if it's nil the CA defaults will be used, and so does the
+// renew policy of each certificate. Renewal errors are logged in the given
+// logger if it's not nil. The requests to the CA are traced as children of the
+// span in the given context.
+func newSecretRenewer(ctx context.Context, tokens []string, req *secretRequest, logger *logging.Logger) (s *secretRenewer, err error) {
 	if len(tokens) == 0 {
 		return nil, errors.New("missing tokens")
 	}
+	defer func(start time.Time) {
+		observeCertificate("issue", start, err)
+	}(time.Now())
 
-	client, err := ca.Bootstrap(tokens[0])
+	t0 := time.Now()
+	client, err := bootstrap(ctx, tokens[0])
+	observeCA("bootstrap", t0, err)
 	if err != nil {
 		return nil, err
 	}
 
-	roots, err := client.Roots()
+	t0 = time.Now()
+	roots, err := getRoots(ctx, client)
+	observeCA("roots", t0, err)
 	if err != nil {
 		return nil, err
 	}
 
-	s := &secretRenewer{
+	s = &secretRenewer{
 		roots:   apiCertToX509(roots.Certificates),
 		client:  client,
-		renewCh: make(chan secrets),
+		request: req,
+		renewCh: make(chan secrets, 1),
+		logger:  logger,
+	}
+	if req != nil {
+		s.policy, s.rotation = req.Renewal, req.Rotation
 	}
 
 	for _, tok := range tokens {
@@ -58,30 +181,146 @@ func newSecretRenewer(tokens []string) (*secretRenewer, error) {
 		if err != nil {
 			return nil, err
 		}
+		if s.name == "" {
+			s.name = subject
+		}
 
 		if !isValidationContext(subject) {
-			cert, tr, err := s.sign(tok)
+			cert, tr, err := s.sign(ctx, tok, req, s.roots)
 			if err != nil {
 				return nil, err
 			}
 			s.certificates = append(s.certificates, cert)
 			s.transports = append(s.transports, tr)
+			s.renewAt = append(s.renewAt, s.policy.RenewAt(cert.Leaf, time.Now()))
+			s.renewals = append(s.renewals, 0)
 		}
 	}
-	if len(s.certificates) > 0 {
-		validity := s.certificates[0].Leaf.NotAfter.Sub(s.certificates[0].Leaf.NotBefore)
-		s.renewPeriod = validity / 3
-	} else {
-		s.renewPeriod = ValidationContextRenewPeriod
+
+	// Initialize renewer
+	s.rootsAt = time.Now().Add(jitter(ValidationContextRenewPeriod))
+	s.nextRenewal = s.next()
+	s.timer = time.AfterFunc(max(time.Until(s.nextRenewal), 0), s.doRenew)
+	return s, nil
+}
+
+// newStoredSecretRenewer creates a renewer for the secrets loaded from the
+// given state store with the given cache key. The CA is not contacted until
+// the first renewal, that is scheduled using the renew policy of the given
+// request, or immediately if that time has passed. The given client must trust
+// the stored roots. Renewals are written in the store. The renewals counted
+// for the key rotation start at zero.
+func newStoredSecretRenewer(client *ca.Client, store *stateStore, key string, stored *storedSecrets, req *secretRequest, logger *logging.Logger) (*secretRenewer, error) {
+	s := &secretRenewer{
+		name:     stored.Name,
+		roots:    stored.Roots,
+		client:   client,
+		renewCh:  make(chan secrets, 1),
+		request:  req,
+		logger:   logger,
+		store:    store,
+		storeKey: key,
+	}
+	if req != nil {
+		s.policy, s.rotation = req.Renewal, req.Rotation
+	}
+	for _, cert := range stored.Certificates {
+		tr, err := newTransport(cert, &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}, s.roots)
+		if err != nil {
+			return nil, err
+		}
+		s.certificates = append(s.certificates, cert)
+		s.transports = append(s.transports, tr)
+		s.renewAt = append(s.renewAt, s.policy.RenewAt(cert.Leaf, cert.Leaf.NotBefore))
+		s.renewals = append(s.renewals, 0)
 	}
 
 	// Initialize renewer
-	s.timer = time.AfterFunc(s.renewPeriod, s.doRenew)
+	s.rootsAt = stored.UpdatedAt.Add(jitter(ValidationContextRenewPeriod))
+	s.nextRenewal = s.next()
+	s.timer = time.AfterFunc(max(time.Until(s.nextRenewal), 0), s.doRenew)
 	return s, nil
 }
 
-// Stop stops the renewer
+// next returns the time of the next renewal, the earliest of the renewals of
+// the certificates and the roots.
+func (s *secretRenewer) next() time.Time {
+	next := s.rootsAt
+	for _, t := range s.renewAt {
+		if t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// schedule sets the timer to the next renewal. It must be called with the
+// lock held.
+func (s *secretRenewer) schedule() {
+	s.nextRenewal = s.next()
+	s.timer.Reset(max(time.Until(s.nextRenewal), 0))
+}
+
+// retryPeriod returns the time to wait to retry a failed renewal, a twentieth
+// of the time between the issuance and the renewal of the certificates due, or
+// of all of them if force is true, or of ValidationContextRenewPeriod if there
+// are none. It must be called with the lock held.
+func (s *secretRenewer) retryPeriod(now time.Time, force bool) time.Duration {
+	var retry time.Duration
+	for i, t := range s.renewAt {
+		if !force && t.After(now) {
+			continue
+		}
+		if d := t.Sub(s.certificates[i].Leaf.NotBefore) / 20; retry == 0 || d < retry {
+			retry = d
+		}
+	}
+	if retry <= 0 {
+		retry = ValidationContextRenewPeriod / 20
+	}
+	return retry
+}
+
+// backoff returns the time to wait to retry a failed renewal. The first retry
+// waits the retry period, and the time doubles with each consecutive failure
+// up to RenewBackoffMax, with a random jitter. Retries are not scheduled after
+// the expiration of a certificate, so it can be signed again as soon as it
+// expires. It must be called with the lock held.
+func (s *secretRenewer) backoff(now time.Time, force bool) time.Duration {
+	retry := s.retryPeriod(now, force)
+	for i := 1; i < s.failures && retry < RenewBackoffMax; i++ {
+		retry *= 2
+	}
+	retry = jitter(min(retry, RenewBackoffMax))
+	for _, cert := range s.certificates {
+		if d := cert.Leaf.NotAfter.Sub(now); d > 0 && d < retry {
+			retry = d
+		}
+	}
+	return retry
+}
+
+// expired returns the first certificate that has expired, or nil if there are
+// none. It must be called with the lock held.
+func (s *secretRenewer) expired(now time.Time) *x509.Certificate {
+	for _, cert := range s.certificates {
+		if !now.Before(cert.Leaf.NotAfter) {
+			return cert.Leaf
+		}
+	}
+	return nil
+}
+
+// Stop stops the renewer and closes the renew channel.
 func (s *secretRenewer) Stop() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
 	s.timer.Stop()
 	close(s.renewCh)
 }
@@ -96,92 +335,310 @@ func (s *secretRenewer) Secrets() secrets {
 	}
 }
 
+// Store writes the current secrets in the given state store using the given
+// cache key, and keeps them up to date on each renewal.
+func (s *secretRenewer) Store(store *stateStore, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.store, s.storeKey = store, key
+	return store.Save(key, s.name, secrets{Roots: s.roots, Certificates: s.certificates})
+}
+
+// Forget stops the renewer and removes its secrets from the state store.
+func (s *secretRenewer) Forget() {
+	s.Stop()
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.store != nil {
+		if err := s.store.Delete(s.storeKey); err != nil && s.logger != nil {
+			s.logger.WithError(err).WithField("resourceName", s.name).Warn("Error deleting stored certificate")
+		}
+	}
+}
+
+// SetTokenSource sets the function used to get new tokens to sign the
+// certificates again, when they have expired or the renewals have failed
+// RenewMaxFailures times in a row. Without it, renewals are retried until they
+// succeed.
+func (s *secretRenewer) SetTokenSource(fn func(context.Context) (string, error)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.newToken = fn
+}
+
 // RenewChannel returns the channel that will receive all the certificates.
 func (s *secretRenewer) RenewChannel() chan secrets {
 	return s.renewCh
 }
 
+// Status returns the state of the renewals.
+func (s *secretRenewer) Status() renewerStatus {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return renewerStatus{
+		LastRenewal: s.lastRenewal,
+		NextRenewal: s.nextRenewal,
+		RenewAt:     append([]time.Time(nil), s.renewAt...),
+		LastError:   s.lastError,
+		Failures:    s.failures,
+	}
+}
+
+// doRenew renews the secrets that are due. The renewal is canceled if it
+// takes more than RenewTimeout.
 func (s *secretRenewer) doRenew() {
-	if err := s.renew(); err != nil {
-		s.timer.Reset(s.renewPeriod / 20)
-		return
+	ctx, cancel := context.WithTimeout(context.Background(), RenewTimeout)
+	defer cancel()
+	_ = s.renewSecrets(ctx, false)
+}
+
+// Renew renews the roots and all the certificates immediately and sends them
+// to the renew channel.
+func (s *secretRenewer) Renew(ctx context.Context) error {
+	return s.renewSecrets(ctx, true)
+}
+
+// renewSecrets renews the roots and the certificates that are due, or all of
+// them if force is true, and sends them to the renew channel. If the renewal
+// fails, it is retried with an exponential backoff, otherwise the next renewal
+// of each certificate is scheduled using the renew policy. Failures with
+// expired certificates are logged as errors on each attempt.
+func (s *secretRenewer) renewSecrets(ctx context.Context, force bool) error {
+	s.renewing.Lock()
+	defer s.renewing.Unlock()
+
+	ctx, span := startSpan(ctx, "sds.Renew", attribute.String("sds.resource_name", s.name))
+	start := time.Now()
+	r, err := s.renew(ctx, force)
+	if r != nil || err != nil {
+		observeCertificate("renew", start, err)
+	}
+	endSpan(span, err)
+
+	// The lock prevents sending to a closed channel
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.stopped {
+		return err
+	}
+	if err != nil {
+		now := time.Now()
+		s.failures++
+		retry := s.backoff(now, force)
+		s.timer.Reset(retry)
+		s.nextRenewal = now.Add(retry)
+		s.lastError = err
+		if s.logger != nil {
+			s.logger.WithError(err).WithFields(logging.Fields{
+				"resourceName": s.name,
+				"failures":     s.failures,
+				"retry.after":  retry.String(),
+			}).Error("Error renewing certificate")
+			if cert := s.expired(now); cert != nil {
+				s.logger.WithFields(logging.Fields{
+					"resourceName": s.name,
+					"serialNumber": cert.SerialNumber.String(),
+					"notAfter":     cert.NotAfter,
+				}).Error("Certificate has expired and it will not be served")
+			}
+		}
+		return err
+	}
+	if r == nil {
+		s.schedule()
+		return nil
+	}
+	s.roots = r.roots
+	s.certificates = r.certificates
+	s.transports = r.transports
+	s.renewAt = r.renewAt
+	s.renewals = r.renewals
+	s.rootsAt = r.rootsAt
+	s.schedule()
+	s.lastRenewal = time.Now()
+	s.lastError = nil
+	s.failures = 0
+	if s.store != nil {
+		if err := s.store.Save(s.storeKey, s.name, secrets{Roots: s.roots, Certificates: s.certificates}); err != nil && s.logger != nil {
+			s.logger.WithError(err).WithField("resourceName", s.name).Warn("Error storing certificate")
+		}
 	}
-	s.timer.Reset(s.renewPeriod)
 	select {
-	case s.renewCh <- s.Secrets():
+	case s.renewCh <- secrets{Roots: s.roots, Certificates: s.certificates}:
 	default:
 	}
+	return nil
 }
 
 // Sign signs creates a new CSR ands sends it to the CA to sign it, it returns
-// the signed certificate, and a transport configured with the certificate.
-func (s *secretRenewer) sign(token string) (*tls.Certificate, *http.Transport, error) {
-	req, pk, err := ca.CreateSignRequest(token)
+// the signed certificate, and a transport configured with the certificate and
+// the given roots. The key and the certificate are renewed with the same
+// parameters, so the key type and validity of the secret request are kept on
+// renewals.
+func (s *secretRenewer) sign(ctx context.Context, token string, r *secretRequest, roots []*x509.Certificate) (*tls.Certificate, *http.Transport, error) {
+	req, pk, err := createSignRequest(token, r)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	sign, err := s.client.Sign(req)
+	ctx, span := startSpan(ctx, "ca.Sign")
+	t0 := time.Now()
+	sign, err := s.client.SignWithContext(ctx, req)
+	observeCA("sign", t0, err)
+	endSpan(span, err)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return s.createCertAndTransport(sign, pk)
+	return createCertAndTransport(sign, pk, roots)
 }
 
-func (s *secretRenewer) renew() error {
-	s.m.Lock()
-	defer s.m.Unlock()
+// renew renews the roots and the certificates that are due, or all of them if
+// force is true. The roots are updated on every renewal. Certificates that have
+// expired, or that failed to renew RenewMaxFailures times in a row, are signed
+// again with a new token if the renewer has a token source, and the keys are
+// rotated using the key rotation of the request. It returns nil if nothing was
+// due. The requests to the CA are done without holding the lock of the
+// secrets, the returned renewal, including the new keys, must replace them
+// only if all the renewals succeed. It must be called holding the renewing
+// lock.
+func (s *secretRenewer) renew(ctx context.Context, force bool) (*renewal, error) {
+	s.m.RLock()
+	newToken := s.newToken
+	s.m.RUnlock()
+
+	now := time.Now()
+	due := make([]bool, len(s.certificates))
+	renew := force || !s.rootsAt.After(now)
+	for i, t := range s.renewAt {
+		due[i] = force || !t.After(now)
+		renew = renew || due[i]
+	}
+	if !renew {
+		return nil, nil
+	}
 
-	// Update new roots
-	roots, err := s.client.Roots()
+	// Get new roots
+	t0 := time.Now()
+	roots, err := getRoots(ctx, s.client)
+	observeCA("roots", t0, err)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s.roots = apiCertToX509(roots.Certificates)
 
 	// Update client transport with new roots
 	tr, err := apiCertToTransport(roots.Certificates)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s.client.SetTransport(tracingTransport(tr))
+
+	// Renew certificates, new slices are created so the secrets previously
+	// returned are not modified.
+	r := &renewal{
+		roots:        apiCertToX509(roots.Certificates),
+		certificates: make([]*tls.Certificate, len(s.certificates)),
+		transports:   make([]*http.Transport, len(s.transports)),
+		renewAt:      make([]time.Time, len(s.renewAt)),
+		renewals:     make([]int, len(s.renewals)),
 	}
-	s.client.SetTransport(tr)
-
-	// Update certificates
 	for i, cert := range s.certificates {
-		sign, err := s.client.Renew(s.transports[i])
-		if err != nil {
-			return err
+		if !due[i] {
+			r.certificates[i], r.transports[i], r.renewAt[i], r.renewals[i] = cert, s.transports[i], s.renewAt[i], s.renewals[i]
+			continue
 		}
 
-		crt, tr, err := s.createCertAndTransport(sign, cert.PrivateKey)
+		var crt *tls.Certificate
+		var tr *http.Transport
+		expired := !now.Before(cert.Leaf.NotAfter)
+		switch {
+		case newToken != nil && (expired || s.failures >= RenewMaxFailures):
+			if s.logger != nil {
+				s.logger.WithFields(logging.Fields{
+					"resourceName": s.name,
+					"failures":     s.failures,
+					"expired":      expired,
+				}).Warn("Signing a new certificate")
+			}
+			crt, tr, err = s.resign(ctx, newToken, r.roots)
+		case s.rotation.Rotate(s.renewals[i]):
+			crt, tr, err = s.rotateKey(ctx, i, newToken, r.roots)
+		default:
+			crt, tr, err = s.renewCertificate(ctx, i, r.roots)
+			r.renewals[i] = s.renewals[i] + 1
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.certificates[i] = crt
-		s.transports[i] = tr
+		r.certificates[i] = crt
+		r.transports[i] = tr
+		r.renewAt[i] = s.policy.RenewAt(crt.Leaf, time.Now())
 	}
+	r.rootsAt = time.Now().Add(jitter(ValidationContextRenewPeriod))
 
-	return nil
+	return r, nil
 }
 
-func (s *secretRenewer) createCertAndTransport(sign *api.SignResponse, pk crypto.PrivateKey) (*tls.Certificate, *http.Transport, error) {
-	cert, err := ca.TLSCertificate(sign, pk)
+// renewCertificate renews the certificate with the given index using its
+// transport. The new transport trusts the given roots. It must be called
+// holding the renewing lock.
+func (s *secretRenewer) renewCertificate(ctx context.Context, i int, roots []*x509.Certificate) (*tls.Certificate, *http.Transport, error) {
+	ctx, span := startSpan(ctx, "ca.Renew")
+	t0 := time.Now()
+	sign, err := s.client.RenewWithContext(ctx, tracingTransport(s.transports[i]))
+	observeCA("renew", t0, err)
+	endSpan(span, err)
 	if err != nil {
 		return nil, nil, err
 	}
+	return createCertAndTransport(sign, s.certificates[i].PrivateKey, roots)
+}
 
-	tlsConfig := getDefaultTLSConfig(sign)
-	tlsConfig.Certificates = []tls.Certificate{*cert}
-	if len(s.roots) > 0 {
-		pool := x509.NewCertPool()
-		for _, cert := range s.roots {
-			pool.AddCert(cert)
+// rotateKey renews the certificate with the given index with a new key, using
+// the rekey endpoint of the CA, or signing a new certificate with a token from
+// the given token source. The new transport trusts the given roots. It must be
+// called holding the renewing lock.
+func (s *secretRenewer) rotateKey(ctx context.Context, i int, newToken func(context.Context) (string, error), roots []*x509.Certificate) (*tls.Certificate, *http.Transport, error) {
+	if s.rotation.Method == keyRotationSign {
+		if newToken == nil {
+			return nil, nil, errors.New("error rotating key: missing token source")
 		}
-		tlsConfig.RootCAs = pool
+		return s.resign(ctx, newToken, roots)
+	}
+
+	req, pk, err := createRekeyRequest(s.certificates[i].Leaf, s.request)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, span := startSpan(ctx, "ca.Rekey")
+	t0 := time.Now()
+	sign, err := s.client.RekeyWithContext(ctx, req, tracingTransport(s.transports[i]))
+	observeCA("rekey", t0, err)
+	endSpan(span, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return createCertAndTransport(sign, pk, roots)
+}
+
+// resign signs a new certificate using a new token from the given token source
+// and the parameters of the secret request. The new transport trusts the given
+// roots.
+func (s *secretRenewer) resign(ctx context.Context, newToken func(context.Context) (string, error), roots []*x509.Certificate) (*tls.Certificate, *http.Transport, error) {
+	token, err := newToken(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.sign(ctx, token, s.request, roots)
+}
+
+func createCertAndTransport(sign *api.SignResponse, pk crypto.PrivateKey, roots []*x509.Certificate) (*tls.Certificate, *http.Transport, error) {
+	cert, err := ca.TLSCertificate(sign, pk)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	tr, err := getDefaultTransport(tlsConfig)
+	tr, err := newTransport(cert, getDefaultTLSConfig(sign), roots)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -189,16 +646,46 @@ func (s *secretRenewer) createCertAndTransport(sign *api.SignResponse, pk crypto
 	return cert, tr, nil
 }
 
+// newTransport returns a transport that uses the given certificate as a
+// client certificate and trusts the given roots.
+func newTransport(cert *tls.Certificate, tlsConfig *tls.Config, roots []*x509.Certificate) (*http.Transport, error) {
+	tlsConfig.Certificates = []tls.Certificate{*cert}
+	if len(roots) > 0 {
+		pool := x509.NewCertPool()
+		for _, cert := range roots {
+			pool.AddCert(cert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return getDefaultTransport(tlsConfig)
+}
+
+// getRoots returns the roots of the CA.
+func getRoots(ctx context.Context, client *ca.Client) (*api.RootsResponse, error) {
+	ctx, span := startSpan(ctx, "ca.Roots")
+	roots, err := client.RootsWithContext(ctx)
+	endSpan(span, err)
+	return roots, err
+}
+
 func getTokenSubject(token string) (string, error) {
+	subject, _, err := getTokenSubjectAndSANs(token)
+	return subject, err
+}
+
+func getTokenSubjectAndSANs(token string) (string, []string, error) {
 	tok, err := jose.ParseSigned(token)
 	if err != nil {
-		return "", errors.Wrap(err, "error parsing token")
+		return "", nil, errors.Wrap(err, "error parsing token")
+	}
+	var claims struct {
+		jose.Claims
+		SANs []string `json:"sans"`
 	}
-	var claims jose.Claims
 	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
-		return "", errors.Wrap(err, "error parsing token")
+		return "", nil, errors.Wrap(err, "error parsing token")
 	}
-	return claims.Subject, nil
+	return claims.Subject, claims.SANs, nil
 }
 
 func apiCertToX509(certs []api.Certificate) []*x509.Certificate {
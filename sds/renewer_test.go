@@ -1,10 +1,18 @@
 package sds
 
 import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/smallstep/assert"
+	"github.com/smallstep/certificates/ca"
 )
 
 func Test_secretRenewer(t *testing.T) {
@@ -17,7 +25,7 @@ func Test_secretRenewer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	sr, err := newSecretRenewer([]string{t1})
+	sr, err := newSecretRenewer(context.Background(), []string{t1}, nil, nil)
 	if err != nil {
 		t.Errorf("newSecretRenewer() error = %v", err)
 		return
@@ -84,7 +92,7 @@ func Test_newSecretRenewer(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := newSecretRenewer(tt.args.tokens)
+			got, err := newSecretRenewer(context.Background(), tt.args.tokens, nil, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("newSecretRenewer() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -100,3 +108,342 @@ func Test_newSecretRenewer(t *testing.T) {
 		})
 	}
 }
+
+func Test_renewPolicy_RenewAt(t *testing.T) {
+	tmp := RenewJitter
+	t.Cleanup(func() {
+		RenewJitter = tmp
+	})
+	RenewJitter = 0
+
+	notBefore := time.Now().Truncate(time.Second)
+	cert := &x509.Certificate{
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(24 * time.Hour),
+	}
+	tests := []struct {
+		name     string
+		policy   renewPolicy
+		signedAt time.Time
+		want     time.Time
+	}{
+		{"default", renewPolicy{}, notBefore, notBefore.Add(8 * time.Hour)},
+		{"fraction", renewPolicy{Fraction: 0.75}, notBefore, notBefore.Add(18 * time.Hour)},
+		{"before", renewPolicy{Before: 4 * time.Hour}, notBefore, notBefore.Add(20 * time.Hour)},
+		{"before lifetime", renewPolicy{Before: 48 * time.Hour}, notBefore, notBefore.Add(144 * time.Minute)},
+		{"signed later", renewPolicy{}, notBefore.Add(7 * time.Hour), notBefore.Add(7*time.Hour + 144*time.Minute)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, tt.policy.RenewAt(cert, tt.signedAt))
+		})
+	}
+
+	// The jitter only brings renewals forward
+	RenewJitter = 0.1
+	for i := 0; i < 100; i++ {
+		got := renewPolicy{}.RenewAt(cert, notBefore)
+		assert.False(t, got.After(notBefore.Add(8*time.Hour)))
+		assert.False(t, got.Before(notBefore.Add(8*time.Hour-48*time.Minute)))
+	}
+}
+
+func Test_secretRenewer_schedule(t *testing.T) {
+	tmp := RenewJitter
+	t.Cleanup(func() {
+		RenewJitter = tmp
+	})
+	RenewJitter = 0
+
+	srv := caServer(time.Hour)
+	defer srv.Close()
+	client, err := ca.NewClient(srv.URL, ca.WithRootFile("testdata/root_ca.crt"))
+	assert.FatalError(t, err)
+
+	// Each certificate is renewed on its own schedule
+	short := storeCertificate(t, "short.smallstep.com", 3*time.Second)
+	long := storeCertificate(t, "long.smallstep.com", time.Hour)
+	sr, err := newStoredSecretRenewer(client, nil, "key", &storedSecrets{
+		secrets: secrets{
+			Roots:        rootCAs(t),
+			Certificates: []*tls.Certificate{short, long},
+		},
+		Name:      "short.smallstep.com",
+		UpdatedAt: time.Now(),
+	}, &secretRequest{Renewal: renewPolicy{Fraction: 0.5}}, nil)
+	assert.FatalError(t, err)
+	defer sr.Stop()
+
+	st := sr.Status()
+	assert.Len(t, 2, st.RenewAt)
+	assert.Equals(t, short.Leaf.NotBefore.Add(1500*time.Millisecond), st.RenewAt[0])
+	assert.Equals(t, long.Leaf.NotBefore.Add(30*time.Minute), st.RenewAt[1])
+	assert.Equals(t, st.RenewAt[0], st.NextRenewal)
+
+	select {
+	case s := <-sr.RenewChannel():
+		assert.Len(t, 2, s.Certificates)
+		assert.NotEquals(t, short.Leaf.SerialNumber, s.Certificates[0].Leaf.SerialNumber)
+		assert.Equals(t, long.Leaf.SerialNumber, s.Certificates[1].Leaf.SerialNumber)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the renewal")
+	}
+
+	st = sr.Status()
+	assert.True(t, st.RenewAt[0].After(time.Now().Add(20*time.Minute)))
+	assert.Equals(t, long.Leaf.NotBefore.Add(30*time.Minute), st.RenewAt[1])
+}
+
+func Test_secretRenewer_backoff(t *testing.T) {
+	tmpJitter, tmpMax := RenewJitter, RenewBackoffMax
+	t.Cleanup(func() {
+		RenewJitter, RenewBackoffMax = tmpJitter, tmpMax
+	})
+	RenewJitter, RenewBackoffMax = 0, time.Hour
+
+	cert := storeCertificate(t, "foo.smallstep.com", 24*time.Hour)
+	s := &secretRenewer{
+		certificates: []*tls.Certificate{cert},
+		renewAt:      []time.Time{cert.Leaf.NotBefore.Add(8 * time.Hour)},
+	}
+	now := cert.Leaf.NotBefore.Add(9 * time.Hour)
+
+	// The time doubles up to the maximum
+	for i, want := range []time.Duration{24 * time.Minute, 48 * time.Minute, time.Hour, time.Hour} {
+		s.failures = i + 1
+		assert.Equals(t, want, s.backoff(now, false))
+	}
+
+	// Retries are not scheduled after the expiration
+	assert.Equals(t, 10*time.Minute, s.backoff(cert.Leaf.NotAfter.Add(-10*time.Minute), false))
+
+	// Only the roots are due
+	s.renewAt[0] = now.Add(time.Hour)
+	s.failures = 1
+	assert.Equals(t, ValidationContextRenewPeriod/20, s.backoff(now, false))
+	assert.Equals(t, 30*time.Minute, s.backoff(now, true))
+}
+
+func Test_secretRenewer_resign(t *testing.T) {
+	tmpJitter, tmpFailures := RenewJitter, RenewMaxFailures
+	t.Cleanup(func() {
+		RenewJitter, RenewMaxFailures = tmpJitter, tmpFailures
+	})
+	RenewJitter, RenewMaxFailures = 0, 2
+
+	srv := caServer(time.Hour)
+	defer srv.Close()
+	proxy := newCAProxy(t, srv)
+	proxy.Start(t)
+	client, err := ca.NewClient(proxy.URL(), ca.WithRootFile("testdata/root_ca.crt"))
+	assert.FatalError(t, err)
+
+	p := caProvisioner(srv)
+	var tokens atomic.Int32
+	newToken := func(context.Context) (string, error) {
+		tokens.Add(1)
+		return p.Token("foo.smallstep.com")
+	}
+	newRenewer := func(cert *tls.Certificate) *secretRenewer {
+		sr, err := newStoredSecretRenewer(client, nil, "key", &storedSecrets{
+			secrets: secrets{
+				Roots:        rootCAs(t),
+				Certificates: []*tls.Certificate{cert},
+			},
+			Name:      "foo.smallstep.com",
+			UpdatedAt: time.Now(),
+		}, nil, nil)
+		assert.FatalError(t, err)
+		sr.SetTokenSource(newToken)
+		return sr
+	}
+
+	// Expired certificates are signed again with a new key
+	expired := storeCertificate(t, "foo.smallstep.com", -time.Minute)
+	sr := newRenewer(expired)
+	defer sr.Stop()
+	select {
+	case s := <-sr.RenewChannel():
+		assert.Len(t, 1, s.Certificates)
+		assert.True(t, time.Now().Before(s.Certificates[0].Leaf.NotAfter))
+		assert.NotEquals(t, expired.Leaf.PublicKey, s.Certificates[0].Leaf.PublicKey)
+		assert.Equals(t, int32(1), tokens.Load())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the renewal")
+	}
+
+	// Certificates are signed again after too many failures
+	tokens.Store(0)
+	cert := storeCertificate(t, "foo.smallstep.com", time.Hour)
+	sr = newRenewer(cert)
+	defer sr.Stop()
+	proxy.Stop()
+	assert.Error(t, sr.Renew(context.Background()))
+	assert.Error(t, sr.Renew(context.Background()))
+	st := sr.Status()
+	assert.Equals(t, 2, st.Failures)
+	assert.Error(t, st.LastError)
+	assert.True(t, st.NextRenewal.Before(time.Now().Add(5*time.Minute)))
+
+	proxy.Start(t)
+	assert.FatalError(t, sr.Renew(context.Background()))
+	assert.Equals(t, int32(1), tokens.Load())
+	st = sr.Status()
+	assert.Equals(t, 0, st.Failures)
+	assert.Nil(t, st.LastError)
+	assert.NotEquals(t, cert.Leaf.PublicKey, sr.Secrets().Certificates[0].Leaf.PublicKey)
+
+	// Without failures certificates are renewed with the same key
+	assert.FatalError(t, sr.Renew(context.Background()))
+	assert.Equals(t, int32(1), tokens.Load())
+}
+
+func Test_secretRenewer_blockedCA(t *testing.T) {
+	srv := caServer(time.Hour)
+	defer srv.Close()
+
+	// A CA that does not answer until the test ends
+	requests := make(chan struct{}, 1)
+	release := make(chan struct{})
+	blocked := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		http.Error(w, "timeout", http.StatusGatewayTimeout)
+	}))
+	blocked.TLS = srv.TLS.Clone()
+	blocked.StartTLS()
+	defer blocked.Close()
+	defer close(release)
+
+	client, err := ca.NewClient(blocked.URL, ca.WithRootFile("testdata/root_ca.crt"))
+	assert.FatalError(t, err)
+	cert := storeCertificate(t, "foo.smallstep.com", time.Hour)
+	sr, err := newStoredSecretRenewer(client, nil, "key", &storedSecrets{
+		secrets: secrets{
+			Roots:        rootCAs(t),
+			Certificates: []*tls.Certificate{cert},
+		},
+		Name:      "foo.smallstep.com",
+		UpdatedAt: time.Now(),
+	}, nil, nil)
+	assert.FatalError(t, err)
+	defer sr.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- sr.Renew(ctx)
+	}()
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the request to the CA")
+	}
+
+	// The secrets are served while the CA does not answer
+	got := make(chan secrets, 1)
+	go func() {
+		sr.Status()
+		got <- sr.Secrets()
+	}()
+	select {
+	case s := <-got:
+		assert.Equals(t, []*tls.Certificate{cert}, s.Certificates)
+	case <-time.After(time.Second):
+		t.Fatal("Secrets() is blocked by the renewal")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the renewal")
+	}
+	assert.Equals(t, 1, sr.Status().Failures)
+}
+
+func Test_keyRotation_Rotate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotation keyRotation
+		renewals int
+		want     bool
+	}{
+		{"none", keyRotation{}, 10, false},
+		{"every renewal", keyRotation{Method: "rekey"}, 0, true},
+		{"every 3", keyRotation{Method: "sign", Every: 3}, 1, false},
+		{"every 3 due", keyRotation{Method: "sign", Every: 3}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equals(t, tt.want, tt.rotation.Rotate(tt.renewals))
+		})
+	}
+}
+
+func Test_secretRenewer_rotation(t *testing.T) {
+	srv := caServer(time.Hour)
+	defer srv.Close()
+
+	p := caProvisioner(srv)
+	var tokens atomic.Int32
+	newToken := func(context.Context) (string, error) {
+		tokens.Add(1)
+		return p.Token("foo.smallstep.com")
+	}
+	renew := func(t *testing.T, sr *secretRenewer) *tls.Certificate {
+		t.Helper()
+		assert.FatalError(t, sr.Renew(context.Background()))
+		s := <-sr.RenewChannel()
+		assert.Len(t, 1, s.Certificates)
+		assert.Equals(t, s.Certificates, sr.Secrets().Certificates)
+		return s.Certificates[0]
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		tokens int32
+	}{
+		{"rekey", "rekey", 0},
+		{"sign", "sign", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens.Store(0)
+			token, err := newToken(context.Background())
+			assert.FatalError(t, err)
+			sr, err := newSecretRenewer(context.Background(), []string{token}, &secretRequest{
+				Rotation: keyRotation{Method: tt.method, Every: 2},
+			}, nil)
+			assert.FatalError(t, err)
+			defer sr.Stop()
+			sr.SetTokenSource(newToken)
+			tokens.Store(0)
+
+			// The key is kept on the first renewal
+			cert := sr.Secrets().Certificates[0]
+			renewed := renew(t, sr)
+			assert.Equals(t, cert.PrivateKey, renewed.PrivateKey)
+			assert.NotEquals(t, cert.Leaf.SerialNumber, renewed.Leaf.SerialNumber)
+
+			// And rotated on the second one with its certificate
+			rotated := renew(t, sr)
+			assert.NotEquals(t, renewed.PrivateKey, rotated.PrivateKey)
+			assert.Equals(t, rotated.PrivateKey.(crypto.Signer).Public(), rotated.Leaf.PublicKey)
+			assert.Equals(t, []string{"foo.smallstep.com"}, rotated.Leaf.DNSNames)
+			assert.Equals(t, tt.tokens, tokens.Load())
+
+			// The count starts again
+			assert.Equals(t, rotated.PrivateKey, renew(t, sr).PrivateKey)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package sds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/step-sds/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// RESTSecretsPath is the path used by Envoy to fetch secrets using the
+// REST-JSON transport.
+const RESTSecretsPath = "/v3/discovery:secrets"
+
+// RESTListenerName is the name of the listener of the REST-JSON server.
+const RESTListenerName = "rest"
+
+// maxRESTRequestSize is the maximum size of a REST discovery request.
+const maxRESTRequestSize = 1 << 20
+
+// RESTHandler returns the http.Handler that serves secrets using the REST-JSON
+// transport (Envoy api_type REST). It implements the same semantics as
+// FetchSecrets, but it returns a 304 Not Modified if the version in the request
+// is the current one.
+func (srv *Service) RESTHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+RESTSecretsPath, srv.restFetchSecrets)
+	return logging.HTTPServerMiddleware(srv.logger)(mux)
+}
+
+func (srv *Service) restFetchSecrets(w http.ResponseWriter, req *http.Request) {
+	t1 := time.Now()
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := startServerSpan(ctx, "sds.RESTFetchSecrets")
+	defer span.End()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRESTRequestSize))
+	if err != nil {
+		srv.writeRESTError(ctx, w, nil, t1, status.Errorf(codes.InvalidArgument, "error reading request: %v", err))
+		return
+	}
+	var r discovery.DiscoveryRequest
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(body, &r); err != nil {
+		srv.writeRESTError(ctx, w, nil, t1, status.Errorf(codes.InvalidArgument, "error parsing request: %v", err))
+		return
+	}
+	if !isSecretTypeURL(r.TypeUrl) {
+		srv.writeRESTError(ctx, w, &r, t1, status.Errorf(codes.InvalidArgument, "unsupported type url %s", r.TypeUrl))
+		return
+	}
+
+	requestsTotal.WithLabelValues("rest", "fetch").Inc()
+
+	// Use the same validation as gRPC requests on the default listener, with
+	// the network of the REST server if restAddress is configured
+	if _, ok := srv.getConfig().listeners[RESTListenerName]; ok {
+		ctx = NewListenerContext(ctx, RESTListenerName)
+	}
+	l, err := srv.getListener(ctx)
+	if err != nil {
+		srv.writeRESTError(ctx, w, &r, t1, err)
+		return
+	}
+	if l.isTCP && req.TLS == nil {
+		srv.writeRESTError(ctx, w, &r, t1, status.Error(codes.Unauthenticated, "missing client certificate"))
+		return
+	}
+	ctx = newHTTPPeerContext(ctx, req)
+	if err := srv.validateRequest(ctx, &r); err != nil {
+		srv.writeRESTError(ctx, w, &r, t1, err)
+		return
+	}
+
+	dr, err := srv.fetchSecrets(ctx, &r)
+	if err != nil {
+		srv.writeRESTError(ctx, w, &r, t1, err)
+		return
+	}
+	if r.VersionInfo == dr.VersionInfo {
+		w.WriteHeader(http.StatusNotModified)
+		srv.logRequest(ctx, &r, "Not modified", t1, nil)
+		return
+	}
+
+	b, err := protojson.Marshal(dr)
+	if err != nil {
+		srv.writeRESTError(ctx, w, &r, t1, status.Errorf(codes.Internal, "error marshaling response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		srv.logRequest(ctx, &r, "Write failed", t1, err)
+		return
+	}
+
+	extra := logging.Fields{
+		"nonce":           dr.Nonce,
+		"new versionInfo": dr.VersionInfo,
+	}
+	if len(certsInRequest(&r)) > 0 {
+		srv.logRequest(ctx, &r, "Certificate sent", t1, nil, extra)
+	} else {
+		srv.logRequest(ctx, &r, "Trusted CA sent", t1, nil, extra)
+	}
+}
+
+// writeRESTError writes the given error using the http status code equivalent
+// to the gRPC code of the error.
+func (srv *Service) writeRESTError(ctx context.Context, w http.ResponseWriter, r *discovery.DiscoveryRequest, start time.Time, err error) {
+	srv.logRequest(ctx, r, "Fetch failed", start, err)
+	recordError(trace.SpanFromContext(ctx), err)
+	st, _ := status.FromError(err)
+	code := httpStatusCode(st.Code())
+	http.Error(w, fmt.Sprintf("%s: %s", http.StatusText(code), st.Message()), code)
+}
+
+// newHTTPPeerContext returns a new context with the peer of the given HTTP
+// request, so HTTP requests can be validated like gRPC ones. The peer contains
+// the TLS connection state or the credentials of the peer process.
+func newHTTPPeerContext(ctx context.Context, req *http.Request) context.Context {
+	p := &peer.Peer{}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		p.Addr = addr
+	}
+	if req.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *req.TLS}
+	} else if creds, ok := peerCredentialsFromContext(req.Context()); ok {
+		p.AuthInfo = creds
+	}
+	return peer.NewContext(ctx, p)
+}
+
+// certsInRequest returns the names in the request that are not validation
+// contexts.
+func certsInRequest(r *discovery.DiscoveryRequest) []string {
+	var names []string
+	for _, name := range r.ResourceNames {
+		if !isValidationContext(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// httpStatusCode returns the http status code equivalent to the given gRPC
+// code.
+func httpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,218 @@
+package sds
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestService_RESTHandler(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	handler := srv.RESTHandler()
+
+	b, _ := pem.Decode([]byte(testCert))
+	cert, err := x509.ParseCertificate(b.Bytes)
+	assert.FatalError(t, err)
+	peerState := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}
+
+	marshal := func(r *discovery.DiscoveryRequest) []byte {
+		b, err := protojson.Marshal(r)
+		assert.FatalError(t, err)
+		return b
+	}
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	req := &discovery.DiscoveryRequest{
+		Node:          node,
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       secretTypeURL,
+	}
+
+	// Get the current version
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", RESTSecretsPath, bytes.NewReader(marshal(req))))
+	assert.Equals(t, http.StatusOK, w.Code)
+	var dr discovery.DiscoveryResponse
+	assert.FatalError(t, protojson.Unmarshal(w.Body.Bytes(), &dr))
+	version := dr.VersionInfo
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       []byte
+		isTCP      bool
+		identity   string
+		tls        *tls.ConnectionState
+		wantStatus int
+	}{
+		{"ok", "POST", RESTSecretsPath, marshal(req), false, "", nil, http.StatusOK},
+		{"ok old version", "POST", RESTSecretsPath, marshal(&discovery.DiscoveryRequest{
+			VersionInfo:   "old-version",
+			Node:          node,
+			ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+			TypeUrl:       secretTypeURL,
+		}), false, "", nil, http.StatusOK},
+		{"ok empty type url", "POST", RESTSecretsPath, marshal(&discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"validation_context"},
+		}), false, "", nil, http.StatusOK},
+		{"ok unknown fields", "POST", RESTSecretsPath, []byte(`{"resourceNames":["trusted_ca"],"foo":"bar"}`), false, "", nil, http.StatusOK},
+		{"ok tcp", "POST", RESTSecretsPath, marshal(req), true, "foo.smallstep.com", peerState, http.StatusOK},
+		{"ok not modified", "POST", RESTSecretsPath, marshal(&discovery.DiscoveryRequest{
+			VersionInfo:   version,
+			Node:          node,
+			ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+			TypeUrl:       secretTypeURL,
+		}), false, "", nil, http.StatusNotModified},
+		{"fail method", "GET", RESTSecretsPath, nil, false, "", nil, http.StatusMethodNotAllowed},
+		{"fail path", "POST", "/v3/discovery:clusters", marshal(req), false, "", nil, http.StatusNotFound},
+		{"fail json", "POST", RESTSecretsPath, []byte(`{`), false, "", nil, http.StatusBadRequest},
+		{"fail type url", "POST", RESTSecretsPath, marshal(&discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"foo.smallstep.com"},
+			TypeUrl:       "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+		}), false, "", nil, http.StatusBadRequest},
+		{"fail tcp no tls", "POST", RESTSecretsPath, marshal(req), true, "", nil, http.StatusUnauthorized},
+		{"fail tcp identity", "POST", RESTSecretsPath, marshal(req), true, "bar.smallstep.com", peerState, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var identities []string
+			if tt.identity != "" {
+				identities = []string{tt.identity}
+			}
+			m, err := newIdentityMatcher(identities)
+			assert.FatalError(t, err)
+			sc := srv.getConfig()
+			srv.config.Store(&serviceConfig{
+				provisioner:  sc.provisioner,
+				provisioners: sc.provisioners,
+				listeners: map[string]*listenerPolicy{
+					DefaultListenerName: {isTCP: tt.isTCP, authorizedIdentities: m},
+				},
+			})
+			defer srv.config.Store(sc)
+
+			var body io.Reader
+			if tt.body != nil {
+				body = bytes.NewReader(tt.body)
+			}
+			r := httptest.NewRequest(tt.method, tt.path, body)
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equals(t, tt.wantStatus, w.Code)
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			assert.Equals(t, "application/json", w.Header().Get("Content-Type"))
+			var got discovery.DiscoveryResponse
+			assert.FatalError(t, protojson.Unmarshal(w.Body.Bytes(), &got))
+			assert.True(t, got.VersionInfo != "")
+			assert.Equals(t, secretTypeURL, got.TypeUrl)
+			assert.Len(t, 64, got.Nonce)
+			for _, r := range got.Resources {
+				assert.Equals(t, secretTypeURL, r.TypeUrl)
+				var sec auth.Secret
+				assert.FatalError(t, proto.Unmarshal(r.Value, &sec))
+				if isValidationContext(sec.Name) {
+					assert.Type(t, &auth.Secret_ValidationContext{}, sec.Type)
+				} else {
+					assert.Type(t, &auth.Secret_TlsCertificate{}, sec.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestService_RESTHandler_network(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	// The REST server on a UNIX domain socket does not require the client
+	// certificate of the default listener on TCP
+	srv, err := New(Config{
+		Network:              "tcp",
+		Address:              ":8443",
+		Certificate:          "sds.crt",
+		CertificateKey:       "sds.key",
+		AuthorizedIdentities: []string{"envoy.smallstep.com"},
+		RESTNetwork:          "unix",
+		RESTAddress:          "/tmp/rest.unix",
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	b, err := protojson.Marshal(&discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"trusted_ca"},
+		TypeUrl:       secretTypeURL,
+	})
+	assert.FatalError(t, err)
+	w := httptest.NewRecorder()
+	srv.RESTHandler().ServeHTTP(w, httptest.NewRequest("POST", RESTSecretsPath, bytes.NewReader(b)))
+	assert.Equals(t, http.StatusOK, w.Code)
+}
+
+func Test_httpStatusCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code codes.Code
+		want int
+	}{
+		{"ok", codes.OK, http.StatusOK},
+		{"invalid argument", codes.InvalidArgument, http.StatusBadRequest},
+		{"unauthenticated", codes.Unauthenticated, http.StatusUnauthorized},
+		{"permission denied", codes.PermissionDenied, http.StatusForbidden},
+		{"not found", codes.NotFound, http.StatusNotFound},
+		{"unavailable", codes.Unavailable, http.StatusServiceUnavailable},
+		{"unknown", codes.Unknown, http.StatusInternalServerError},
+		{"internal", codes.Internal, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpStatusCode(tt.code); got != tt.want {
+				t.Errorf("httpStatusCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
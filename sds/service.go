@@ -7,19 +7,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	secret "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
 	"github.com/smallstep/certificates/ca"
 	"github.com/smallstep/step-sds/logging"
-	"go.step.sm/crypto/x509util"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/peer"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 // Identifier is the identifier of the secret discovery service.
@@ -35,151 +39,473 @@ var ValidationContextAltName = "validation_context"
 // ValidationContextRenewPeriod is the default period to check for new roots.
 var ValidationContextRenewPeriod = 8 * time.Hour
 
+// DefaultRenewFraction is the fraction of the lifetime of a certificate after
+// which it is renewed if its resource does not set renewFraction or
+// renewBefore.
+var DefaultRenewFraction = 1.0 / 3
+
+// RenewJitter is the maximum fraction of the time until a renewal that is
+// randomly subtracted from it, so the certificates signed at the same time are
+// not renewed at the same time.
+var RenewJitter = 0.1
+
+// RenewBackoffMax is the maximum time between the retries of a failed renewal.
+var RenewBackoffMax = 10 * time.Minute
+
+// RenewMaxFailures is the number of consecutive failed renewals after which the
+// certificates are signed again using a new token instead of renewed.
+var RenewMaxFailures = 5
+
+// RenewTimeout is the maximum time of a scheduled renewal, including all the
+// requests to the CA. The secrets are served while the renewal is in progress.
+var RenewTimeout = time.Minute
+
 // Service is the interface that an Envoy secret discovery service (SDS) has to
-// implement. They server TLS certificates to Envoy using gRPC.
+// implement. They server TLS certificates to Envoy using gRPC. Secrets are also
+// served using the aggregated discovery service (ADS).
 //
 //	type Service interface {
 //		Register(s *grpc.Server)
 //		discovery.SecretDiscoveryServiceServer
+//		discovery.AggregatedDiscoveryServiceServer
 //	}
 type Service struct {
-	provisioner           *ca.Provisioner
-	stopCh                chan struct{}
-	authorizedIdentity    string
-	authorizedFingerprint string
-	isTCP                 bool
-	logger                *logging.Logger
+	config       atomic.Pointer[serviceConfig]
+	cache        *secretCache
+	stopCh       chan struct{}
+	addresses    []string
+	m            sync.Mutex
+	tlsReloaders map[string]*TLSReloader
+	health       *healthChecker
+	streams      *streamRegistry
+	state        *stateStore
+	logger       *logging.Logger
+}
+
+// serviceConfig contains the settings of the service that can be changed
+// with a reload.
+type serviceConfig struct {
+	provisioner  *provisioner
+	provisioners map[string]*provisioner
+	profiles     []*resourceProfile
+	listeners    map[string]*listenerPolicy
+	logger       *logging.Logger
+}
+
+// newServiceConfig initializes the provisioners, resource profiles and
+// the authorization settings of the listeners in the given configuration. The
+// provisioners of the current configuration, if any, are kept if their
+// settings have not changed. Provisioners whose CA is not reachable are
+// initialized later. The given logger is used by the renewers of the secrets.
+func newServiceConfig(c Config, current *serviceConfig, logger *logging.Logger) (*serviceConfig, error) {
+	provisioners := make(map[string]*provisioner, len(c.Provisioners)+1)
+	for _, pc := range append([]ProvisionerConfig{c.Provisioner}, c.Provisioners...) {
+		if current != nil {
+			if p, ok := current.provisioners[pc.Name]; ok && p.config == pc {
+				provisioners[pc.Name] = p
+				continue
+			}
+		}
+		p, err := newProvisioner(pc)
+		if err != nil {
+			return nil, err
+		}
+		provisioners[pc.Name] = p
+	}
+
+	profiles, err := newResourceProfiles(c.Resources)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make(map[string]*listenerPolicy, len(c.Listeners)+3)
+	listenerConfigs := c.GetListeners()
+	if rest, ok := c.GetREST(); ok {
+		listenerConfigs = append(listenerConfigs, rest)
+	}
+	if admin, ok := c.GetAdmin(); ok {
+		listenerConfigs = append(listenerConfigs, admin)
+	}
+	for _, lc := range listenerConfigs {
+		l, err := newListenerPolicy(lc)
+		if err != nil {
+			return nil, err
+		}
+		listeners[lc.Name] = l
+	}
+
+	return &serviceConfig{
+		provisioner:  provisioners[c.Provisioner.Name],
+		provisioners: provisioners,
+		profiles:     profiles,
+		listeners:    listeners,
+		logger:       logger,
+	}, nil
 }
 
 // New creates a new sds.Service that will support multiple TLS certificates. It
-// will use the given CA provisioner to generate the CA tokens used to sign
-// certificates.
+// will use the given CA provisioners to generate the CA tokens used to sign
+// certificates. If the CA is not reachable, the service starts in degraded
+// mode and the provisioners are initialized in the background.
 func New(c Config) (*Service, error) {
-	p, err := ca.NewProvisioner(
-		c.Provisioner.Issuer, c.Provisioner.KeyID,
-		c.Provisioner.CaURL, []byte(c.Provisioner.Password),
-		ca.WithRootFile(c.Provisioner.CaRoot))
+	logger, err := logging.New("step-sds", c.Logger)
 	if err != nil {
 		return nil, err
 	}
 
-	logger, err := logging.New("step-sds", c.Logger)
+	sc, err := newServiceConfig(c, nil, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Service{
-		provisioner:           p,
-		stopCh:                make(chan struct{}),
-		authorizedIdentity:    c.AuthorizedIdentity,
-		authorizedFingerprint: c.AuthorizedFingerprint,
-		isTCP:                 c.IsTCP(),
-		logger:                logger,
-	}, nil
+	srv := &Service{
+		stopCh:    make(chan struct{}),
+		addresses: listenAddresses(c),
+		health:    newHealthChecker(),
+		streams:   newStreamRegistry(),
+		logger:    logger,
+	}
+	srv.health.degraded = logDegraded(sc, logger)
+	if c.State != nil {
+		if srv.state, err = newStateStore(c.State.Directory, []byte(c.GetStatePassword())); err != nil {
+			return nil, err
+		}
+		n, err := srv.state.Prune()
+		if err != nil {
+			return nil, err
+		}
+		logger.WithFields(logging.Fields{
+			"directory": c.State.Directory,
+			"secrets":   n,
+		}).Info("Loaded state directory")
+	}
+	srv.config.Store(sc)
+	srv.cache = newSecretCache(srv.newRenewer)
+	go srv.retryProvisioners()
+	return srv, nil
+}
+
+// Logger returns the logger used by the service. The logger is updated when
+// the service is reloaded.
+func (srv *Service) Logger() *logging.Logger {
+	return srv.logger
+}
+
+// getConfig returns the current settings of the service.
+func (srv *Service) getConfig() *serviceConfig {
+	return srv.config.Load()
+}
+
+// newSecretRequest returns the secret request for the given resource name
+// rendered with the given node.
+func (srv *Service) newSecretRequest(name string, node *core.Node) (*secretRequest, error) {
+	req, err := newSecretRequest(name, node, srv.getConfig().profiles)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "error creating request for %s: %v", name, err)
+	}
+	return req, nil
 }
 
-// Stop stops the current service.
+// newRenewer signs the certificate for the given secret request using the
+// current settings and returns the renewer that will keep it up to date.
+func (srv *Service) newRenewer(ctx context.Context, req *secretRequest) (*secretRenewer, error) {
+	return srv.newConfigRenewer(ctx, srv.getConfig(), resourceStateNamespace, req)
+}
+
+// newConfigRenewer signs the certificate for the given secret request using
+// the given settings and returns the renewer that will keep it up to date. If
+// the state directory is configured, the still valid secrets stored for the
+// request in the given namespace are used instead of signing a new
+// certificate, and the new ones are stored.
+func (srv *Service) newConfigRenewer(ctx context.Context, sc *serviceConfig, namespace string, req *secretRequest) (*secretRenewer, error) {
+	if srv.state == nil {
+		return sc.newRenewer(ctx, req)
+	}
+
+	key := stateKey(namespace, req)
+	s, err := sc.loadRenewer(srv.state, key, req)
+	switch {
+	case err == nil:
+		srv.logger.WithFields(logging.Fields{
+			"resourceName": req.Name,
+			"next-renewal": s.Status().NextRenewal,
+		}).Info("Loaded stored certificate")
+		return s, nil
+	case !errors.Is(err, os.ErrNotExist):
+		srv.logger.WithError(err).WithField("resourceName", req.Name).Warn("Error loading stored certificate")
+	}
+
+	if s, err = sc.newRenewer(ctx, req); err != nil {
+		return nil, err
+	}
+	if err := s.Store(srv.state, key); err != nil {
+		srv.logger.WithError(err).WithField("resourceName", req.Name).Warn("Error storing certificate")
+	}
+	return s, nil
+}
+
+// newRenewer signs the certificate for the given secret request using the
+// provisioner in the request and returns the renewer that will keep it up to
+// date. The certificate is signed in a span named after the resource.
+func (sc *serviceConfig) newRenewer(ctx context.Context, req *secretRequest) (s *secretRenewer, err error) {
+	ctx, span := startSpan(ctx, "sds.Sign", attribute.String("sds.resource_name", req.Name))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	p, err := sc.getProvisioner(req)
+	if err != nil {
+		return nil, err
+	}
+	newToken := tokenSource(p, req)
+	token, err := newToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = newSecretRenewer(ctx, []string{token}, req, sc.logger); err != nil {
+		return nil, err
+	}
+	s.SetTokenSource(newToken)
+	return s, nil
+}
+
+// loadRenewer returns a renewer for the secrets stored with the given key for
+// the given request. The stored roots must contain the root of the provisioner of the request,
+// and the renewals will use its CA. The provisioner does not need to be
+// initialized, so the stored secrets can be served while the CA is not
+// reachable.
+func (sc *serviceConfig) loadRenewer(store *stateStore, key string, req *secretRequest) (*secretRenewer, error) {
+	p, err := sc.getProvisioner(req)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := store.Load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.Trusts(stored.Roots) {
+		return nil, fmt.Errorf("stored roots of %s do not contain the root of provisioner %s", req.Name, p.Name())
+	}
+	pool := x509.NewCertPool()
+	for _, root := range stored.Roots {
+		pool.AddCert(root)
+	}
+	tr, err := getDefaultTransport(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := ca.NewClient(p.config.CaURL, ca.WithTransport(tracingTransport(tr)))
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStoredSecretRenewer(client, store, key, stored, req, sc.logger)
+	if err != nil {
+		return nil, err
+	}
+	s.SetTokenSource(tokenSource(p, req))
+	return s, nil
+}
+
+// tokenSource returns a function that generates tokens for the given request
+// using the given provisioner. Renewers use it to sign their certificates
+// again if they cannot be renewed.
+func tokenSource(p *provisioner, req *secretRequest) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		cp, err := p.Get()
+		if err != nil {
+			return "", err
+		}
+		_, span := startSpan(ctx, "ca.Token", attribute.String("ca.provisioner", p.Name()))
+		token, err := req.Token(cp)
+		endSpan(span, err)
+		return token, err
+	}
+}
+
+// getProvisioner returns the provisioner of the given request, or the
+// default one if the request does not set it.
+func (sc *serviceConfig) getProvisioner(req *secretRequest) (*provisioner, error) {
+	if req.Provisioner == "" {
+		return sc.provisioner, nil
+	}
+	p, ok := sc.provisioners[req.Provisioner]
+	if !ok {
+		return nil, fmt.Errorf("provisioner %s not found", req.Provisioner)
+	}
+	return p, nil
+}
+
+// Stop stops the current service. The health service reports NOT_SERVING
+// after the service is stopped.
 func (srv *Service) Stop() error {
+	srv.SetNotServing()
 	close(srv.stopCh)
+	srv.cache.Stop()
 	return nil
 }
 
-// Register registers the sds.Service into the given gRPC server.
+// Register registers the sds.Service into the given gRPC server as a secret
+// discovery service and as an aggregated discovery service. It also registers
+// the standard gRPC health service.
 func (srv *Service) Register(s *grpc.Server) {
 	secret.RegisterSecretDiscoveryServiceServer(s, srv)
-}
-
-func (srv *Service) DeltaSecrets(_ secret.SecretDiscoveryService_DeltaSecretsServer) (err error) {
-	return errors.New("method DeltaSecrets not implemented")
+	discovery.RegisterAggregatedDiscoveryServiceServer(s, srv)
+	healthpb.RegisterHealthServer(s, srv.health.server)
 }
 
 // StreamSecrets implements the gRPC SecretDiscoveryService service and returns
 // a stream of TLS certificates.
 func (srv *Service) StreamSecrets(sds secret.SecretDiscoveryService_StreamSecretsServer) (err error) {
-	ctx := sds.Context()
+	ctx, span := startServerSpan(sds.Context(), "sds.StreamSecrets")
+	defer func() {
+		endSpan(span, err)
+	}()
 	errCh := make(chan error)
 	reqCh := make(chan *discovery.DiscoveryRequest)
 
+	// The handler can return without reading the channels, when the stream is
+	// disconnected or the service stops, so sends also wait for the stream
+	// context, which is canceled when the handler returns.
 	go func() {
+		var node *core.Node
 		for {
 			r, err := sds.Recv()
 			if err != nil {
-				errCh <- err
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
 				return
 			}
+			// Requests for other types can be sent using ADS, they are
+			// expected and ignored
+			if !isSecretTypeURL(r.TypeUrl) {
+				logging.GetRequestEntry(ctx).WithField("typeUrl", r.TypeUrl).Debug("Ignored request for unsupported type url")
+				continue
+			}
+			// The node is usually sent only in the first request
+			if r.Node == nil {
+				r.Node = node
+			} else {
+				node = r.Node
+			}
 			if err := srv.validateRequest(ctx, r); err != nil {
-				errCh <- err
+				select {
+				case errCh <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+			select {
+			case reqCh <- r:
+			case <-ctx.Done():
 				return
 			}
-			reqCh <- r
 		}
 	}()
 
 	var t1 time.Time
-	var certs []*tls.Certificate
-	var roots []*x509.Certificate
-	var ch chan secrets
 	var nonce, versionInfo string
 	var req *discovery.DiscoveryRequest
-	var isRenewal bool
+	var sent *discovery.DiscoveryResponse
+	var sentNames []string
+
+	// acked contains the last resources acknowledged by the client, they are
+	// used as a fall back if the client keeps rejecting the new ones.
+	acked := make(map[string]*anypb.Any)
+	backoff := new(nackBackoff)
+	defer backoff.Stop()
+
+	// The node is usually sent only in the first request
+	var node *core.Node
+	sub := newSubscriber()
+	subscription := newSubscription(srv.cache, sub, func(name string) (*secretRequest, error) {
+		return srv.newSecretRequest(name, node)
+	})
+	defer subscription.Close()
+	stream := newStreamMetric("sotw")
+	defer stream.Close()
+	active := srv.streams.Add(ctx, "sotw")
+	defer srv.streams.Remove(active)
 
 	for {
+		var isRenewal, isRetry, useAcked bool
+
 		select {
 		case r := <-reqCh:
 			t1 = time.Now()
-			isRenewal = false
-
-			// Validations
-			if r.ErrorDetail != nil {
-				srv.logRequest(ctx, r, "NACK", t1, nil)
-				continue
+			if r.Node != nil {
+				node = r.Node
+				setNodeAttributes(span, node)
+				active.SetNode(node)
 			}
+
 			// Do not validate nonce/version if we're restarting the server
 			if req != nil {
-				switch {
-				case nonce != r.ResponseNonce:
+				if nonce != r.ResponseNonce {
 					srv.logRequest(ctx, r, "Invalid responseNonce", t1, fmt.Errorf("invalid responseNonce"))
 					continue
-				case r.VersionInfo == "": // initial request
-					versionInfo = srv.versionInfo()
-				case r.VersionInfo == versionInfo: // ACK
-					srv.logRequest(ctx, r, "ACK", t1, nil)
-					continue
-				default: // it should not go here
-					versionInfo = srv.versionInfo()
 				}
-			} else {
-				versionInfo = srv.versionInfo()
+				if equalResourceNames(r.ResourceNames, req.ResourceNames) {
+					switch {
+					case r.ErrorDetail != nil: // NACK
+						stream.Request("nack", node)
+						if d, ok := backoff.NACK(); ok {
+							srv.logRequest(ctx, r, "NACK", t1, nil, logging.Fields{
+								"retry":       backoff.Attempts(),
+								"retry.after": d.String(),
+							})
+						} else {
+							srv.logRequest(ctx, r, "NACK", t1, nil)
+						}
+						continue
+					case r.VersionInfo == versionInfo: // ACK
+						stream.Request("ack", node)
+						backoff.Reset()
+						acked = make(map[string]*anypb.Any, len(sentNames))
+						for i, name := range sentNames {
+							acked[name] = sent.Resources[i]
+						}
+						srv.logRequest(ctx, r, "ACK", t1, nil)
+						continue
+					}
+				}
 			}
 
-			req = r
-
-			var tokens []string
-			for _, name := range req.ResourceNames {
-				token, err := srv.provisioner.Token(name)
-				if err != nil {
-					srv.logRequest(ctx, r, "Error generating token", t1, err)
-					return err
-				}
-				tokens = append(tokens, token)
+			// Initial request or subscription changed
+			if req == nil {
+				stream.Request("initial", node)
+			} else {
+				stream.Request("update", node)
 			}
+			req = r
+			backoff.Reset()
 
-			sr, err := newSecretRenewer(tokens)
+			// Only sign the new names and stop the ones removed
+			added, removed, err := subscription.Update(ctx, req.ResourceNames)
 			if err != nil {
-				srv.logRequest(ctx, r, "Error creating renewer", t1, err)
+				srv.logRequest(ctx, r, "Error getting secrets", t1, err)
 				return err
 			}
-			//nolint:gocritic // legacy
-			defer sr.Stop()
-
-			ch = sr.RenewChannel()
-			secs := sr.Secrets()
-			certs, roots = secs.Certificates, secs.Roots
-		case secs := <-ch:
+			if len(added) > 0 || len(removed) > 0 {
+				active.SetResourceNames(subscription.Names())
+				logging.AddFields(ctx, logging.Fields{
+					"addedResourceNames":   added,
+					"removedResourceNames": removed,
+				})
+			}
+		case <-sub.C():
 			t1 = time.Now()
+			sub.Renewed()
 			isRenewal = true
-			versionInfo = srv.versionInfo()
-			certs, roots = secs.Certificates, secs.Roots
+		case <-backoff.C():
+			t1 = time.Now()
+			isRetry = true
+			useAcked = backoff.Retry()
 		case err := <-errCh:
 			t1 = time.Now()
 			if errors.Is(err, io.EOF) {
@@ -189,112 +515,152 @@ func (srv *Service) StreamSecrets(sds secret.SecretDiscoveryService_StreamSecret
 			return err
 		case <-srv.stopCh:
 			return nil
+		case <-active.Done():
+			return errStreamClosed
 		}
 
-		// Send certificates
-		dr, err := getDiscoveryResponse(req, versionInfo, certs, roots)
+		// Send certificates, the expired ones are replaced with the last
+		// version acknowledged or omitted.
+		certs, roots := collectSecrets(subscription.Entries(req.ResourceNames))
+		names, certs, expired := withoutExpired(req.ResourceNames, certs)
+		dr, err := getDiscoveryResponse(&discovery.DiscoveryRequest{ResourceNames: names}, "", certs, roots)
 		if err != nil {
 			srv.logRequest(ctx, req, "Creation of DiscoveryResponse failed", t1, err)
 			return err
 		}
+		if len(expired) > 0 {
+			srv.logRequest(ctx, req, "Expired certificates not sent", t1, fmt.Errorf("certificates for %s have expired", strings.Join(expired, ", ")))
+			for _, name := range expired {
+				if res, ok := acked[name]; ok {
+					names = append(names, name)
+					dr.Resources = append(dr.Resources, res)
+				}
+			}
+		}
+		if useAcked {
+			for i, name := range names {
+				if res, ok := acked[name]; ok {
+					dr.Resources[i] = res
+				}
+			}
+		}
+		dr.VersionInfo = getVersionInfo(dr.Resources)
+		if isRenewal {
+			// Skip renewals of secrets that have not changed
+			if dr.VersionInfo == versionInfo {
+				continue
+			}
+			backoff.Reset()
+		}
 		if err := sds.Send(dr); err != nil {
 			srv.logRequest(ctx, req, "Send failed", t1, err)
 			return err
 		}
 
-		nonce = dr.Nonce
+		sent, sentNames = dr, names
+		nonce, versionInfo = dr.Nonce, dr.VersionInfo
 		extra := logging.Fields{
-			"nonce": nonce,
+			"nonce":           nonce,
+			"new versionInfo": versionInfo,
 		}
 
-		if len(certs) > 0 {
-			if isRenewal {
-				srv.logRequest(ctx, req, "Certificate renewed", t1, err, extra)
-			} else {
-				srv.logRequest(ctx, req, "Certificate sent", t1, err, extra)
-			}
-		} else {
-			srv.logRequest(ctx, req, "Trusted CA sent", t1, err, extra)
+		switch {
+		case useAcked:
+			srv.logRequest(ctx, req, "Acknowledged secrets sent", t1, nil, extra)
+		case isRetry:
+			extra["retry"] = backoff.Attempts()
+			srv.logRequest(ctx, req, "Secrets sent again", t1, nil, extra)
+		case len(certs) > 0 && isRenewal:
+			srv.logRequest(ctx, req, "Certificate renewed", t1, nil, extra)
+		case len(certs) > 0:
+			srv.logRequest(ctx, req, "Certificate sent", t1, nil, extra)
+		default:
+			srv.logRequest(ctx, req, "Trusted CA sent", t1, nil, extra)
 		}
 	}
 }
 
 // FetchSecrets implements gRPC SecretDiscoveryService service and returns one TLS certificate.
-func (srv *Service) FetchSecrets(ctx context.Context, r *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+func (srv *Service) FetchSecrets(ctx context.Context, r *discovery.DiscoveryRequest) (dr *discovery.DiscoveryResponse, err error) {
+	ctx, span := startServerSpan(ctx, "sds.FetchSecrets")
+	defer func() {
+		endSpan(span, err)
+	}()
+	setNodeAttributes(span, r.Node)
+
 	srv.addRequestToContext(ctx, r)
+	requestsTotal.WithLabelValues("fetch", "fetch").Inc()
 	if err := srv.validateRequest(ctx, r); err != nil {
 		return nil, err
 	}
+	return srv.fetchSecrets(ctx, r)
+}
 
-	var tokens []string
-	for _, name := range r.ResourceNames {
-		token, err := srv.provisioner.Token(name)
-		if err != nil {
-			return nil, err
-		}
-		tokens = append(tokens, token)
+// fetchSecrets returns the discovery response for the given request, the
+// version of the response is based on its content.
+func (srv *Service) fetchSecrets(ctx context.Context, r *discovery.DiscoveryRequest) (*discovery.DiscoveryResponse, error) {
+	subscription := newSubscription(srv.cache, nil, func(name string) (*secretRequest, error) {
+		return srv.newSecretRequest(name, r.Node)
+	})
+	defer subscription.Close()
+	if _, err := subscription.Subscribe(ctx, r.ResourceNames); err != nil {
+		return nil, err
 	}
 
-	sr, err := newSecretRenewer(tokens)
+	certs, roots := collectSecrets(subscription.Entries(r.ResourceNames))
+	names, certs, expired := withoutExpired(r.ResourceNames, certs)
+	if len(expired) > 0 {
+		srv.logRequest(ctx, r, "Expired certificates not sent", time.Now(), fmt.Errorf("certificates for %s have expired", strings.Join(expired, ", ")))
+	}
+	dr, err := getDiscoveryResponse(&discovery.DiscoveryRequest{ResourceNames: names}, "", certs, roots)
 	if err != nil {
 		return nil, err
 	}
-	defer sr.Stop()
-
-	secs := sr.Secrets()
-	certs, roots := secs.Certificates, secs.Roots
-	versionInfo := time.Now().UTC().Format(time.RFC3339)
-
-	return getDiscoveryResponse(r, versionInfo, certs, roots)
+	dr.VersionInfo = getVersionInfo(dr.Resources)
+	return dr, nil
 }
 
-func (srv *Service) validateRequest(ctx context.Context, _ *discovery.DiscoveryRequest) error {
-	if !srv.isTCP {
-		return nil
-	}
-
-	// TLS validation
-	p, ok := peer.FromContext(ctx)
-	if !ok {
-		return status.Errorf(codes.Internal, "failed to obtain peer for request")
-	}
-
-	var cs *tls.ConnectionState
-	switch tlsInfo := p.AuthInfo.(type) {
-	case credentials.TLSInfo:
-		cs = &tlsInfo.State
-	case *credentials.TLSInfo:
-		cs = &tlsInfo.State
-	default:
-		return status.Errorf(codes.Internal, "failed to obtain connection state for request")
+// validateRequest validates the client certificate on TCP connections and
+// checks the authorization policy for the resource names in the request. The
+// policy used is the one of the listener that received the request.
+func (srv *Service) validateRequest(ctx context.Context, r *discovery.DiscoveryRequest) error {
+	l, err := srv.getListener(ctx)
+	if err != nil {
+		return err
 	}
-
-	if len(cs.PeerCertificates) == 0 {
-		return status.Errorf(codes.PermissionDenied, "missing peer certificate")
+	client, err := l.validatePeer(ctx)
+	if err != nil {
+		return err
 	}
+	return l.authorize(ctx, client, r, func(name string) (*secretRequest, error) {
+		return srv.newSecretRequest(name, r.Node)
+	})
+}
 
-	if srv.authorizedIdentity != "" {
-		cn := cs.PeerCertificates[0].Subject.CommonName
-		if !strings.EqualFold(cn, srv.authorizedIdentity) {
-			return status.Errorf(codes.PermissionDenied, "certificate common name %s is not authorized", cn)
+func (srv *Service) logRequest(ctx context.Context, r *discovery.DiscoveryRequest, msg string, start time.Time, err error, extra ...logging.Fields) {
+	var fields logging.Fields
+	if r != nil {
+		fields = logging.Fields{
+			"versionInfo":   r.VersionInfo,
+			"resourceNames": r.ResourceNames,
+			"responseNonce": r.ResponseNonce,
 		}
-	}
-
-	if srv.authorizedFingerprint != "" {
-		fp := x509util.Fingerprint(cs.PeerCertificates[0])
-		if !strings.EqualFold(fp, srv.authorizedFingerprint) {
-			return status.Errorf(codes.PermissionDenied, "certificate fingerprint %s is not authorized", fp)
+		if r.Node != nil {
+			fields["node"] = r.Node.Id
+			fields["cluster"] = r.Node.Cluster
+		}
+		if r.ErrorDetail != nil {
+			fields["code"] = r.ErrorDetail.Code
+			fields[logging.ErrorKey] = r.ErrorDetail.Message
 		}
 	}
-
-	return nil
-}
-
-func (srv *Service) versionInfo() string {
-	return time.Now().UTC().Format(time.RFC3339)
+	srv.logEntry(ctx, fields, msg, start, err, extra...)
 }
 
-func (srv *Service) logRequest(ctx context.Context, r *discovery.DiscoveryRequest, msg string, start time.Time, err error, extra ...logging.Fields) {
+// logEntry writes a log entry with the given request fields. Entries with
+// errors or with a client error detail are logged with the error level, entries
+// with extra fields with the info level, and the rest with the debug level.
+func (srv *Service) logEntry(ctx context.Context, fields logging.Fields, msg string, start time.Time, err error, extra ...logging.Fields) {
 	duration := time.Since(start)
 	entry := logging.GetRequestEntry(ctx)
 
@@ -302,19 +668,11 @@ func (srv *Service) logRequest(ctx context.Context, r *discovery.DiscoveryReques
 	entry.Data["grpc.start_time"] = start.Format(srv.logger.GetTimeFormat())
 	entry.Data["grpc.duration"] = duration.String()
 	entry.Data["grpc.duration-ns"] = duration.Nanoseconds()
-	if r != nil {
-		entry.Data["versionInfo"] = r.VersionInfo
-		entry.Data["resourceNames"] = r.ResourceNames
-		entry.Data["responseNonce"] = r.ResponseNonce
-		if r.Node != nil {
-			entry.Data["node"] = r.Node.Id
-			entry.Data["cluster"] = r.Node.Cluster
-		}
-		if r.ErrorDetail != nil {
-			entry.Data["code"] = r.ErrorDetail.Code
-			entry.Data[logging.ErrorKey] = r.ErrorDetail.Message
-		}
+	for k, v := range fields {
+		entry.Data[k] = v
 	}
+	_, hasErrorDetail := fields["code"]
+
 	var infoLevel bool
 	if len(extra) > 0 {
 		infoLevel = true
@@ -329,7 +687,7 @@ func (srv *Service) logRequest(ctx context.Context, r *discovery.DiscoveryReques
 	}
 
 	switch {
-	case err != nil || (r != nil && r.ErrorDetail != nil):
+	case err != nil || hasErrorDetail:
 		entry.Error(msg)
 	case infoLevel:
 		entry.Info(msg)
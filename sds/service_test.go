@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/test/bufconn"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
@@ -277,6 +279,115 @@ func TestService_StreamSecrets(t *testing.T) {
 	}
 }
 
+func TestService_StreamSecrets_update(t *testing.T) {
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 0
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	getSecrets := func(t *testing.T, dr *discovery.DiscoveryResponse) map[string]*auth.Secret {
+		t.Helper()
+		m := make(map[string]*auth.Secret)
+		for _, r := range dr.Resources {
+			var sec auth.Secret
+			assert.FatalError(t, proto.Unmarshal(r.Value, &sec))
+			m[sec.Name] = &sec
+		}
+		return m
+	}
+
+	stream, err := client.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	req := &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	}
+	assert.FatalError(t, stream.Send(req))
+	got, err := stream.Recv()
+	assert.FatalError(t, err)
+	secrets := getSecrets(t, got)
+	assert.Len(t, 2, secrets)
+
+	// ACK with a new set of names
+	req.VersionInfo = got.VersionInfo
+	req.ResponseNonce = got.Nonce
+	req.ResourceNames = []string{"bar.smallstep.com", "foo.smallstep.com"}
+	assert.FatalError(t, stream.Send(req))
+	got, err = stream.Recv()
+	assert.FatalError(t, err)
+	assert.NotEquals(t, req.VersionInfo, got.VersionInfo)
+	newSecrets := getSecrets(t, got)
+	assert.Len(t, 2, newSecrets)
+	assert.NotNil(t, newSecrets["bar.smallstep.com"])
+
+	// The existing certificate is kept and the removed name is released
+	assert.True(t, proto.Equal(secrets["foo.smallstep.com"], newSecrets["foo.smallstep.com"]))
+	srv.cache.m.Lock()
+	var hasFoo, hasBar, hasTrustedCA bool
+	for _, e := range srv.cache.entries {
+		switch e.name {
+		case "foo.smallstep.com":
+			hasFoo = true
+		case "bar.smallstep.com":
+			hasBar = true
+		case "trusted_ca":
+			hasTrustedCA = true
+		}
+	}
+	srv.cache.m.Unlock()
+	assert.True(t, hasFoo)
+	assert.True(t, hasBar)
+	assert.False(t, hasTrustedCA)
+
+	// The ACK of the same names is not answered, the stream is closed after it
+	req.VersionInfo = got.VersionInfo
+	req.ResponseNonce = got.Nonce
+	req.ResourceNames = []string{"foo.smallstep.com", "bar.smallstep.com"}
+	assert.FatalError(t, stream.Send(req))
+	assert.FatalError(t, stream.CloseSend())
+	_, err = stream.Recv()
+	assert.Equals(t, io.EOF, err)
+}
+
 func TestService_FetchSecrets(t *testing.T) {
 	ca := caServer(60 * time.Second)
 	defer ca.Close()
@@ -376,11 +487,253 @@ func TestService_FetchSecrets(t *testing.T) {
 						}
 					}
 				}
+
+				// The version only depends on the content
+				again, err := client.FetchSecrets(context.Background(), tt.req)
+				assert.FatalError(t, err)
+				assert.Equals(t, got.VersionInfo, again.VersionInfo)
+				assert.NotEquals(t, got.Nonce, again.Nonce)
 			}
 		})
 	}
 }
 
+func TestService_expiredCertificate(t *testing.T) {
+	ca := caServer(time.Hour)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// The certificate of bar.smallstep.com has expired and it is not renewed
+	newRenewer := srv.cache.newRenewer
+	srv.cache.newRenewer = func(ctx context.Context, req *secretRequest) (*secretRenewer, error) {
+		if req.Name != "bar.smallstep.com" {
+			return newRenewer(ctx, req)
+		}
+		return &secretRenewer{
+			name:         req.Name,
+			roots:        rootCAs(t),
+			certificates: []*tls.Certificate{storeCertificate(t, req.Name, -time.Minute)},
+			renewCh:      make(chan secrets, 1),
+			timer:        time.NewTimer(time.Hour),
+		}, nil
+	}
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	node := &core.Node{Id: "node-id", Cluster: "node-cluster"}
+	secretNames := func(t *testing.T, resources []*anypb.Any) []string {
+		t.Helper()
+		var names []string
+		for _, r := range resources {
+			var sec auth.Secret
+			assert.FatalError(t, proto.Unmarshal(r.Value, &sec))
+			names = append(names, sec.Name)
+		}
+		return names
+	}
+
+	t.Run("sotw", func(t *testing.T) {
+		stream, err := client.StreamSecrets(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+
+		req := &discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"foo.smallstep.com", "bar.smallstep.com", "trusted_ca"},
+			TypeUrl:       secretTypeURL,
+		}
+		assert.FatalError(t, stream.Send(req))
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{"foo.smallstep.com", "trusted_ca"}, secretNames(t, got.Resources))
+
+		// The stream is still open
+		req.VersionInfo, req.ResponseNonce = got.VersionInfo, got.Nonce
+		req.ResourceNames = []string{"bar.smallstep.com", "trusted_ca"}
+		assert.FatalError(t, stream.Send(req))
+		got, err = stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{"trusted_ca"}, secretNames(t, got.Resources))
+	})
+
+	t.Run("fetch", func(t *testing.T) {
+		got, err := client.FetchSecrets(context.Background(), &discovery.DiscoveryRequest{
+			Node:          node,
+			ResourceNames: []string{"bar.smallstep.com", "foo.smallstep.com"},
+			TypeUrl:       secretTypeURL,
+		})
+		assert.FatalError(t, err)
+		assert.Equals(t, []string{"foo.smallstep.com"}, secretNames(t, got.Resources))
+	})
+
+	t.Run("delta", func(t *testing.T) {
+		stream, err := client.DeltaSecrets(context.Background())
+		assert.FatalError(t, err)
+		defer stream.CloseSend()
+
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResourceNamesSubscribe: []string{"foo.smallstep.com", "bar.smallstep.com"},
+		}))
+		got, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Len(t, 1, got.Resources)
+		assert.Equals(t, "foo.smallstep.com", got.Resources[0].Name)
+		assert.Equals(t, []string{"bar.smallstep.com"}, got.RemovedResources)
+
+		// The stream is still open
+		assert.FatalError(t, stream.Send(&discovery.DeltaDiscoveryRequest{
+			Node:                   node,
+			TypeUrl:                secretTypeURL,
+			ResponseNonce:          got.Nonce,
+			ResourceNamesSubscribe: []string{"trusted_ca"},
+		}))
+		got, err = stream.Recv()
+		assert.FatalError(t, err)
+		assert.Len(t, 1, got.Resources)
+		assert.Equals(t, "trusted_ca", got.Resources[0].Name)
+	})
+}
+
+func TestService_StreamSecrets_nack(t *testing.T) {
+	ca := caServer(3 * time.Second)
+	defer ca.Close()
+
+	tmpInterval, tmpRetries := NACKRetryInterval, NACKMaxRetries
+	t.Cleanup(func() {
+		NACKRetryInterval, NACKMaxRetries = tmpInterval, tmpRetries
+	})
+	NACKRetryInterval, NACKMaxRetries = 10*time.Millisecond, 2
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// Prepare server
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	srv.Register(s)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			panic(fmt.Sprintf("Server exited with error: %v", err))
+		}
+	}()
+
+	// Prepare client
+	dialer := func(ctx context.Context, s string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	conn, err := grpc.NewClient("localhost", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial bufconn: %v", err)
+	}
+	defer conn.Close()
+	client := secret.NewSecretDiscoveryServiceClient(conn)
+
+	stream, err := client.StreamSecrets(context.Background())
+	assert.FatalError(t, err)
+	defer stream.CloseSend()
+
+	req := &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	}
+	nack := func(got *discovery.DiscoveryResponse) {
+		t.Helper()
+		assert.FatalError(t, stream.Send(&discovery.DiscoveryRequest{
+			VersionInfo:   req.VersionInfo,
+			Node:          req.Node,
+			ResourceNames: req.ResourceNames,
+			TypeUrl:       req.TypeUrl,
+			ResponseNonce: got.Nonce,
+			ErrorDetail:   &rpc.Status{Code: 123, Message: "an error"},
+		}))
+	}
+
+	// Initial request and ACK
+	assert.FatalError(t, stream.Send(req))
+	acked, err := stream.Recv()
+	assert.FatalError(t, err)
+	req.VersionInfo = acked.VersionInfo
+	req.ResponseNonce = acked.Nonce
+	assert.FatalError(t, stream.Send(req))
+
+	// Renewal is rejected
+	renewed, err := stream.Recv()
+	assert.FatalError(t, err)
+	assert.NotEquals(t, acked.VersionInfo, renewed.VersionInfo)
+	nack(renewed)
+
+	// Retries send the same version
+	got := renewed
+	for i := 0; i < NACKMaxRetries; i++ {
+		retry, err := stream.Recv()
+		assert.FatalError(t, err)
+		assert.Equals(t, renewed.VersionInfo, retry.VersionInfo)
+		assert.NotEquals(t, got.Nonce, retry.Nonce)
+		got = retry
+		nack(got)
+	}
+
+	// Fall back to the acknowledged version
+	fallback, err := stream.Recv()
+	assert.FatalError(t, err)
+	assert.Equals(t, acked.VersionInfo, fallback.VersionInfo)
+	assert.Len(t, len(acked.Resources), fallback.Resources)
+	for i := range acked.Resources {
+		assert.True(t, proto.Equal(acked.Resources[i], fallback.Resources[i]))
+	}
+	nack(fallback)
+
+	// The next response is a new renewal
+	got, err = stream.Recv()
+	assert.FatalError(t, err)
+	assert.NotEquals(t, acked.VersionInfo, got.VersionInfo)
+	assert.NotEquals(t, renewed.VersionInfo, got.VersionInfo)
+}
+
 func TestService_validateRequest(t *testing.T) {
 	req := &discovery.DiscoveryRequest{
 		VersionInfo:   "versionInfo",
@@ -419,9 +772,9 @@ func TestService_validateRequest(t *testing.T) {
 	})
 
 	type fields struct {
-		isTCP                 bool
-		authorizedIdentity    string
-		authorizedFingerprint string
+		isTCP                  bool
+		authorizedIdentities   []string
+		authorizedFingerprints []string
 	}
 	type args struct {
 		ctx context.Context
@@ -433,25 +786,34 @@ func TestService_validateRequest(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"ok unix", fields{false, "", ""}, args{ctx, req}, false},
-		{"ok tcp", fields{true, "", ""}, args{ctx, req}, false},
-		{"ok authIdentity", fields{true, "foo.smallstep.com", ""}, args{ctx, req}, false},
-		{"ok authFingerPrint", fields{true, "", fingerprint}, args{ctx, req}, false},
-		{"ok authIdentity+authFingerPrint", fields{true, "foo.smallstep.com", fingerprint}, args{ctx, req}, false},
-		{"ok authIdentity+authFingerPrint", fields{true, "foo.smallstep.com", fingerprint}, args{ctx2, req}, false},
-		{"fail no peer", fields{true, "bar.smallstep.com", fingerprint}, args{context.Background(), req}, true},
-		{"fail no peer certificate", fields{true, "bar.smallstep.com", fingerprint}, args{ctxNoPeer, req}, true},
-		{"fail authIdentity", fields{true, "bar.smallstep.com", fingerprint}, args{ctx, req}, true},
-		{"fail authFingerPrint", fields{true, "foo.smallstep.com", "123456"}, args{ctx, req}, true},
-		{"fail authIdentity+authFingerPrint", fields{true, "bar.smallstep.com", "123456"}, args{ctx, req}, true},
+		{"ok unix", fields{false, nil, nil}, args{ctx, req}, false},
+		{"ok tcp", fields{true, nil, nil}, args{ctx, req}, false},
+		{"ok authIdentity", fields{true, []string{"foo.smallstep.com"}, nil}, args{ctx, req}, false},
+		{"ok authIdentity pattern", fields{true, []string{"bar.smallstep.com", "*.smallstep.com"}, nil}, args{ctx, req}, false},
+		{"ok authIdentity regexp", fields{true, []string{`regexp:(foo|bar)\.smallstep\.com`}, nil}, args{ctx, req}, false},
+		{"ok authFingerPrint", fields{true, nil, []string{fingerprint}}, args{ctx, req}, false},
+		{"ok authFingerPrints", fields{true, nil, []string{"123456", fingerprint}}, args{ctx, req}, false},
+		{"ok authIdentity+authFingerPrint", fields{true, []string{"foo.smallstep.com"}, []string{fingerprint}}, args{ctx, req}, false},
+		{"ok authIdentity+authFingerPrint", fields{true, []string{"foo.smallstep.com"}, []string{fingerprint}}, args{ctx2, req}, false},
+		{"fail no peer", fields{true, []string{"bar.smallstep.com"}, []string{fingerprint}}, args{context.Background(), req}, true},
+		{"fail no peer certificate", fields{true, []string{"bar.smallstep.com"}, []string{fingerprint}}, args{ctxNoPeer, req}, true},
+		{"fail authIdentity", fields{true, []string{"bar.smallstep.com"}, []string{fingerprint}}, args{ctx, req}, true},
+		{"fail authIdentity regexp", fields{true, []string{"regexp:foo"}, nil}, args{ctx, req}, true},
+		{"fail authFingerPrint", fields{true, []string{"foo.smallstep.com"}, []string{"123456"}}, args{ctx, req}, true},
+		{"fail authIdentity+authFingerPrint", fields{true, []string{"bar.smallstep.com"}, []string{"123456"}}, args{ctx, req}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			srv := &Service{
-				isTCP:                 tt.fields.isTCP,
-				authorizedIdentity:    tt.fields.authorizedIdentity,
-				authorizedFingerprint: tt.fields.authorizedFingerprint,
-			}
+			identities, err := newIdentityMatcher(tt.fields.authorizedIdentities)
+			assert.FatalError(t, err)
+			srv := &Service{}
+			srv.config.Store(&serviceConfig{listeners: map[string]*listenerPolicy{
+				DefaultListenerName: {
+					isTCP:                  tt.fields.isTCP,
+					authorizedIdentities:   identities,
+					authorizedFingerprints: tt.fields.authorizedFingerprints,
+				},
+			}})
 			if err := srv.validateRequest(tt.args.ctx, tt.args.r); (err != nil) != tt.wantErr {
 				t.Errorf("Service.validateRequest() error = %v, wantErr %v", err, tt.wantErr)
 			}
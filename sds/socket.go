@@ -0,0 +1,151 @@
+package sds
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// staleSocketTimeout is the time used to check if another server is listening
+// on an existing socket file.
+var staleSocketTimeout = time.Second
+
+// Listen announces on the network and address of the given listener.
+//
+// On UNIX domain sockets, a socket file left by a previous process is removed
+// if no server answers on it, and the mode, owner and group of the new socket
+// file are set if they are configured. The socket file is removed when the
+// listener is closed. Addresses starting with "@" are sockets in the Linux
+// abstract namespace, and they do not use the file system.
+func Listen(c ListenerConfig) (net.Listener, error) {
+	if c.IsTCP() || isAbstractSocket(c.Address) {
+		lis, err := net.Listen(c.Network, c.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error listening using network '%s' and address '%s'", c.Network, c.Address)
+		}
+		return lis, nil
+	}
+
+	if err := removeStaleSocket(c.Network, c.Address); err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen(c.Network, c.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listening using network '%s' and address '%s'", c.Network, c.Address)
+	}
+	if ul, ok := lis.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	if err := setSocketPermissions(c); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+// isAbstractSocket returns if the given address is a socket in the Linux
+// abstract namespace.
+func isAbstractSocket(address string) bool {
+	return strings.HasPrefix(address, "@")
+}
+
+// removeStaleSocket removes the socket file in the given address if it exists
+// and there is no server listening on it. It fails if the file is not a socket
+// or if another server answers.
+func removeStaleSocket(network, address string) error {
+	st, err := os.Lstat(address)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "error checking %s", address)
+	case st.Mode()&os.ModeSocket == 0:
+		return errors.Errorf("error listening on %s: file exists and it is not a socket", address)
+	}
+
+	if conn, err := net.DialTimeout(network, address, staleSocketTimeout); err == nil {
+		conn.Close()
+		return errors.Errorf("error listening on %s: another server is listening on the socket", address)
+	}
+
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "error removing stale socket %s", address)
+	}
+	return nil
+}
+
+// setSocketPermissions sets the configured mode, owner and group of the
+// socket file.
+func setSocketPermissions(c ListenerConfig) error {
+	if c.SocketMode != "" {
+		mode, err := parseSocketMode(c.SocketMode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(c.Address, mode); err != nil {
+			return errors.Wrapf(err, "error setting mode of %s", c.Address)
+		}
+	}
+	if c.SocketOwner == "" && c.SocketGroup == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if c.SocketOwner != "" {
+		id, err := lookupID(c.SocketOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error looking up socketOwner %s", c.SocketOwner)
+		}
+		uid = id
+	}
+	if c.SocketGroup != "" {
+		id, err := lookupID(c.SocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error looking up socketGroup %s", c.SocketGroup)
+		}
+		gid = id
+	}
+	if err := os.Lchown(c.Address, uid, gid); err != nil {
+		return errors.Wrapf(err, "error setting owner of %s", c.Address)
+	}
+	return nil
+}
+
+// parseSocketMode parses the given octal file mode, e.g. "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("socketMode %s is not a valid file mode", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupID returns the numeric id in the given string, or looks up the id of
+// the given name.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	v, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,111 @@
+package sds
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/smallstep/assert"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	address := filepath.Join(dir, "sds.unix")
+
+	// The socket file is created with the given mode and removed on close
+	lis, err := Listen(ListenerConfig{Network: "unix", Address: address, SocketMode: "0600"})
+	assert.FatalError(t, err)
+	st, err := os.Stat(address)
+	assert.FatalError(t, err)
+	assert.Equals(t, os.FileMode(0600), st.Mode().Perm())
+	assert.True(t, st.Mode()&os.ModeSocket != 0)
+
+	// Live servers are not replaced
+	_, err = Listen(ListenerConfig{Network: "unix", Address: address})
+	assert.Error(t, err)
+
+	assert.FatalError(t, lis.Close())
+	_, err = os.Stat(address)
+	assert.True(t, os.IsNotExist(err))
+
+	// Stale sockets are replaced
+	stale, err := net.Listen("unix", address)
+	assert.FatalError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.FatalError(t, stale.Close())
+	_, err = os.Stat(address)
+	assert.FatalError(t, err)
+
+	lis, err = Listen(ListenerConfig{Network: "unix", Address: address})
+	assert.FatalError(t, err)
+	assert.FatalError(t, lis.Close())
+
+	// Other files are not removed
+	regular := filepath.Join(dir, "regular")
+	assert.FatalError(t, os.WriteFile(regular, []byte("data"), 0600))
+	_, err = Listen(ListenerConfig{Network: "unix", Address: regular})
+	assert.Error(t, err)
+	_, err = os.Stat(regular)
+	assert.FatalError(t, err)
+
+	// The owner and group can be numeric ids
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	lis, err = Listen(ListenerConfig{Network: "unix", Address: address, SocketOwner: uid, SocketGroup: gid})
+	assert.FatalError(t, err)
+	assert.FatalError(t, lis.Close())
+
+	// Unknown users fail and the socket is removed
+	_, err = Listen(ListenerConfig{Network: "unix", Address: address, SocketOwner: "step-sds-missing-user"})
+	assert.Error(t, err)
+	_, err = os.Stat(address)
+	assert.True(t, os.IsNotExist(err))
+
+	// TCP listeners
+	lis, err = Listen(ListenerConfig{Network: "tcp", Address: "127.0.0.1:0"})
+	assert.FatalError(t, err)
+	assert.FatalError(t, lis.Close())
+}
+
+func TestListen_abstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are only supported on linux")
+	}
+
+	address := fmt.Sprintf("@step-sds-test-%d", os.Getpid())
+	lis, err := Listen(ListenerConfig{Network: "unix", Address: address})
+	assert.FatalError(t, err)
+	defer lis.Close()
+
+	conn, err := net.Dial("unix", address)
+	assert.FatalError(t, err)
+	conn.Close()
+}
+
+func Test_parseSocketMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{"ok", "0660", 0660, false},
+		{"ok no prefix", "600", 0600, false},
+		{"fail empty", "", 0, true},
+		{"fail decimal", "0999", 0, true},
+		{"fail too large", "01777", 0, true},
+		{"fail string", "rw-rw----", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSocketMode(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseSocketMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equals(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package sds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.step.sm/crypto/pemutil"
+)
+
+// stateFileExt is the extension of the files in the state directory.
+const stateFileExt = ".json"
+
+// Namespaces of the keys in the state store. The SDS resources and the server
+// certificates of the listeners are stored in different files even if their
+// requests are the same, so forgetting one does not delete the other.
+const (
+	resourceStateNamespace = "sds/"
+	serverStateNamespace   = "server/"
+)
+
+// stateKey returns the key used to store the secrets of the given request in
+// the given namespace.
+func stateKey(namespace string, req *secretRequest) string {
+	return namespace + req.Key()
+}
+
+// stateStore persists the secrets signed by the service in a directory, so
+// they can be served after a restart without signing them again. There is one
+// file for each key in the secret cache, and the private keys are stored
+// encrypted with the password of the store.
+type stateStore struct {
+	dir      string
+	password []byte
+}
+
+// stateEntry is the content of a file in the state directory.
+type stateEntry struct {
+	Key          string             `json:"key"`
+	Name         string             `json:"name"`
+	UpdatedAt    time.Time          `json:"updatedAt"`
+	Roots        string             `json:"roots"`
+	Certificates []stateCertificate `json:"certificates,omitempty"`
+}
+
+// stateCertificate is a certificate chain and its encrypted private key, both
+// in PEM format.
+type stateCertificate struct {
+	Certificate string `json:"crt"`
+	Key         string `json:"key"`
+}
+
+// storedSecrets are the secrets loaded from the state directory.
+type storedSecrets struct {
+	secrets
+	Name      string
+	UpdatedAt time.Time
+}
+
+// newStateStore creates the given directory if necessary and returns a store
+// that will encrypt the private keys with the given password.
+func newStateStore(dir string, password []byte) (*stateStore, error) {
+	if len(password) == 0 {
+		return nil, errors.New("error initializing state: password cannot be empty")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "error creating %s", dir)
+	}
+	return &stateStore{
+		dir:      dir,
+		password: password,
+	}, nil
+}
+
+// filename returns the name of the file for the given cache key.
+func (st *stateStore) filename(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(st.dir, hex.EncodeToString(sum[:])+stateFileExt)
+}
+
+// Save stores the given secrets with the given cache key and name. The file
+// is replaced atomically.
+func (st *stateStore) Save(key, name string, secs secrets) error {
+	e := stateEntry{
+		Key:          key,
+		Name:         name,
+		UpdatedAt:    time.Now().UTC(),
+		Certificates: make([]stateCertificate, len(secs.Certificates)),
+	}
+	var buf bytes.Buffer
+	for _, root := range secs.Roots {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}); err != nil {
+			return errors.Wrap(err, "error encoding root")
+		}
+	}
+	e.Roots = buf.String()
+	for i, cert := range secs.Certificates {
+		buf.Reset()
+		for _, der := range cert.Certificate {
+			if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+				return errors.Wrap(err, "error encoding certificate")
+			}
+		}
+		block, err := pemutil.Serialize(cert.PrivateKey, pemutil.WithPKCS8(true), pemutil.WithPassword(st.password))
+		if err != nil {
+			return errors.Wrap(err, "error encrypting private key")
+		}
+		e.Certificates[i] = stateCertificate{
+			Certificate: buf.String(),
+			Key:         string(pem.EncodeToMemory(block)),
+		}
+	}
+
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling state")
+	}
+	filename := st.filename(key)
+	f, err := os.CreateTemp(st.dir, ".tmp-*")
+	if err != nil {
+		return errors.Wrapf(err, "error writing %s", filename)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "error writing %s", filename)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "error writing %s", filename)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return errors.Wrapf(err, "error writing %s", filename)
+	}
+	return nil
+}
+
+// Load returns the secrets stored with the given cache key. It returns an
+// error wrapping os.ErrNotExist if there are no secrets for the key, and an
+// error if the certificates have expired or cannot be decrypted.
+func (st *stateStore) Load(key string) (*storedSecrets, error) {
+	filename := st.filename(key)
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", filename)
+	}
+	var e stateEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	if e.Key != key {
+		return nil, errors.Errorf("error loading %s: key does not match", filename)
+	}
+
+	s := &storedSecrets{
+		Name:      e.Name,
+		UpdatedAt: e.UpdatedAt,
+	}
+	if s.Roots, err = pemutil.ParseCertificateBundle([]byte(e.Roots)); err != nil {
+		return nil, errors.Wrapf(err, "error loading %s", filename)
+	}
+	now := time.Now()
+	for _, c := range e.Certificates {
+		key, err := pemutil.ParseKey([]byte(c.Key), pemutil.WithPassword(st.password))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading %s", filename)
+		}
+		block, err := pemutil.Serialize(key, pemutil.WithPKCS8(true))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading %s", filename)
+		}
+		cert, err := tls.X509KeyPair([]byte(c.Certificate), pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading %s", filename)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, errors.Wrapf(err, "error loading %s", filename)
+		}
+		if now.After(cert.Leaf.NotAfter) {
+			return nil, errors.Errorf("error loading %s: certificate has expired", filename)
+		}
+		s.Certificates = append(s.Certificates, &cert)
+	}
+	return s, nil
+}
+
+// Delete removes the secrets stored with the given cache key.
+func (st *stateStore) Delete(key string) error {
+	if err := os.Remove(st.filename(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error deleting state")
+	}
+	return nil
+}
+
+// Prune removes the files with expired certificates, or that cannot be
+// loaded, from the state directory. It returns the number of valid entries.
+func (st *stateStore) Prune() (int, error) {
+	files, err := os.ReadDir(st.dir)
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading %s", st.dir)
+	}
+	var n int
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, stateFileExt) {
+			continue
+		}
+		var e stateEntry
+		filename := filepath.Join(st.dir, name)
+		if b, err := os.ReadFile(filename); err == nil && json.Unmarshal(b, &e) == nil {
+			if st.filename(e.Key) == filename {
+				if _, err := st.Load(e.Key); err == nil {
+					n++
+					continue
+				}
+			}
+		}
+		if err := os.Remove(filename); err != nil {
+			return n, errors.Wrapf(err, "error deleting %s", filename)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,247 @@
+package sds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+)
+
+// storeCertificate returns a certificate for the given common name signed by
+// the test intermediate with the given validity.
+func storeCertificate(t *testing.T, commonName string, validity time.Duration) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	b, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: []string{commonName},
+	}, key)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(b)
+	assert.FatalError(t, err)
+	cert := mustSign(csr, validity)
+	cert.PrivateKey = key
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.FatalError(t, err)
+	return cert
+}
+
+func Test_stateStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	_, err := newStateStore(dir, nil)
+	assert.Error(t, err)
+
+	st, err := newStateStore(dir, []byte("password"))
+	assert.FatalError(t, err)
+	fi, err := os.Stat(dir)
+	assert.FatalError(t, err)
+	assert.Equals(t, os.FileMode(0700), fi.Mode().Perm())
+
+	cert := storeCertificate(t, "foo.smallstep.com", time.Hour)
+	assert.FatalError(t, st.Save("foo", "foo.smallstep.com", secrets{
+		Roots:        rootCAs(t),
+		Certificates: []*tls.Certificate{cert},
+	}))
+	assert.FatalError(t, st.Save("trusted_ca", "trusted_ca", secrets{
+		Roots: rootCAs(t),
+	}))
+
+	// Private keys are encrypted
+	fi, err = os.Stat(st.filename("foo"))
+	assert.FatalError(t, err)
+	assert.Equals(t, os.FileMode(0600), fi.Mode().Perm())
+	b, err := os.ReadFile(st.filename("foo"))
+	assert.FatalError(t, err)
+	assert.True(t, strings.Contains(string(b), "ENCRYPTED PRIVATE KEY"))
+
+	s, err := st.Load("foo")
+	assert.FatalError(t, err)
+	assert.Equals(t, "foo.smallstep.com", s.Name)
+	assert.Equals(t, rootCAs(t), s.Roots)
+	assert.Len(t, 1, s.Certificates)
+	assert.Equals(t, cert.Certificate, s.Certificates[0].Certificate)
+	assert.Equals(t, cert.PrivateKey, s.Certificates[0].PrivateKey)
+	assert.Equals(t, cert.Leaf, s.Certificates[0].Leaf)
+	assert.True(t, time.Since(s.UpdatedAt) < time.Minute)
+
+	s, err = st.Load("trusted_ca")
+	assert.FatalError(t, err)
+	assert.Equals(t, rootCAs(t), s.Roots)
+	assert.Len(t, 0, s.Certificates)
+
+	_, err = st.Load("bar")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Wrong password
+	other, err := newStateStore(dir, []byte("other"))
+	assert.FatalError(t, err)
+	_, err = other.Load("foo")
+	assert.Error(t, err)
+
+	// Expired certificates
+	assert.FatalError(t, st.Save("expired", "expired.smallstep.com", secrets{
+		Roots:        rootCAs(t),
+		Certificates: []*tls.Certificate{storeCertificate(t, "expired.smallstep.com", -time.Minute)},
+	}))
+	_, err = st.Load("expired")
+	assert.Error(t, err)
+
+	// Prune removes expired and invalid files
+	assert.FatalError(t, os.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{}"), 0600))
+	assert.FatalError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("foo"), 0600))
+	n, err := st.Prune()
+	assert.FatalError(t, err)
+	assert.Equals(t, 2, n)
+	files, err := os.ReadDir(dir)
+	assert.FatalError(t, err)
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	assert.Len(t, 3, names)
+	assert.True(t, strings.Contains(strings.Join(names, ","), "README"))
+	_, err = os.Stat(st.filename("expired"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.FatalError(t, st.Delete("foo"))
+	assert.FatalError(t, st.Delete("foo"))
+	_, err = st.Load("foo")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestService_state(t *testing.T) {
+	ca := caServer(time.Hour)
+	defer ca.Close()
+
+	config := Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		State: &StateConfig{
+			Directory: t.TempDir(),
+		},
+		Logger: []byte("{}"),
+	}
+	request := &discovery.DiscoveryRequest{
+		ResourceNames: []string{"foo.smallstep.com", "trusted_ca"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	}
+	serialNumber := func(srv *Service) string {
+		t.Helper()
+		st := srv.secretsStatus("foo.smallstep.com")
+		if len(st) != 1 || len(st[0].Certificates) != 1 {
+			t.Fatalf("unexpected secrets %v", st)
+		}
+		return st[0].Certificates[0].SerialNumber
+	}
+
+	srv, err := New(config)
+	assert.FatalError(t, err)
+	_, err = srv.FetchSecrets(context.Background(), request)
+	assert.FatalError(t, err)
+	serial := serialNumber(srv)
+	srv.Stop()
+
+	// The stored certificate is served after a restart
+	srv, err = New(config)
+	assert.FatalError(t, err)
+	defer srv.Stop()
+	_, err = srv.FetchSecrets(context.Background(), request)
+	assert.FatalError(t, err)
+	assert.Equals(t, serial, serialNumber(srv))
+
+	// Renewals are stored
+	var e *cacheEntry
+	for _, ce := range srv.cache.Entries() {
+		if ce.name == "foo.smallstep.com" {
+			e = ce
+		}
+	}
+	assert.FatalError(t, e.renewer.Renew(context.Background()))
+	renewed := serialNumber(srv)
+	assert.NotEquals(t, serial, renewed)
+	key := stateKey(resourceStateNamespace, e.request)
+	assert.Equals(t, key, e.renewer.storeKey)
+	stored, err := srv.state.Load(key)
+	assert.FatalError(t, err)
+	assert.Equals(t, renewed, stored.Certificates[0].Leaf.SerialNumber.String())
+
+	// Evicted secrets are removed
+	tmp := SecretIdleTimeout
+	t.Cleanup(func() {
+		SecretIdleTimeout = tmp
+	})
+	SecretIdleTimeout = 0
+	_, err = srv.cache.Acquire(context.Background(), e.request, nil)
+	assert.FatalError(t, err)
+	srv.cache.Release(e.key, nil)
+	_, err = srv.state.Load(key)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Invalid stored secrets are signed again
+	SecretIdleTimeout = tmp
+	assert.FatalError(t, os.WriteFile(srv.state.filename(key), []byte(`{"key":"foo"}`), 0600))
+	_, err = srv.FetchSecrets(context.Background(), request)
+	assert.FatalError(t, err)
+	assert.NotEquals(t, renewed, serialNumber(srv))
+}
+
+func TestService_state_namespaces(t *testing.T) {
+	ca := caServer(time.Hour)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		State: &StateConfig{
+			Directory: t.TempDir(),
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// A server certificate and a resource with the same request
+	req, err := ServerCertificateConfig{CommonName: "foo.smallstep.com"}.secretRequest()
+	assert.FatalError(t, err)
+	server, err := srv.tlsRenewer(srv.getConfig())(context.Background(), req)
+	assert.FatalError(t, err)
+	resource, err := srv.newRenewer(context.Background(), req)
+	assert.FatalError(t, err)
+	defer resource.Stop()
+	assert.NotEquals(t, server.storeKey, resource.storeKey)
+
+	files, err := os.ReadDir(srv.state.dir)
+	assert.FatalError(t, err)
+	assert.Len(t, 2, files)
+
+	// Forgetting the server certificate keeps the resource
+	server.Forget()
+	_, err = srv.state.Load(server.storeKey)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	stored, err := srv.state.Load(resource.storeKey)
+	assert.FatalError(t, err)
+	assert.Equals(t, resource.Secrets().Certificates[0].Leaf.SerialNumber, stored.Certificates[0].Leaf.SerialNumber)
+}
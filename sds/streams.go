@@ -0,0 +1,181 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// errStreamClosed is the error returned to the clients of the streams closed
+// using the admin API. Envoy will open a new stream after it.
+var errStreamClosed = status.Error(codes.Unavailable, "stream closed by the administrator")
+
+// activeStream is a stream being served. It is used by the admin API to list
+// the clients and the resources they are subscribed to, and to close streams.
+type activeStream struct {
+	m             sync.Mutex
+	id            uint64
+	protocol      string
+	listener      string
+	address       string
+	identities    []string
+	credentials   *PeerCredentials
+	node          *core.Node
+	resourceNames []string
+	startedAt     time.Time
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// streamRegistry contains the active streams of the service.
+type streamRegistry struct {
+	m       sync.Mutex
+	lastID  uint64
+	streams map[uint64]*activeStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{
+		streams: make(map[uint64]*activeStream),
+	}
+}
+
+// Add registers a new stream of the given protocol. The listener and the peer
+// of the stream are read from the given context.
+func (r *streamRegistry) Add(ctx context.Context, protocol string) *activeStream {
+	s := &activeStream{
+		protocol:  protocol,
+		startedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	if s.listener, _ = ListenerFromContext(ctx); s.listener == "" {
+		s.listener = DefaultListenerName
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			s.address = p.Addr.String()
+		}
+		var cs *tls.ConnectionState
+		switch info := p.AuthInfo.(type) {
+		case credentials.TLSInfo:
+			cs = &info.State
+		case *credentials.TLSInfo:
+			cs = &info.State
+		case *PeerCredentials:
+			s.credentials = info
+		}
+		if cs != nil && len(cs.PeerCertificates) > 0 {
+			s.identities = certificateIdentities(cs.PeerCertificates[0])
+		}
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.lastID++
+	s.id = r.lastID
+	r.streams[s.id] = s
+	return s
+}
+
+// Remove unregisters the given stream.
+func (r *streamRegistry) Remove(s *activeStream) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	delete(r.streams, s.id)
+}
+
+// Get returns the stream with the given id.
+func (r *streamRegistry) Get(id string) (*activeStream, bool) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	s, ok := r.streams[n]
+	return s, ok
+}
+
+// List returns the active streams in the order they were started.
+func (r *streamRegistry) List() []*activeStream {
+	r.m.Lock()
+	streams := make([]*activeStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, s)
+	}
+	r.m.Unlock()
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].id < streams[j].id
+	})
+	return streams
+}
+
+// ID returns the identifier of the stream.
+func (s *activeStream) ID() string {
+	return strconv.FormatUint(s.id, 10)
+}
+
+// SetNode sets the node of the client.
+func (s *activeStream) SetNode(node *core.Node) {
+	s.m.Lock()
+	s.node = node
+	s.m.Unlock()
+}
+
+// SetResourceNames sets the resource names the client is subscribed to.
+func (s *activeStream) SetResourceNames(names []string) {
+	s.m.Lock()
+	s.resourceNames = names
+	s.m.Unlock()
+}
+
+// Close requests the stream to be closed.
+func (s *activeStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// Done returns a channel that is closed when the stream must be closed.
+func (s *activeStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Status returns the state of the stream.
+func (s *activeStream) Status() StreamStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+	st := StreamStatus{
+		ID:            s.ID(),
+		Protocol:      s.protocol,
+		Listener:      s.listener,
+		Address:       s.address,
+		Identities:    s.identities,
+		ResourceNames: s.resourceNames,
+		StartedAt:     s.startedAt,
+	}
+	if st.ResourceNames == nil {
+		st.ResourceNames = []string{}
+	}
+	if s.node != nil {
+		st.Node, st.Cluster = s.node.Id, s.node.Cluster
+	}
+	if c := s.credentials; c != nil {
+		st.Process = &ProcessStatus{
+			UID:        c.UID,
+			GID:        c.GID,
+			PID:        c.PID,
+			Executable: c.Executable,
+		}
+	}
+	return st
+}
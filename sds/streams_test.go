@@ -0,0 +1,82 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/smallstep/assert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func Test_streamRegistry(t *testing.T) {
+	r := newStreamRegistry()
+
+	// TLS stream in an additional listener
+	ctx := NewListenerContext(context.Background(), "internal")
+	ctx = peer.NewContext(ctx, &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{
+				Subject:  pkix.Name{CommonName: "envoy"},
+				DNSNames: []string{"envoy.smallstep.com"},
+			}},
+		}},
+	})
+	s1 := r.Add(ctx, "sotw")
+	s1.SetNode(&core.Node{Id: "node-1", Cluster: "backend"})
+	s1.SetResourceNames([]string{"foo.smallstep.com"})
+
+	// UNIX domain socket stream
+	ctx = peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: &PeerCredentials{UID: 1000, GID: 1000, PID: 42, Executable: "/usr/bin/envoy"},
+	})
+	s2 := r.Add(ctx, "delta")
+
+	streams := r.List()
+	assert.Len(t, 2, streams)
+	assert.Equals(t, s1, streams[0])
+	assert.Equals(t, s2, streams[1])
+
+	st := s1.Status()
+	assert.Equals(t, "1", st.ID)
+	assert.Equals(t, "sotw", st.Protocol)
+	assert.Equals(t, "internal", st.Listener)
+	assert.Equals(t, "127.0.0.1:1234", st.Address)
+	assert.Equals(t, []string{"envoy", "envoy.smallstep.com"}, st.Identities)
+	assert.Equals(t, "node-1", st.Node)
+	assert.Equals(t, "backend", st.Cluster)
+	assert.Equals(t, []string{"foo.smallstep.com"}, st.ResourceNames)
+	assert.Nil(t, st.Process)
+
+	st = s2.Status()
+	assert.Equals(t, "2", st.ID)
+	assert.Equals(t, DefaultListenerName, st.Listener)
+	assert.Equals(t, &ProcessStatus{UID: 1000, GID: 1000, PID: 42, Executable: "/usr/bin/envoy"}, st.Process)
+	assert.Equals(t, []string{}, st.ResourceNames)
+
+	got, ok := r.Get("2")
+	assert.True(t, ok)
+	assert.Equals(t, s2, got)
+	_, ok = r.Get("3")
+	assert.False(t, ok)
+	_, ok = r.Get("foo")
+	assert.False(t, ok)
+
+	// Close can be called multiple times
+	s2.Close()
+	s2.Close()
+	select {
+	case <-s2.Done():
+	default:
+		t.Fatal("stream is not done")
+	}
+
+	r.Remove(s2)
+	assert.Equals(t, []*activeStream{s1}, r.List())
+}
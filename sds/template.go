@@ -0,0 +1,90 @@
+package sds
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/pkg/errors"
+)
+
+// templateData is the data available in the templates of a resource profile.
+// For example, a SPIFFE ID can be created using:
+//
+//	spiffe://prod/{{.Node.Cluster}}/{{.Node.Id}}
+type templateData struct {
+	Name string
+	Node nodeData
+}
+
+// nodeData is the Envoy node that sent the request. The field names match the
+// ones in the Envoy configuration.
+type nodeData struct {
+	Id       string //nolint:revive,stylecheck // matches the Envoy field
+	Cluster  string
+	Locality localityData
+	Metadata map[string]interface{}
+}
+
+// localityData is the locality of an Envoy node.
+type localityData struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
+// newTemplateData returns the data used to render the templates for the given
+// resource name and node. The node can be nil.
+func newTemplateData(name string, node *core.Node) templateData {
+	data := templateData{
+		Name: name,
+		Node: nodeData{
+			Metadata: map[string]interface{}{},
+		},
+	}
+	if node != nil {
+		data.Node.Id = node.Id
+		data.Node.Cluster = node.Cluster
+		if l := node.Locality; l != nil {
+			data.Node.Locality = localityData{
+				Region:  l.Region,
+				Zone:    l.Zone,
+				SubZone: l.SubZone,
+			}
+		}
+		if node.Metadata != nil {
+			data.Node.Metadata = node.Metadata.AsMap()
+		}
+	}
+	return data
+}
+
+// isTemplate returns if the given string contains template actions.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// parseTemplate parses the given text template, missing keys in the node
+// metadata will fail when the template is rendered.
+func parseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New(text).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing template %s", text)
+	}
+	return tmpl, nil
+}
+
+// renderTemplate executes the given template with the given data. It fails if
+// the result is empty.
+func renderTemplate(tmpl *template.Template, data templateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrapf(err, "error rendering template %s", tmpl.Name())
+	}
+	s := strings.TrimSpace(buf.String())
+	if s == "" {
+		return "", errors.Errorf("template %s rendered an empty value", tmpl.Name())
+	}
+	return s, nil
+}
@@ -0,0 +1,349 @@
+package sds
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/step-sds/logging"
+	"go.step.sm/crypto/pemutil"
+)
+
+// CertificateReloadInterval is the interval used to check if the certificate,
+// key, and root files of the server have changed.
+var CertificateReloadInterval = time.Minute
+
+// TLSReloader keeps the TLS certificate of the server and the roots used to
+// verify the client certificates up to date. The certificate is either signed
+// and renewed by the CA, if the serverCertificate is configured, or reloaded
+// from disk when the crt or key files change. The client roots are reloaded
+// from disk when the root file changes, or if it is not configured and the
+// certificate is signed by the CA, they are the roots of the CA.
+type TLSReloader struct {
+	m      sync.RWMutex
+	source *tlsSource
+}
+
+// tlsSource is the source of the certificate and client roots for a given
+// configuration.
+type tlsSource struct {
+	m         sync.RWMutex
+	config    ListenerConfig
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	renewer   *secretRenewer
+	timer     *time.Timer
+	stopped   bool
+	logger    *logging.Logger
+}
+
+// NewTLSReloader loads the TLS certificate and client roots of the given
+// listener and starts the process that keeps them up to date. The reloader is
+// updated with the settings of the listener with the same name when the
+// service is reloaded.
+func (srv *Service) NewTLSReloader(c ListenerConfig) (*TLSReloader, error) {
+	source, err := newTLSSource(srv.tlsRenewer(srv.getConfig()), c, srv.logger)
+	if err != nil {
+		return nil, err
+	}
+	r := &TLSReloader{source: source}
+	srv.m.Lock()
+	if srv.tlsReloaders == nil {
+		srv.tlsReloaders = make(map[string]*TLSReloader)
+	}
+	srv.tlsReloaders[c.Name] = r
+	srv.m.Unlock()
+	return r, nil
+}
+
+// tlsRenewer returns the function used to sign the server certificates with
+// the given settings. The certificates are stored in the state directory if it
+// is configured.
+func (srv *Service) tlsRenewer(sc *serviceConfig) func(context.Context, *secretRequest) (*secretRenewer, error) {
+	return func(ctx context.Context, req *secretRequest) (*secretRenewer, error) {
+		return srv.newConfigRenewer(ctx, sc, serverStateNamespace, req)
+	}
+}
+
+// newTLSSource loads the certificate and client roots in the given
+// configuration. The certificate is signed using the given function if
+// serverCertificate is set.
+func newTLSSource(newRenewer func(context.Context, *secretRequest) (*secretRenewer, error), c ListenerConfig, logger *logging.Logger) (*tlsSource, error) {
+	r := &tlsSource{
+		config:   c,
+		modTimes: make(map[string]time.Time),
+		logger:   logger,
+	}
+
+	if scc := c.ServerCertificate; scc != nil {
+		req, err := scc.secretRequest()
+		if err != nil {
+			return nil, err
+		}
+		if r.renewer, err = newRenewer(context.Background(), req); err != nil {
+			return nil, errors.Wrap(err, "error signing server certificate")
+		}
+		r.setSecrets(r.renewer.Secrets())
+		go r.watchRenewer()
+	} else if err := r.loadCertificate(); err != nil {
+		return nil, err
+	}
+
+	if c.Root != "" {
+		if err := r.loadClientCAs(); err != nil {
+			r.Stop()
+			return nil, err
+		}
+	}
+
+	if r.renewer == nil || c.Root != "" {
+		r.timer = time.AfterFunc(CertificateReloadInterval, r.reload)
+	}
+	return r, nil
+}
+
+// TLSConfig returns the tls.Config used by the server. The config always
+// serves the current certificate and verifies the client certificates with the
+// current roots. ALPN supports HTTP/2 and HTTP/1.1 so the same configuration
+// can be used in the gRPC and REST servers.
+func (r *TLSReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = r.ClientCAs()
+		return cfg, nil
+	}
+	return base
+}
+
+// GetCertificate returns the current certificate of the server.
+func (r *TLSReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.getSource().GetCertificate()
+}
+
+// ClientCAs returns the current pool used to verify the client certificates.
+// It returns nil if the system roots are used.
+func (r *TLSReloader) ClientCAs() *x509.CertPool {
+	return r.getSource().ClientCAs()
+}
+
+// Stop stops the renewal and reload of the certificate and roots.
+func (r *TLSReloader) Stop() {
+	r.getSource().Stop()
+}
+
+func (r *TLSReloader) getSource() *tlsSource {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.source
+}
+
+// setSource replaces the current source and stops the previous one. The
+// stored secrets of the previous server certificate are removed unless the new
+// source uses them.
+func (r *TLSReloader) setSource(source *tlsSource) {
+	r.m.Lock()
+	old := r.source
+	r.source = source
+	r.m.Unlock()
+	old.Stop()
+	if old.renewer != nil && (source.renewer == nil || old.renewer.storeKey != source.renewer.storeKey) {
+		old.renewer.Forget()
+	}
+}
+
+// sameConfig returns if the given listener has the same TLS settings than the
+// source.
+func (r *tlsSource) sameConfig(c ListenerConfig) bool {
+	return r.config.Root == c.Root &&
+		r.config.Certificate == c.Certificate &&
+		r.config.CertificateKey == c.CertificateKey &&
+		r.config.Password == c.Password &&
+		reflect.DeepEqual(r.config.ServerCertificate, c.ServerCertificate)
+}
+
+func (r *tlsSource) GetCertificate() (*tls.Certificate, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.cert, nil
+}
+
+func (r *tlsSource) ClientCAs() *x509.CertPool {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.clientCAs
+}
+
+func (r *tlsSource) Stop() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.renewer != nil {
+		r.renewer.Stop()
+	}
+}
+
+// watchRenewer updates the certificate and the roots with the renewals of the
+// server certificate.
+func (r *tlsSource) watchRenewer() {
+	for s := range r.renewer.RenewChannel() {
+		r.setSecrets(s)
+		if len(s.Certificates) > 0 {
+			r.logger.WithFields(logging.Fields{
+				"certificate.notAfter": s.Certificates[0].Leaf.NotAfter.Format(time.RFC3339),
+			}).Info("Server certificate renewed")
+		}
+	}
+}
+
+func (r *tlsSource) setSecrets(s secrets) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if len(s.Certificates) > 0 {
+		r.cert = s.Certificates[0]
+	}
+	if r.config.Root == "" {
+		pool := x509.NewCertPool()
+		for _, crt := range s.Roots {
+			pool.AddCert(crt)
+		}
+		r.clientCAs = pool
+	}
+}
+
+// reload reloads the certificate, key and root files if they have changed.
+// Errors are logged and the previous values are kept until the files change
+// again.
+func (r *tlsSource) reload() {
+	if r.renewer == nil && (r.changed(r.config.Certificate) || r.changed(r.config.CertificateKey)) {
+		if err := r.loadCertificate(); err != nil {
+			r.setModTimes(r.config.Certificate, r.config.CertificateKey)
+			r.logger.WithError(err).Error("Error reloading server certificate")
+		} else {
+			r.logger.Info("Server certificate reloaded")
+		}
+	}
+	if r.config.Root != "" && r.changed(r.config.Root) {
+		if err := r.loadClientCAs(); err != nil {
+			r.setModTimes(r.config.Root)
+			r.logger.WithError(err).Error("Error reloading client roots")
+		} else {
+			r.logger.Info("Client roots reloaded")
+		}
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.stopped {
+		r.timer.Reset(CertificateReloadInterval)
+	}
+}
+
+// changed returns if the modification time of the given file is not the one
+// of the last load.
+func (r *tlsSource) changed(filename string) bool {
+	mt := ModTime(filename)
+	if mt.IsZero() {
+		return false
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return !mt.Equal(r.modTimes[filename])
+}
+
+// setModTimes stores the current modification time of the given files.
+func (r *tlsSource) setModTimes(filenames ...string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, fn := range filenames {
+		r.modTimes[fn] = ModTime(fn)
+	}
+}
+
+// loadCertificate loads the certificate and key of the server. The key can be
+// encrypted with the configured password.
+func (r *tlsSource) loadCertificate() error {
+	crtModTime, keyModTime := ModTime(r.config.Certificate), ModTime(r.config.CertificateKey)
+	crtPEM, err := os.ReadFile(r.config.Certificate)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", r.config.Certificate)
+	}
+	keyBytes, err := os.ReadFile(r.config.CertificateKey)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", r.config.CertificateKey)
+	}
+	opts := []pemutil.Options{
+		pemutil.WithFilename(r.config.CertificateKey),
+	}
+	if r.config.Password != "" {
+		opts = append(opts, pemutil.WithPassword([]byte(r.config.Password)))
+	}
+	key, err := pemutil.Parse(keyBytes, opts...)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := pemutil.Serialize(key)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(crtPEM, pem.EncodeToMemory(keyPEM))
+	if err != nil {
+		return errors.Wrap(err, "error loading certificate")
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.cert = &cert
+	r.modTimes[r.config.Certificate] = crtModTime
+	r.modTimes[r.config.CertificateKey] = keyModTime
+	return nil
+}
+
+// loadClientCAs loads the roots used to verify the client certificates.
+func (r *tlsSource) loadClientCAs() error {
+	mt := ModTime(r.config.Root)
+	b, err := os.ReadFile(r.config.Root)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", r.config.Root)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return errors.Errorf("failed to successfully load root certificates from %s", r.config.Root)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.clientCAs = pool
+	r.modTimes[r.config.Root] = mt
+	return nil
+}
+
+// ModTime returns the modification time of the given file, or the zero time if
+// it cannot be read. It is used to detect changes in the files of the server
+// certificates and in the configuration file.
+func ModTime(filename string) time.Time {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
@@ -0,0 +1,226 @@
+package sds
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smallstep/assert"
+	"github.com/smallstep/step-sds/logging"
+)
+
+// writeTLSFiles writes a new certificate signed by the test intermediate for
+// the given common name, its key, and the given roots in the given directory.
+func writeTLSFiles(t *testing.T, dir, commonName string, roots ...string) (string, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.FatalError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: commonName},
+		DNSNames: []string{commonName},
+	}, key)
+	assert.FatalError(t, err)
+	csr, err := x509.ParseCertificateRequest(der)
+	assert.FatalError(t, err)
+	cert := mustSign(csr, time.Hour)
+
+	var crtPEM []byte
+	for _, b := range cert.Certificate {
+		crtPEM = append(crtPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	assert.FatalError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+
+	var rootPEM []byte
+	for _, r := range roots {
+		rootPEM = append(rootPEM, []byte(r+"\n")...)
+	}
+
+	crtFile := filepath.Join(dir, "sds_server.crt")
+	keyFile := filepath.Join(dir, "sds_server_key")
+	rootFile := filepath.Join(dir, "root_ca.crt")
+	assert.FatalError(t, os.WriteFile(crtFile, crtPEM, 0600))
+	assert.FatalError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	assert.FatalError(t, os.WriteFile(rootFile, rootPEM, 0600))
+
+	// Make sure the modification times change
+	mt := time.Now().Add(time.Duration(len(roots)) * time.Minute)
+	for _, fn := range []string{crtFile, keyFile, rootFile} {
+		assert.FatalError(t, os.Chtimes(fn, mt, mt))
+	}
+	return crtFile, keyFile, rootFile
+}
+
+func TestTLSReloader_files(t *testing.T) {
+	tmp := CertificateReloadInterval
+	t.Cleanup(func() {
+		CertificateReloadInterval = tmp
+	})
+	CertificateReloadInterval = 50 * time.Millisecond
+
+	logger, err := logging.New("step-sds", []byte("{}"))
+	assert.FatalError(t, err)
+	srv := &Service{logger: logger}
+
+	dir := t.TempDir()
+	crtFile, keyFile, rootFile := writeTLSFiles(t, dir, "sds.smallstep.com", testRootCA)
+	r, err := srv.NewTLSReloader(ListenerConfig{
+		Network:        "tcp",
+		Root:           rootFile,
+		Certificate:    crtFile,
+		CertificateKey: keyFile,
+	})
+	assert.FatalError(t, err)
+	defer r.Stop()
+
+	cert, err := r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "sds.smallstep.com", cert.Leaf.Subject.CommonName)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(testRootCA))
+	assert.True(t, pool.Equal(r.ClientCAs()))
+
+	// The config uses the current certificate and roots
+	cfg, err := r.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.FatalError(t, err)
+	assert.Equals(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	assert.True(t, pool.Equal(cfg.ClientCAs))
+	got, err := cfg.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.True(t, got == cert)
+
+	// The files are reloaded when they change
+	writeTLSFiles(t, dir, "new.smallstep.com", testRootCA, testIntermediateCert)
+	pool.AppendCertsFromPEM([]byte(testIntermediateCert))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, err = r.GetCertificate(nil)
+		assert.FatalError(t, err)
+		if cert.Leaf.Subject.CommonName == "new.smallstep.com" && pool.Equal(r.ClientCAs()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invalid files keep the previous certificate
+	assert.FatalError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	mt := time.Now().Add(time.Hour)
+	assert.FatalError(t, os.Chtimes(keyFile, mt, mt))
+	time.Sleep(200 * time.Millisecond)
+	got, err = r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.True(t, got == cert)
+}
+
+func TestTLSReloader_fail(t *testing.T) {
+	logger, err := logging.New("step-sds", []byte("{}"))
+	assert.FatalError(t, err)
+	srv := &Service{logger: logger}
+
+	dir := t.TempDir()
+	crtFile, keyFile, rootFile := writeTLSFiles(t, dir, "sds.smallstep.com", testRootCA)
+	badFile := filepath.Join(dir, "bad.crt")
+	assert.FatalError(t, os.WriteFile(badFile, []byte("not a certificate"), 0600))
+
+	tests := []struct {
+		name string
+		c    ListenerConfig
+	}{
+		{"fail crt", ListenerConfig{Certificate: filepath.Join(dir, "missing.crt"), CertificateKey: keyFile}},
+		{"fail key", ListenerConfig{Certificate: crtFile, CertificateKey: filepath.Join(dir, "missing_key")}},
+		{"fail key pair", ListenerConfig{Certificate: badFile, CertificateKey: keyFile}},
+		{"fail root", ListenerConfig{Root: filepath.Join(dir, "missing.crt"), Certificate: crtFile, CertificateKey: keyFile}},
+		{"fail root pem", ListenerConfig{Root: badFile, Certificate: crtFile, CertificateKey: keyFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := srv.NewTLSReloader(tt.c)
+			assert.Error(t, err)
+			assert.Nil(t, r)
+		})
+	}
+
+	r, err := srv.NewTLSReloader(ListenerConfig{Root: rootFile, Certificate: crtFile, CertificateKey: keyFile})
+	assert.FatalError(t, err)
+	r.Stop()
+	r.Stop()
+}
+
+func TestTLSReloader_serverCertificate(t *testing.T) {
+	ca := caServer(3 * time.Second)
+	defer ca.Close()
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	r, err := srv.NewTLSReloader(ListenerConfig{
+		Network: "tcp",
+		ServerCertificate: &ServerCertificateConfig{
+			CommonName:  "sds.smallstep.com",
+			DNSNames:    []string{"sds.internal"},
+			IPAddresses: []string{"127.0.0.1"},
+		},
+	})
+	assert.FatalError(t, err)
+	defer r.Stop()
+
+	cert, err := r.GetCertificate(nil)
+	assert.FatalError(t, err)
+	assert.Equals(t, "sds.smallstep.com", cert.Leaf.Subject.CommonName)
+	assert.Equals(t, []string{"sds.smallstep.com", "sds.internal"}, cert.Leaf.DNSNames)
+	assert.Len(t, 1, cert.Leaf.IPAddresses)
+
+	// Without a root file the client roots are the CA roots
+	pool := x509.NewCertPool()
+	for _, crt := range rootCAs(t) {
+		pool.AddCert(crt)
+	}
+	assert.True(t, pool.Equal(r.ClientCAs()))
+
+	// The certificate is renewed by the CA
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := r.GetCertificate(nil)
+		assert.FatalError(t, err)
+		if got.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+			assert.Equals(t, "sds.smallstep.com", got.Leaf.Subject.CommonName)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for renewal")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Unknown provisioners fail
+	_, err = srv.NewTLSReloader(ListenerConfig{
+		Network: "tcp",
+		ServerCertificate: &ServerCertificateConfig{
+			CommonName:  "sds.smallstep.com",
+			Provisioner: "missing",
+		},
+	})
+	assert.Error(t, err)
+}
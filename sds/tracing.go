@@ -0,0 +1,183 @@
+package sds
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/ca"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.step.sm/crypto/jose"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultTracingServiceName is the service name used in the traces if the
+// configuration does not define one.
+const DefaultTracingServiceName = "step-sds"
+
+const tracerName = "github.com/smallstep/step-sds/sds"
+
+// StartTracing configures the global OpenTelemetry tracer provider to export
+// the traces to the OTLP collector in the given configuration, and the W3C
+// trace context propagator. It returns the function that flushes the pending
+// spans and stops the exporter. If the configuration is nil, tracing is not
+// enabled and the returned function does nothing.
+func StartTracing(ctx context.Context, c *TracingConfig) (func(context.Context) error, error) {
+	if c == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(c.Headers))
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating trace exporter")
+	}
+
+	name := c.ServiceName
+	if name == "" {
+		name = DefaultTracingServiceName
+	}
+	ratio := 1.0
+	if c.SampleRatio != nil {
+		ratio = *c.SampleRatio
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", name),
+			attribute.String("service.version", Identifier),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a new span with the given name as a child of the span in
+// the given context, if any.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startServerSpan starts the span of a request received by the service. The
+// trace context sent by the client in the gRPC metadata, if any, is used as the
+// parent of the span, otherwise the span in the given context is used.
+func startServerSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	var attrs []attribute.KeyValue
+	if method, ok := grpc.Method(ctx); ok {
+		attrs = append(attrs, attribute.String("rpc.method", method))
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// setNodeAttributes adds the id and cluster of the given node to the span.
+func setNodeAttributes(span trace.Span, node *core.Node) {
+	if node != nil {
+		span.SetAttributes(
+			attribute.String("sds.node.id", node.Id),
+			attribute.String("sds.node.cluster", node.Cluster),
+		)
+	}
+}
+
+// endSpan records the given error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	recordError(span, err)
+	span.End()
+}
+
+// recordError records the given error, if any, and sets the status of the
+// span as failed.
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+}
+
+// metadataCarrier adapts the gRPC metadata to a propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// tracingTransport returns a transport that creates a span for each request
+// and propagates the trace context to the CA.
+func tracingTransport(tr http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(tr)
+}
+
+// bootstrap is like ca.Bootstrap but the requests of the returned client
+// propagate the trace context to the CA. It creates a client using the CA url
+// and the root fingerprint in the given token.
+func bootstrap(ctx context.Context, token string) (c *ca.Client, err error) {
+	_, span := startSpan(ctx, "ca.Bootstrap")
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	tok, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing token")
+	}
+	var claims struct {
+		jose.Claims
+		SHA string `json:"sha"`
+	}
+	if err := tok.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, errors.Wrap(err, "error parsing token")
+	}
+
+	switch {
+	case claims.SHA == "":
+		return nil, errors.New("invalid bootstrap token: sha claim is not present")
+	case len(claims.Audience) == 0 || !strings.HasPrefix(strings.ToLower(claims.Audience[0]), "http"):
+		return nil, errors.New("invalid bootstrap token: aud claim is not a url")
+	}
+	if u, err := url.Parse(claims.Audience[0]); err == nil {
+		span.SetAttributes(attribute.String("ca.url", u.Scheme+"://"+u.Host))
+	}
+
+	return ca.NewClient(claims.Audience[0], ca.WithRootSHA256(claims.SHA), ca.WithTransportDecorator(tracingTransport))
+}
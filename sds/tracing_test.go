@@ -0,0 +1,163 @@
+package sds
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/smallstep/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceCollector is a stand-in of an OTLP collector that keeps all the spans
+// received.
+type traceCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	m     sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *traceCollector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+// Spans returns the spans received by name.
+func (c *traceCollector) Spans() map[string]*tracepb.Span {
+	c.m.Lock()
+	defer c.m.Unlock()
+	spans := make(map[string]*tracepb.Span)
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func startTraceCollector(t *testing.T) (*traceCollector, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.FatalError(t, err)
+	c := new(traceCollector)
+	s := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(s, c)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return c, lis.Addr().String()
+}
+
+func TestStartTracing(t *testing.T) {
+	collector, endpoint := startTraceCollector(t)
+	shutdown, err := StartTracing(context.Background(), &TracingConfig{
+		Endpoint: endpoint,
+		Insecure: true,
+	})
+	assert.FatalError(t, err)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	// Record the trace context sent to the CA
+	var m sync.Mutex
+	var traceparents []string
+	ca := caServer(60 * time.Second)
+	defer ca.Close()
+	handler := ca.Config.Handler
+	ca.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		traceparents = append(traceparents, r.Header.Get("Traceparent"))
+		m.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+
+	srv, err := New(Config{
+		Provisioner: ProvisionerConfig{
+			Issuer:   "sds@smallstep.com",
+			KeyID:    "oA1x2nV3yClaf2kQdPOJ_LEzTGw5ow4r2A5SWl3MfMg",
+			Password: "password",
+			CaURL:    ca.URL,
+			CaRoot:   "testdata/root_ca.crt",
+		},
+		Logger: []byte("{}"),
+	})
+	assert.FatalError(t, err)
+	defer srv.Stop()
+
+	// The trace is continued from the client
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentID := "00f067aa0ba902b7"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-"+traceID+"-"+parentID+"-01",
+	))
+	ctx = NewListenerContext(ctx, DefaultListenerName)
+	_, err = srv.FetchSecrets(ctx, &discovery.DiscoveryRequest{
+		Node:          &core.Node{Id: "node-id", Cluster: "node-cluster"},
+		ResourceNames: []string{"foo.smallstep.com"},
+		TypeUrl:       "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret",
+	})
+	assert.FatalError(t, err)
+
+	// Renewals start a new trace
+	entries := srv.cache.Entries()
+	assert.Len(t, 1, entries)
+	assert.FatalError(t, entries[0].renewer.Renew(context.Background()))
+
+	assert.FatalError(t, shutdown(context.Background()))
+
+	spans := collector.Spans()
+	for _, name := range []string{
+		"sds.FetchSecrets", "sds.Sign", "ca.Token", "ca.Bootstrap", "ca.Roots", "ca.Sign",
+		"sds.Renew", "ca.Renew",
+	} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("span %s not found", name)
+		}
+	}
+
+	fetch := spans["sds.FetchSecrets"]
+	assert.Equals(t, traceID, hex.EncodeToString(fetch.TraceId))
+	assert.Equals(t, parentID, hex.EncodeToString(fetch.ParentSpanId))
+	assert.Equals(t, fetch.SpanId, spans["sds.Sign"].ParentSpanId)
+	for _, name := range []string{"ca.Token", "ca.Bootstrap", "ca.Sign"} {
+		assert.Equals(t, spans["sds.Sign"].SpanId, spans[name].ParentSpanId)
+	}
+	renew := spans["sds.Renew"]
+	assert.Len(t, 0, renew.ParentSpanId)
+	assert.Equals(t, renew.SpanId, spans["ca.Renew"].ParentSpanId)
+	assert.NotEquals(t, traceID, hex.EncodeToString(renew.TraceId))
+
+	// The trace context is propagated to the CA
+	m.Lock()
+	defer m.Unlock()
+	var signed bool
+	for _, tp := range traceparents {
+		if strings.HasPrefix(tp, "00-"+traceID+"-") {
+			signed = true
+		}
+	}
+	assert.True(t, signed, "trace context not propagated to the CA")
+	assert.True(t, strings.HasPrefix(traceparents[len(traceparents)-1], "00-"+hex.EncodeToString(renew.TraceId)+"-"))
+}
+
+func TestStartTracing_disabled(t *testing.T) {
+	shutdown, err := StartTracing(context.Background(), nil)
+	assert.FatalError(t, err)
+	assert.FatalError(t, shutdown(context.Background()))
+}
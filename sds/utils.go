@@ -2,9 +2,13 @@ package sds
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
+	"time"
 
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	auth "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
@@ -12,18 +16,43 @@ import (
 	"github.com/pkg/errors"
 	"go.step.sm/crypto/pemutil"
 	"go.step.sm/crypto/randutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 )
 
 const secretTypeURL = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
 
+// isSecretTypeURL returns if the given type url is empty or the secret type
+// url.
+func isSecretTypeURL(typeURL string) bool {
+	return typeURL == "" || typeURL == secretTypeURL
+}
+
 // isValidationContext returns if the given name is one of the predefined
 // validation context names.
 func isValidationContext(name string) bool {
 	return name == ValidationContextName || name == ValidationContextAltName
 }
 
+// equalResourceNames returns if both lists contain the same resource names,
+// regardless of their order.
+func equalResourceNames(a, b []string) bool {
+	setA := make(map[string]struct{}, len(a))
+	for _, name := range a {
+		setA[name] = struct{}{}
+	}
+	setB := make(map[string]struct{}, len(b))
+	for _, name := range b {
+		if _, ok := setA[name]; !ok {
+			return false
+		}
+		setB[name] = struct{}{}
+	}
+	return len(setA) == len(setB)
+}
+
 // getDiscoveryResponse returns the api.DiscoveryResponse for the given request.
 func getDiscoveryResponse(r *discovery.DiscoveryRequest, versionInfo string, certs []*tls.Certificate, roots []*x509.Certificate) (*discovery.DiscoveryResponse, error) {
 	nonce, err := randutil.Hex(64)
@@ -62,6 +91,38 @@ func getDiscoveryResponse(r *discovery.DiscoveryRequest, versionInfo string, cer
 	}, nil
 }
 
+// getSecret returns the marshaled secret with the given name using the
+// certificate or the roots in the given secrets.
+func getSecret(name string, secs secrets) ([]byte, error) {
+	if isValidationContext(name) {
+		return getTrustedCA(name, secs.Roots)
+	}
+	if len(secs.Certificates) == 0 {
+		return nil, errors.Errorf("missing certificate for %s", name)
+	}
+	return getCertificateChain(name, secs.Certificates[0])
+}
+
+// resourceVersion returns the version of a resource based on its content.
+func resourceVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// getVersionInfo returns the version of a discovery response based on the
+// content of its resources.
+func getVersionInfo(resources []*anypb.Any) string {
+	h := sha256.New()
+	for _, r := range resources {
+		b := []byte(r.TypeUrl)
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(b))))
+		h.Write(b)
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(r.Value))))
+		h.Write(r.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
 func getTrustedCA(name string, roots []*x509.Certificate) ([]byte, error) {
 	var chain bytes.Buffer
 	for _, crt := range roots {
@@ -84,7 +145,42 @@ func getTrustedCA(name string, roots []*x509.Certificate) ([]byte, error) {
 	return v, errors.Wrapf(err, "error marshaling secret")
 }
 
+// certificateExpired returns if the given certificate has expired.
+func certificateExpired(cert *tls.Certificate) bool {
+	return cert.Leaf != nil && !time.Now().Before(cert.Leaf.NotAfter)
+}
+
+// withoutExpired returns the given resource names and certificates, in the
+// same order, without the certificates that have expired. It also returns the
+// names of the expired certificates.
+func withoutExpired(names []string, certs []*tls.Certificate) ([]string, []*tls.Certificate, []string) {
+	var i int
+	var validNames, expired []string
+	var validCerts []*tls.Certificate
+	for _, name := range names {
+		if isValidationContext(name) {
+			validNames = append(validNames, name)
+			continue
+		}
+		cert := certs[i]
+		i++
+		if certificateExpired(cert) {
+			expired = append(expired, name)
+			continue
+		}
+		validNames = append(validNames, name)
+		validCerts = append(validCerts, cert)
+	}
+	return validNames, validCerts, expired
+}
+
+// getCertificateChain returns the secret with the given certificate chain and
+// key. Expired certificates are never served.
 func getCertificateChain(name string, cert *tls.Certificate) ([]byte, error) {
+	if certificateExpired(cert) {
+		return nil, status.Errorf(codes.Unavailable, "certificate for %s expired at %s", name, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
 	var chain bytes.Buffer
 	for _, c := range cert.Certificate {
 		chain.Write(pem.EncodeToMemory(&pem.Block{
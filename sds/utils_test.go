@@ -22,6 +22,8 @@ import (
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/smallstep/certificates/ca"
@@ -176,6 +178,18 @@ func Test_getDiscoveryResponse(t *testing.T) {
 	}
 }
 
+func Test_getCertificateChain_expired(t *testing.T) {
+	cert := storeCertificate(t, "foo.smallstep.com", -time.Minute)
+	_, err := getCertificateChain("foo.smallstep.com", cert)
+	require.Error(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = getDiscoveryResponse(&discovery.DiscoveryRequest{
+		ResourceNames: []string{"foo.smallstep.com"},
+	}, "", []*tls.Certificate{cert}, rootCAs(t))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
 func rootCAs(t *testing.T) []*x509.Certificate {
 	t.Helper()
 
@@ -265,6 +279,10 @@ func mustSign(csr *x509.CertificateRequest, validity time.Duration) *tls.Certifi
 func caServer(signValidity time.Duration) *httptest.Server {
 	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
+		case "/health":
+			sendJSON(w, map[string]interface{}{
+				"status": "ok",
+			})
 		case "/roots", "/1.0/roots":
 			sendJSON(w, map[string]interface{}{
 				"crts": []string{testRootCA},
@@ -275,7 +293,8 @@ func caServer(signValidity time.Duration) *httptest.Server {
 			})
 		case "/sign", "/1.0/sign":
 			body := struct {
-				CsrPEM string `json:"csr"`
+				CsrPEM   string `json:"csr"`
+				NotAfter string `json:"notAfter"`
 			}{}
 			readJSON(w, r, &body)
 			b, _ := pem.Decode([]byte(body.CsrPEM))
@@ -284,6 +303,32 @@ func caServer(signValidity time.Duration) *httptest.Server {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			validity := signValidity
+			if body.NotAfter != "" {
+				if validity, err = time.ParseDuration(body.NotAfter); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			crt := mustSign(csr, validity)
+			sendJSON(w, map[string]interface{}{
+				"crt": string(pem.EncodeToMemory(&pem.Block{
+					Type:  "CERTIFICATE",
+					Bytes: crt.Certificate[0],
+				})),
+				"ca": testIntermediateCert,
+			})
+		case "/rekey", "/1.0/rekey":
+			body := struct {
+				CsrPEM string `json:"csr"`
+			}{}
+			readJSON(w, r, &body)
+			b, _ := pem.Decode([]byte(body.CsrPEM))
+			csr, err := x509.ParseCertificateRequest(b.Bytes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			crt := mustSign(csr, signValidity)
 			sendJSON(w, map[string]interface{}{
 				"crt": string(pem.EncodeToMemory(&pem.Block{
@@ -392,3 +437,60 @@ func caProvisioner(srv *httptest.Server) *ca.Provisioner {
 	}
 	return p
 }
+
+func Test_equalResourceNames(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want bool
+	}{
+		{"ok empty", nil, []string{}, true},
+		{"ok same", []string{"foo", "bar"}, []string{"foo", "bar"}, true},
+		{"ok order", []string{"foo", "bar"}, []string{"bar", "foo"}, true},
+		{"ok duplicates", []string{"foo", "bar", "foo"}, []string{"bar", "foo"}, true},
+		{"fail added", []string{"foo"}, []string{"foo", "bar"}, false},
+		{"fail removed", []string{"foo", "bar"}, []string{"foo"}, false},
+		{"fail different", []string{"foo", "bar"}, []string{"foo", "zar"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := equalResourceNames(tt.a, tt.b); got != tt.want {
+				t.Errorf("equalResourceNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isSecretTypeURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		typeURL string
+		want    bool
+	}{
+		{"secret", "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret", true},
+		{"empty", "", true},
+		{"cluster", "type.googleapis.com/envoy.config.cluster.v3.Cluster", false},
+		{"v2", "type.googleapis.com/envoy.api.v2.auth.Secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSecretTypeURL(tt.typeURL); got != tt.want {
+				t.Errorf("isSecretTypeURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getVersionInfo(t *testing.T) {
+	a := []*anypb.Any{{TypeUrl: secretTypeURL, Value: []byte("foo")}}
+	b := []*anypb.Any{{TypeUrl: secretTypeURL, Value: []byte("bar")}}
+	ab := []*anypb.Any{a[0], b[0]}
+	ba := []*anypb.Any{b[0], a[0]}
+
+	assert.Len(t, getVersionInfo(a), 32)
+	assert.Equal(t, getVersionInfo(a), getVersionInfo([]*anypb.Any{{TypeUrl: secretTypeURL, Value: []byte("foo")}}))
+	assert.NotEqual(t, getVersionInfo(a), getVersionInfo(b))
+	assert.NotEqual(t, getVersionInfo(ab), getVersionInfo(ba))
+	assert.NotEqual(t, getVersionInfo(nil), getVersionInfo(a))
+}